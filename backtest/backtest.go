@@ -0,0 +1,213 @@
+// Package backtest replays the market snapshots recorded in the bot's DB
+// through the bot's strategy, exits, throttle and risk limits, filling the
+// orders against the recorded AMMs and paying funding every epoch.
+package backtest
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	fbot "fbot/bot"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// DEFAULT_FUNDING_INTERVAL: Length of a funding epoch unless configured
+// otherwise.
+const DEFAULT_FUNDING_INTERVAL = time.Hour
+
+// DEFAULT_FEE_RATIO: Trading fee ratio, exchange plus ecosystem fund, unless
+// configured otherwise.
+var DEFAULT_FEE_RATIO = sdk.MustNewDecFromStr("0.002")
+
+// Config: The simulated account and the bot settings of a backtest.
+type Config struct {
+	// Wallet: Starting coins, including the tx fee denom, see fbot.TX_FEE.
+	Wallet sdk.Coins
+	// FeeRatio: Fraction of the notional charged on every fill.
+	FeeRatio sdk.Dec
+	// FundingInterval: Length of a funding epoch. Every epoch, positions pay
+	// their size times the mark/index gap, scaled to the epoch as a
+	// fraction of a day.
+	FundingInterval time.Duration
+
+	RiskLimits fbot.RiskLimits
+	Throttle   fbot.Throttle
+	ExitRules  fbot.ExitRules
+}
+
+// Step: The market state recorded at one block.
+type Step struct {
+	Block int64
+	Time  time.Time
+	Amms  map[string]fbot.AmmFields
+	// Prices: Index and mark price of each pair of Amms.
+	Prices map[string]fbot.Prices
+}
+
+// LoadSteps returns a Step for every block with prices in the block and
+// time range of query, with the AMMs and prices recorded at that block. A
+// pair recorded twice in a block keeps its latest rows, and a pair without
+// an AMM at the block is not traded; blocks without AMMs are left out. A
+// query pair keeps only that pair.
+//
+// Prices and AMMs are read in one query each, whatever the number of
+// blocks.
+func LoadSteps(botdb *fbot.BotDB, query fbot.DBQuery) ([]Step, error) {
+
+	prices, err := botdb.QueryPrices(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(prices) == 0 {
+		return []Step{}, nil
+	}
+
+	steps := []Step{}
+	// byBlock: Index in steps of the step of each block.
+	byBlock := make(map[int64]int)
+	for _, row := range prices {
+		i, exists := byBlock[row.BlockHeight]
+		if !exists {
+			i = len(steps)
+			byBlock[row.BlockHeight] = i
+			steps = append(steps, Step{
+				Block:  row.BlockHeight,
+				Time:   row.CreatedAt.UTC(),
+				Amms:   make(map[string]fbot.AmmFields),
+				Prices: make(map[string]fbot.Prices),
+			})
+		}
+		if steps[i].Prices[row.Pair], err = fbot.PricesFromRow(row); err != nil {
+			return nil, fmt.Errorf("Block %d: %w", row.BlockHeight, err)
+		}
+	}
+
+	// The amms of the blocks with prices, whatever their time.
+	ammQuery := fbot.DBQuery{Pair: query.Pair, FromBlock: steps[0].Block, ToBlock: steps[len(steps)-1].Block}
+	amms, err := botdb.QueryAmms(ammQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range amms {
+		i, exists := byBlock[row.BlockHeight]
+		if !exists {
+			continue
+		}
+		price, exists := steps[i].Prices[row.Pair]
+		if !exists {
+			continue
+		}
+		if steps[i].Amms[row.Pair], err = fbot.AmmFromRow(row, price); err != nil {
+			return nil, fmt.Errorf("Block %d: %w", row.BlockHeight, err)
+		}
+	}
+
+	traded := []Step{}
+	for _, step := range steps {
+		if len(step.Amms) > 0 {
+			traded = append(traded, step)
+		}
+	}
+
+	return traded, nil
+}
+
+// Trade: One simulated fill.
+type Trade struct {
+	Block int64
+	Time  time.Time
+	Pair  string
+	// Action: The fbot.TradeAction that sent the order, e.g. close_and_open
+	// or stop_loss.
+	Action string
+	// Side: long, short or close.
+	Side     string
+	Notional sdk.Dec
+	Base     sdk.Dec
+	Price    sdk.Dec
+	Fee      sdk.Dec
+	// RealizedPnl: PnL of the position closed, before fees and funding.
+	RealizedPnl sdk.Dec
+}
+
+// EquityPoint: Value of the simulated account after a step, in quote units:
+// quote coins in the wallet plus margin and unrealized PnL of the positions.
+type EquityPoint struct {
+	Block  int64
+	Time   time.Time
+	Equity sdk.Dec
+}
+
+// Summary: Stats of a backtest.
+type Summary struct {
+	Steps       int
+	StartEquity sdk.Dec
+	EndEquity   sdk.Dec
+	// TotalReturn: EndEquity / StartEquity - 1.
+	TotalReturn float64
+	// MaxDrawdown: Largest fall of the equity from a previous peak, as a
+	// fraction of the peak.
+	MaxDrawdown float64
+	Trades      int
+	// RoundTrips: Positions closed, Wins those whose realized PnL, funding
+	// and fees are positive.
+	RoundTrips  int
+	Wins        int
+	Losses      int
+	WinRate     float64
+	RealizedPnl sdk.Dec
+	FundingPnl  sdk.Dec
+	Fees        sdk.Dec
+	TxFees      sdk.Coin
+}
+
+// Adjustment: An order cut down or skipped because the simulated wallet
+// couldn't pay it.
+type Adjustment struct {
+	Block  int64
+	Time   time.Time
+	Pair   string
+	Action string
+	// Requested and Filled: Margin of the order, or of the position for a
+	// close, and margin filled, zero if the order was skipped.
+	Requested sdk.Int
+	Filled    sdk.Int
+	Reason    string
+}
+
+// Result: The trade list, equity curve and summary of a backtest.
+type Result struct {
+	Trades      []Trade
+	Adjustments []Adjustment
+	Equity      []EquityPoint
+	Summary     Summary
+}
+
+// summarize fills the equity based stats of the summary from the curve.
+func (result *Result) summarize() {
+
+	summary := &result.Summary
+	summary.Steps = len(result.Equity)
+	summary.Trades = len(result.Trades)
+	summary.EndEquity = summary.StartEquity
+	if len(result.Equity) > 0 {
+		summary.EndEquity = result.Equity[len(result.Equity)-1].Equity
+	}
+	if summary.StartEquity.IsPositive() {
+		summary.TotalReturn = summary.EndEquity.Quo(summary.StartEquity).MustFloat64() - 1
+	}
+	if summary.RoundTrips > 0 {
+		summary.WinRate = float64(summary.Wins) / float64(summary.RoundTrips)
+	}
+
+	peak := summary.StartEquity.MustFloat64()
+	for _, point := range result.Equity {
+		equity := point.Equity.MustFloat64()
+		peak = math.Max(peak, equity)
+		if peak > 0 {
+			summary.MaxDrawdown = math.Max(summary.MaxDrawdown, (peak-equity)/peak)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package backtest_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fbot/backtest"
+	fbot "fbot/bot"
+
+	perpTypes "github.com/NibiruChain/nibiru/x/perp/v2/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/stretchr/testify/require"
+)
+
+const pair = "ubtc:unusd"
+
+func step(block int64, at time.Time, quoteReserve, baseReserve int64, indexPrice string) backtest.Step {
+	amm := perpTypes.AMM{
+		QuoteReserve:    sdk.NewDec(quoteReserve),
+		BaseReserve:     sdk.NewDec(baseReserve),
+		PriceMultiplier: sdk.OneDec(),
+		SqrtDepth:       sdk.ZeroDec(),
+		TotalLong:       sdk.ZeroDec(),
+		TotalShort:      sdk.ZeroDec(),
+	}
+	return backtest.Step{
+		Block: block,
+		Time:  at,
+		Amms:  map[string]fbot.AmmFields{pair: {Markets: amm, Bias: sdk.ZeroDec()}},
+		Prices: map[string]fbot.Prices{pair: {
+			IndexPrice: sdk.MustNewDecFromStr(indexPrice),
+			MarkPrice:  amm.MarkPrice(),
+		}},
+	}
+}
+
+func TestRun(t *testing.T) {
+
+	start := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	steps := []backtest.Step{
+		// Mark 1 below index 1.2: the strategy goes long.
+		step(10, start, 1_000_000, 1_000_000, "1.2"),
+		// Mark overshot the index: the long is closed with a profit above a
+		// tenth of its notional and a small short opened.
+		step(20, start.Add(time.Hour), 1_118_034, 894_427, "1.19"),
+		// Mark back at the index: the short is kept.
+		step(30, start.Add(2*time.Hour), 1_000_000, 1_000_000, "1"),
+	}
+	config := backtest.Config{
+		Wallet: sdk.NewCoins(sdk.NewInt64Coin("unusd", 1_000_000), sdk.NewInt64Coin("unibi", 1_000_000)),
+	}
+
+	result, err := backtest.Run(steps, config)
+	require.NoError(t, err)
+
+	require.Len(t, result.Trades, 3)
+	require.Equal(t, fbot.SIDE_LONG, result.Trades[0].Side)
+	require.Equal(t, fbot.OpenOrder.String(), result.Trades[0].Action)
+	require.True(t, result.Trades[0].Base.IsPositive())
+	require.Equal(t, fbot.SIDE_CLOSE, result.Trades[1].Side)
+	require.Equal(t, fbot.CloseAndOpenOrder.String(), result.Trades[1].Action)
+	require.Equal(t, int64(20), result.Trades[1].Block)
+	require.True(t, result.Trades[1].RealizedPnl.IsPositive())
+	require.Equal(t, fbot.SIDE_SHORT, result.Trades[2].Side)
+	require.True(t, result.Trades[2].Base.IsNegative())
+
+	summary := result.Summary
+	require.Equal(t, 3, summary.Steps)
+	require.Len(t, result.Equity, 3)
+	require.Equal(t, sdk.NewDec(1_000_000), summary.StartEquity)
+	require.Equal(t, 1, summary.RoundTrips)
+	require.Equal(t, 1, summary.Wins)
+	require.Equal(t, 1.0, summary.WinRate)
+	require.True(t, summary.EndEquity.GT(summary.StartEquity))
+	require.Greater(t, summary.TotalReturn, 0.0)
+	require.Equal(t, sdk.NewInt64Coin("unibi", 3_000), summary.TxFees)
+}
+
+func TestRunPayoutShortfall(t *testing.T) {
+
+	start := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	steps := []backtest.Step{
+		step(10, start, 1_000_000, 1_000_000, "1.2"),
+		// Mark overshot the index: the long is closed and a large short
+		// opened with the released margin and PnL, of which the close pays
+		// out less than the mark promised.
+		step(20, start.Add(time.Hour), 1_118_034, 894_427, "1"),
+	}
+	config := backtest.Config{
+		// Just the first order, margin and trading fee.
+		Wallet: sdk.NewCoins(sdk.NewInt64Coin("unusd", 87_304), sdk.NewInt64Coin("unibi", 1_000_000)),
+	}
+
+	result, err := backtest.Run(steps, config)
+	require.NoError(t, err)
+
+	require.Len(t, result.Trades, 3)
+	require.Len(t, result.Adjustments, 1)
+	adjustment := result.Adjustments[0]
+	require.Equal(t, int64(20), adjustment.Block)
+	require.Equal(t, fbot.CloseAndOpenOrder.String(), adjustment.Action)
+	require.True(t, adjustment.Filled.IsPositive())
+	require.True(t, adjustment.Filled.LT(adjustment.Requested))
+	require.Contains(t, adjustment.Reason, "wallet holds")
+	require.True(t, result.Trades[2].Notional.Equal(sdk.NewDecFromInt(adjustment.Filled)))
+	require.True(t, result.Summary.EndEquity.IsPositive())
+}
+
+func TestRunCloseTxFeeShortfall(t *testing.T) {
+
+	start := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	steps := []backtest.Step{
+		step(10, start, 1_000_000, 1_000_000, "1.2"),
+		// The close-and-open of TestRun, cut to a close by fbot.CheckFunds
+		// for want of unibi, which the close lacks too.
+		step(20, start.Add(time.Hour), 1_118_034, 894_427, "1.19"),
+	}
+	config := backtest.Config{
+		// Tx fees of the first order only.
+		Wallet: sdk.NewCoins(sdk.NewInt64Coin("unusd", 1_000_000), fbot.TX_FEE),
+	}
+
+	result, err := backtest.Run(steps, config)
+	require.NoError(t, err)
+
+	require.Len(t, result.Trades, 1)
+	require.Len(t, result.Adjustments, 1)
+	adjustment := result.Adjustments[0]
+	require.Equal(t, int64(20), adjustment.Block)
+	require.Equal(t, fbot.CloseOrder.String(), adjustment.Action)
+	require.True(t, adjustment.Requested.IsPositive())
+	require.True(t, adjustment.Filled.IsZero())
+	require.Contains(t, adjustment.Reason, "position kept")
+	require.Equal(t, 0, result.Summary.RoundTrips)
+	require.Len(t, result.Equity, 2)
+}
+
+func TestRunRiskAndFunding(t *testing.T) {
+
+	start := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	steps := []backtest.Step{
+		step(10, start, 1_000_000, 1_000_000, "1.2"),
+		// Mark stays below the index for a day: the long receives funding.
+		step(20, start.Add(24*time.Hour), 1_000_000, 1_000_000, "1.2"),
+	}
+	config := backtest.Config{
+		Wallet:          sdk.NewCoins(sdk.NewInt64Coin("unusd", 1_000_000), sdk.NewInt64Coin("unibi", 1_000_000)),
+		FundingInterval: 12 * time.Hour,
+		RiskLimits:      fbot.RiskLimits{MaxPairNotional: sdk.NewDec(10_000)},
+	}
+
+	result, err := backtest.Run(steps, config)
+	require.NoError(t, err)
+
+	require.Len(t, result.Trades, 1)
+	require.Equal(t, sdk.NewDec(10_000), result.Trades[0].Notional)
+	require.True(t, result.Summary.FundingPnl.IsPositive())
+	require.Equal(t, 0, result.Summary.RoundTrips)
+}
+
+func TestRunStopLoss(t *testing.T) {
+
+	start := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	steps := []backtest.Step{
+		step(10, start, 1_000_000, 1_000_000, "1.2"),
+		// Mark falls to 0.81.
+		step(20, start.Add(time.Hour), 900_000, 1_111_111, "1.2"),
+	}
+	rules, err := fbot.ParseExitRules("*/stop_loss=5%")
+	require.NoError(t, err)
+	config := backtest.Config{
+		Wallet:    sdk.NewCoins(sdk.NewInt64Coin("unusd", 1_000_000), sdk.NewInt64Coin("unibi", 1_000_000)),
+		ExitRules: rules,
+	}
+
+	result, err := backtest.Run(steps, config)
+	require.NoError(t, err)
+
+	require.Len(t, result.Trades, 2)
+	require.Equal(t, fbot.EXIT_STOP_LOSS, result.Trades[1].Action)
+	require.Equal(t, 1, result.Summary.Losses)
+	require.Greater(t, result.Summary.MaxDrawdown, 0.0)
+}
+
+func TestLoadSteps(t *testing.T) {
+
+	botDB, err := fbot.CreateAndConnectDB(filepath.Join(t.TempDir(), "backtest.db"))
+	require.NoError(t, err)
+
+	for _, s := range []backtest.Step{
+		step(10, time.Time{}, 1_000_000, 1_000_000, "1.2"),
+		step(20, time.Time{}, 1_095_445, 912_871, "1.19"),
+	} {
+		_, err := botDB.SaveSnapshot(fbot.Snapshot{BlockHeight: s.Block, Amms: s.Amms, Prices: s.Prices})
+		require.NoError(t, err)
+	}
+	// Prices written again after a trade, and of a pair without an AMM.
+	require.NoError(t, botDB.PopulatePricesTable(map[string]fbot.Prices{
+		pair:         {IndexPrice: sdk.MustNewDecFromStr("1.18"), MarkPrice: sdk.MustNewDecFromStr("1.2")},
+		"ueth:unusd": {IndexPrice: sdk.NewDec(2000), MarkPrice: sdk.NewDec(2000)},
+	}, 20))
+
+	steps, err := backtest.LoadSteps(&botDB, fbot.DBQuery{FromBlock: 15})
+	require.NoError(t, err)
+	require.Len(t, steps, 1)
+	require.Equal(t, int64(20), steps[0].Block)
+	require.False(t, steps[0].Time.IsZero())
+	require.Equal(t, sdk.NewDec(1_095_445), steps[0].Amms[pair].Markets.QuoteReserve)
+	require.Equal(t, sdk.MustNewDecFromStr("1.18"), steps[0].Prices[pair].IndexPrice)
+	require.NotContains(t, steps[0].Amms, "ueth:unusd")
+
+	steps, err = backtest.LoadSteps(&botDB, fbot.DBQuery{})
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+	require.Equal(t, sdk.NewDec(1_000_000), steps[0].Amms[pair].Markets.BaseReserve)
+
+	steps, err = backtest.LoadSteps(&botDB, fbot.DBQuery{Pair: "ueth:unusd"})
+	require.NoError(t, err)
+	require.Empty(t, steps)
+}
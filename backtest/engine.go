@@ -0,0 +1,458 @@
+package backtest
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	fbot "fbot/bot"
+
+	"github.com/NibiruChain/nibiru/x/common/asset"
+	perpTypes "github.com/NibiruChain/nibiru/x/perp/v2/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// position: A simulated position. Size is signed, longs positive.
+type position struct {
+	Size         sdk.Dec
+	OpenNotional sdk.Dec
+	Margin       sdk.Dec
+	// Carry: Funding and fees of the position so far, negative when paid.
+	Carry sdk.Dec
+}
+
+// engine: The simulated account, and the bot whose strategy it runs.
+type engine struct {
+	config      Config
+	bot         *fbot.Bot
+	wallet      sdk.Coins
+	positions   map[string]*position
+	step        Step
+	lastFunding time.Time
+	result      Result
+}
+
+// Run replays steps, in order, through the strategy and settings of config.
+// At every step it pays the funding of the epochs that ended, closes the
+// positions that hit an exit rule, then plans the strategy's order of every
+// pair with fbot.Bot.PlanTrade and fills it against the step's AMM.
+//
+// The AMM of a pair is moved by the fills within a step, but every step
+// starts from the reserves recorded at its block: the recorded market never
+// saw the simulated orders.
+func Run(steps []Step, config Config) (Result, error) {
+
+	if config.FeeRatio.IsNil() {
+		config.FeeRatio = DEFAULT_FEE_RATIO
+	}
+	if config.FundingInterval <= 0 {
+		config.FundingInterval = DEFAULT_FUNDING_INTERVAL
+	}
+
+	e := &engine{
+		config:    config,
+		wallet:    config.Wallet,
+		positions: make(map[string]*position),
+	}
+	e.bot = &fbot.Bot{
+		RiskLimits: config.RiskLimits,
+		Throttle:   config.Throttle,
+		ExitRules:  config.ExitRules,
+		Clock:      func() time.Time { return e.step.Time },
+		State: fbot.BotState{
+			Positions:         make(map[string]fbot.PositionFields),
+			PortfolioBalances: *fbot.InitializePortfolio(),
+		},
+	}
+	e.result.Summary = Summary{
+		StartEquity: sdk.ZeroDec(),
+		RealizedPnl: sdk.ZeroDec(),
+		FundingPnl:  sdk.ZeroDec(),
+		Fees:        sdk.ZeroDec(),
+		TxFees:      sdk.NewCoin(fbot.TX_FEE.Denom, sdk.ZeroInt()),
+	}
+
+	for i, step := range steps {
+		e.load(step)
+		if i == 0 {
+			e.lastFunding = step.Time
+			e.result.Summary.StartEquity = e.equity()
+		}
+
+		e.payFunding()
+		e.sync()
+
+		exited, err := e.exits()
+		if err != nil {
+			return e.result, err
+		}
+
+		quoteToMove, err := e.bot.QuoteNeededToMovePrice()
+		if err != nil {
+			return e.result, fmt.Errorf("Block %d: cannot FindQuoteToMove: %w", step.Block, err)
+		}
+		for _, pair := range sortedPairs(step.Amms) {
+			if exited[pair] {
+				continue
+			}
+			order := e.bot.PlanTrade(pair, quoteToMove[pair].RoundInt())
+			if err = e.execute(order); err != nil {
+				return e.result, err
+			}
+		}
+
+		e.result.Equity = append(e.result.Equity, EquityPoint{
+			Block:  step.Block,
+			Time:   step.Time,
+			Equity: e.equity(),
+		})
+	}
+
+	e.result.summarize()
+
+	return e.result, nil
+}
+
+// load makes step the market state of the bot, with the configured fees.
+func (e *engine) load(step Step) {
+
+	e.step = step
+	e.bot.State.Amms = make(map[string]fbot.AmmFields)
+	e.bot.State.Prices = make(map[string]fbot.Prices)
+
+	for pair, fields := range step.Amms {
+		fields.Market.Pair = asset.Pair(pair)
+		fields.Market.ExchangeFeeRatio = e.config.FeeRatio
+		fields.Market.EcosystemFundFeeRatio = sdk.ZeroDec()
+		e.bot.State.Amms[pair] = fields
+		e.bot.State.Prices[pair] = step.Prices[pair]
+	}
+}
+
+// payFunding settles the funding epochs that ended by the step. A position
+// pays its size times the mark/index gap for the part of a day the epoch
+// lasts, out of its margin; shorts receive it when the mark is above the
+// index.
+func (e *engine) payFunding() {
+
+	epochShare := sdk.NewDec(int64(e.config.FundingInterval)).QuoInt64(int64(24 * time.Hour))
+
+	for !e.step.Time.Before(e.lastFunding.Add(e.config.FundingInterval)) {
+		e.lastFunding = e.lastFunding.Add(e.config.FundingInterval)
+
+		for pair, p := range e.positions {
+			prices, exists := e.step.Prices[pair]
+			if !exists || prices.MarkPrice.IsNil() || prices.IndexPrice.IsNil() {
+				continue
+			}
+			payment := p.Size.Mul(prices.MarkPrice.Sub(prices.IndexPrice)).Mul(epochShare)
+			p.Margin = p.Margin.Sub(payment)
+			p.Carry = p.Carry.Sub(payment)
+			e.result.Summary.FundingPnl = e.result.Summary.FundingPnl.Sub(payment)
+		}
+	}
+}
+
+// sync copies the simulated positions and wallet into the bot's state,
+// valuing the positions at the mark price.
+func (e *engine) sync() {
+
+	e.bot.State.Positions = make(map[string]fbot.PositionFields)
+
+	for pair, p := range e.positions {
+		markPrice := e.bot.State.Prices[pair].MarkPrice
+		notional := p.Size.Abs().Mul(markPrice)
+		pnl := notional.Sub(p.OpenNotional)
+		if p.Size.IsNegative() {
+			pnl = pnl.Neg()
+		}
+
+		e.bot.State.Positions[pair] = fbot.PositionFields{
+			Positon: perpTypes.Position{
+				Pair:         asset.Pair(pair),
+				Size_:        p.Size,
+				Margin:       p.Margin,
+				OpenNotional: p.OpenNotional,
+			},
+			UnrealizedPnl:    pnl,
+			PositionNotional: notional,
+		}
+	}
+
+	e.bot.State.PortfolioBalances.Balances.WalletCoins = e.wallet
+	e.bot.State.PortfolioBalances.Balances.SetTradedBalances(e.bot.State.Positions)
+}
+
+// equity values the wallet's quote coins and the positions, see EquityPoint.
+func (e *engine) equity() sdk.Dec {
+
+	e.sync()
+
+	equity := sdk.ZeroDec()
+	denoms := make(map[string]bool)
+	for pair := range e.bot.State.Amms {
+		denoms[asset.Pair(pair).QuoteDenom()] = true
+	}
+	for denom := range denoms {
+		equity = equity.Add(sdk.NewDecFromInt(e.wallet.AmountOf(denom)))
+	}
+	for _, position := range e.bot.State.Positions {
+		equity = equity.Add(position.Positon.Margin).Add(position.UnrealizedPnl)
+	}
+
+	return equity
+}
+
+// exits closes the positions that hit the exit rules, with the same checks
+// as fbot.Bot.CheckExits, and returns their pairs.
+func (e *engine) exits() (map[string]bool, error) {
+
+	exited := make(map[string]bool)
+	if len(e.config.ExitRules) == 0 {
+		return exited, nil
+	}
+
+	e.bot.UpdatePnlPeaks()
+	for _, pair := range sortedPairs(e.bot.State.Positions) {
+		rule, exists := e.config.ExitRules.For(pair)
+		if !exists {
+			continue
+		}
+		signal := fbot.EvaluateExit(pair, rule, e.bot.State.Positions[pair], e.bot.State.PnlPeaks[pair].Peak)
+		if signal == nil {
+			continue
+		}
+		exited[pair] = true
+		order := fbot.TradeOrder{Pair: pair, Action: fbot.ExitActions[signal.Trigger]}
+		if err := e.execute(order); err != nil {
+			return exited, err
+		}
+	}
+
+	return exited, nil
+}
+
+// execute fills the txs of order.
+func (e *engine) execute(order fbot.TradeOrder) error {
+
+	var err error
+	switch order.Action {
+	case fbot.OpenOrder:
+		err = e.open(order)
+	case fbot.CloseOrder, fbot.StopLossExit, fbot.TakeProfitExit, fbot.TrailingStopExit:
+		err = e.close(order)
+	case fbot.CloseAndOpenOrder:
+		// The open only replaces a position that was closed.
+		if err = e.close(order); err == nil && e.positions[order.Pair] == nil {
+			err = e.open(order)
+		}
+	case fbot.DontTrade:
+	default:
+		err = fmt.Errorf("Invalid action type: %v", order.Action)
+	}
+	if err != nil {
+		return fmt.Errorf("Block %d: %s on %s: %w", e.step.Block, order.Action, order.Pair, err)
+	}
+
+	e.sync()
+	return nil
+}
+
+// open fills order.QuoteAmount of margin at order.Leverage, paying the
+// trading fee and a tx fee from the wallet. fbot.CheckFunds counts on the
+// payout of a close-and-open's close, which the fill may fall short of, so
+// an order the wallet can't pay is cut down to what it can, or skipped,
+// and recorded as an Adjustment.
+func (e *engine) open(order fbot.TradeOrder) error {
+
+	if order.QuoteAmount.IsNil() || order.QuoteAmount.IsZero() {
+		return nil
+	}
+	leverage := order.Leverage
+	if leverage.IsNil() {
+		leverage = sdk.OneDec()
+	}
+
+	pair := order.Pair
+	denom := asset.Pair(pair).QuoteDenom()
+	margin := order.QuoteAmount.Abs()
+	feeOf := func(margin sdk.Int) sdk.Int {
+		return sdk.NewDecFromInt(margin).Mul(leverage).Mul(e.config.FeeRatio).Ceil().TruncateInt()
+	}
+
+	wallet, hasNeg := e.wallet.SafeSub(fbot.TX_FEE)
+	if hasNeg {
+		e.adjust(order, margin, sdk.ZeroInt(), fmt.Sprintf("wallet holds %s, tx fees need %s", e.wallet, fbot.TX_FEE))
+		return nil
+	}
+	if available := wallet.AmountOf(denom); available.LT(margin.Add(feeOf(margin))) {
+		requested := margin
+		// The largest margin whose fee the rest of the wallet pays.
+		margin = sdk.NewDecFromInt(available).
+			Quo(sdk.OneDec().Add(leverage.Mul(e.config.FeeRatio))).TruncateInt()
+		for margin.IsPositive() && available.LT(margin.Add(feeOf(margin))) {
+			margin = margin.SubRaw(1)
+		}
+		e.adjust(order, requested, margin, fmt.Sprintf("wallet holds %s%s, order needs %s%s",
+			available, denom, requested.Add(feeOf(requested)), denom))
+		if !margin.IsPositive() {
+			return nil
+		}
+	}
+	wallet = wallet.Sub(sdk.NewCoin(denom, margin.Add(feeOf(margin))))
+
+	notional := sdk.NewDecFromInt(margin).Mul(leverage)
+	fee := notional.Mul(e.config.FeeRatio)
+
+	dir, side := perpTypes.Direction_LONG, fbot.SIDE_LONG
+	if order.QuoteAmount.IsNegative() {
+		dir, side = perpTypes.Direction_SHORT, fbot.SIDE_SHORT
+	}
+
+	base, err := e.swap(pair, func(amm *perpTypes.AMM) (sdk.Dec, error) {
+		return amm.SwapQuoteAsset(notional, dir)
+	})
+	if err != nil {
+		return err
+	}
+	if dir == perpTypes.Direction_SHORT {
+		base = base.Neg()
+	}
+	e.wallet = wallet
+
+	p, exists := e.positions[pair]
+	if !exists {
+		p = &position{Size: sdk.ZeroDec(), OpenNotional: sdk.ZeroDec(), Margin: sdk.ZeroDec(), Carry: sdk.ZeroDec()}
+		e.positions[pair] = p
+	}
+	p.Size = p.Size.Add(base)
+	p.OpenNotional = p.OpenNotional.Add(notional)
+	p.Margin = p.Margin.Add(sdk.NewDecFromInt(margin))
+	p.Carry = p.Carry.Sub(fee)
+
+	e.record(order, side, notional, base, fee, sdk.ZeroDec())
+	return nil
+}
+
+// close fills the whole position of order.Pair, paying back its margin and
+// PnL, less the trading fee, to the wallet. A loss beyond the margin is
+// not charged to the wallet. A close the wallet can't pay the tx fee of
+// leaves the position open and is recorded as an Adjustment.
+func (e *engine) close(order fbot.TradeOrder) error {
+
+	pair := order.Pair
+	p, exists := e.positions[pair]
+	if !exists || p.Size.IsZero() {
+		return nil
+	}
+
+	wallet, hasNeg := e.wallet.SafeSub(fbot.TX_FEE)
+	if hasNeg {
+		e.adjust(order, p.Margin.TruncateInt(), sdk.ZeroInt(),
+			fmt.Sprintf("wallet holds %s, tx fees need %s, position kept", e.wallet, fbot.TX_FEE))
+		return nil
+	}
+
+	dir := perpTypes.Direction_SHORT
+	if p.Size.IsNegative() {
+		dir = perpTypes.Direction_LONG
+	}
+	notional, err := e.swap(pair, func(amm *perpTypes.AMM) (sdk.Dec, error) {
+		return amm.SwapBaseAsset(p.Size.Abs(), dir)
+	})
+	if err != nil {
+		return err
+	}
+	e.wallet = wallet
+
+	pnl := notional.Sub(p.OpenNotional)
+	if p.Size.IsNegative() {
+		pnl = pnl.Neg()
+	}
+	fee := notional.Mul(e.config.FeeRatio)
+	if payout := p.Margin.Add(pnl).Sub(fee).TruncateInt(); payout.IsPositive() {
+		e.wallet = e.wallet.Add(sdk.NewCoin(asset.Pair(pair).QuoteDenom(), payout))
+	}
+
+	summary := &e.result.Summary
+	summary.RoundTrips++
+	if pnl.Add(p.Carry).Sub(fee).IsPositive() {
+		summary.Wins++
+	} else {
+		summary.Losses++
+	}
+	summary.RealizedPnl = summary.RealizedPnl.Add(pnl)
+
+	e.record(order, fbot.SIDE_CLOSE, notional, p.Size.Neg(), fee, pnl)
+	delete(e.positions, pair)
+	return nil
+}
+
+// swap fills against the AMM of pair and moves its reserves and mark price.
+func (e *engine) swap(pair string, fill func(amm *perpTypes.AMM) (sdk.Dec, error)) (sdk.Dec, error) {
+
+	fields := e.bot.State.Amms[pair]
+	amm := fields.Markets
+	amount, err := fill(&amm)
+	if err != nil {
+		return sdk.Dec{}, err
+	}
+
+	fields.Markets = amm
+	e.bot.State.Amms[pair] = fields
+	prices := e.bot.State.Prices[pair]
+	prices.MarkPrice = amm.MarkPrice()
+	e.bot.State.Prices[pair] = prices
+
+	return amount, nil
+}
+
+// adjust records that order was filled with margin instead of the requested
+// margin, for reason.
+func (e *engine) adjust(order fbot.TradeOrder, requested sdk.Int, margin sdk.Int, reason string) {
+	e.result.Adjustments = append(e.result.Adjustments, Adjustment{
+		Block:     e.step.Block,
+		Time:      e.step.Time,
+		Pair:      order.Pair,
+		Action:    order.Action.String(),
+		Requested: requested,
+		Filled:    margin,
+		Reason:    reason,
+	})
+}
+
+// record adds a fill to the trade list and to the orders the throttle sees.
+func (e *engine) record(order fbot.TradeOrder, side string, notional sdk.Dec, base sdk.Dec,
+	fee sdk.Dec, pnl sdk.Dec) {
+
+	trade := Trade{
+		Block:       e.step.Block,
+		Time:        e.step.Time,
+		Pair:        order.Pair,
+		Action:      order.Action.String(),
+		Side:        side,
+		Notional:    notional,
+		Base:        base,
+		Price:       sdk.ZeroDec(),
+		Fee:         fee,
+		RealizedPnl: pnl,
+	}
+	if !base.IsZero() {
+		trade.Price = notional.Quo(base.Abs())
+	}
+	e.result.Trades = append(e.result.Trades, trade)
+
+	summary := &e.result.Summary
+	summary.Fees = summary.Fees.Add(fee)
+	summary.TxFees = summary.TxFees.Add(fbot.TX_FEE)
+	e.bot.State.Orders.Record(order.Pair, side, e.step.Time)
+}
+
+func sortedPairs[V any](values map[string]V) []string {
+	pairs := make([]string, 0, len(values))
+	for pair := range values {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
@@ -2,9 +2,11 @@ package fbot
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/NibiruChain/nibiru/app"
 	"github.com/NibiruChain/nibiru/x/common"
@@ -13,6 +15,7 @@ import (
 	perpTypes "github.com/NibiruChain/nibiru/x/perp/v2/types"
 	"github.com/Unique-Divine/gonibi"
 	rpchttp "github.com/cometbft/cometbft/rpc/client/http"
+	coretypes "github.com/cometbft/cometbft/rpc/core/types"
 	"github.com/cosmos/cosmos-sdk/crypto/keyring"
 	sdk "github.com/cosmos/cosmos-sdk/types"
 	"github.com/joho/godotenv"
@@ -25,16 +28,37 @@ type BotState struct {
 	Amms              map[string]AmmFields
 	Prices            map[string]Prices
 	PortfolioBalances Portfolio
+
+	// EventsSyncedHeight: Last block scanned by SyncPositionChanges.
+	EventsSyncedHeight int64
+	// BalanceDiffs: Differences between the local and chain balances found
+	// by the last RefreshBalances.
+	BalanceDiffs []BalanceDiff
+	// FailedTxs: Txs in a row that failed, counted by JournalTrade.
+	FailedTxs int
+	// BreakerTrip: Circuit breaker that stopped the bot last, if any.
+	BreakerTrip *BreakerTrip
+	// PnlPeaks: Best unrealized PnL of each position, for trailing stops.
+	PnlPeaks map[string]PnlPeak
+	// Orders: Orders sent recently, for the Throttle.
+	Orders OrderActivity
+	// TWAPs: Sliced orders in progress by pair, see ExecuteTWAPSlice.
+	TWAPs map[string]*TWAPOrder
 }
 
 type PositionFields struct {
 	Positon       perpTypes.Position
 	UnrealizedPnl sdk.Dec
+	MarginRatio   sdk.Dec
+	// PositionNotional: Value of the position if closed at the spot price.
+	PositionNotional sdk.Dec
 }
 
 type AmmFields struct {
 	Markets perpTypes.AMM
 	Bias    sdk.Dec
+	// Market: Margin and fee parameters of the pair.
+	Market perpTypes.Market
 }
 
 type Bot struct {
@@ -44,6 +68,30 @@ type Bot struct {
 	TmrpcAddr string
 	DB        BotDB
 	KeyName   string
+	// MaxSlippage: Limit on how far an opening fill may deviate from the mark
+	// price, see BaseAssetAmountLimit. Zero disables the limit.
+	MaxSlippage sdk.Dec
+	// MinGasBalance: Balance of the tx fee denom below which Run warns.
+	MinGasBalance sdk.Int
+	// Breakers: Circuit breakers checked by Run before trading.
+	Breakers []CircuitBreaker
+	// Throttle: Limits on how often PlanTrade lets the strategy trade.
+	Throttle Throttle
+	// TWAP: How Run slices large opening orders, see ExecuteTWAPSlice.
+	TWAP TWAPSchedule
+	// RiskLimits: Caps PlanTrade clips the strategy's orders to.
+	RiskLimits RiskLimits
+	// MarginPolicy: Margin ratios ManageMargin keeps positions between.
+	MarginPolicy MarginPolicy
+	// ExitRules: Stop losses and take profits CheckExits closes positions on.
+	ExitRules ExitRules
+	// Clock: Time the Throttle checks orders at, time.Now if nil. The
+	// backtest replays recorded times with it.
+	Clock func() time.Time
+	// ID: Identifies the bot in a shared DB, defaults to its address.
+	ID string
+	// RunID: Identifies this process in the snapshots it writes.
+	RunID string
 }
 
 type Prices struct {
@@ -60,6 +108,13 @@ type CurrPosStats struct {
 	UnrealizedPnl   sdk.Dec
 	IsAgainstMarket bool
 }
+
+// Notional: Absolute size of the position valued at the mark price, in the
+// quote denom like UnrealizedPnl.
+func (position CurrPosStats) Notional() sdk.Dec {
+	return position.CurrSize.Abs().Mul(position.CurrMarkPrice)
+}
+
 type TradeAction int
 
 const (
@@ -67,6 +122,11 @@ const (
 	CloseOrder
 	CloseAndOpenOrder
 	DontTrade
+	AddMarginOrder
+	RemoveMarginOrder
+	StopLossExit
+	TakeProfitExit
+	TrailingStopExit
 )
 
 func LoadBot() (*Bot, error) {
@@ -113,11 +173,8 @@ func Run(bot *Bot) error {
 	blockHeight, err := bot.GetBlockHeight(context, bot.TmrpcAddr)
 	if err != nil {
 		return fmt.Errorf("Cannot GetHeight(): %s", err)
-	} else {
-		bot.DB.PopulateAmmsTable(bot.State.Amms, blockHeight)
-		bot.DB.PopulatePricesTable(bot.State.Prices, blockHeight)
-		bot.State.PortfolioBalances.BlockNumber = blockHeight
 	}
+	bot.State.PortfolioBalances.BlockNumber = blockHeight
 
 	//Querying trader address to find positions by
 	sdkAddress, err := bot.GetAddress()
@@ -126,17 +183,67 @@ func Run(bot *Bot) error {
 		return fmt.Errorf("Cannot QueryAddress(): %s", err)
 	}
 
-	balancesResp, err := bot.State.PortfolioBalances.Balances.QueryWalletCoins(
-		context, sdkAddress, bot.Gosdk.GrpcClient,
-	)
+	// Funding and liquidations move balances between iterations, so only
+	// the differences after this iteration's trades are reported.
+	if _, err = bot.RefreshBalances(context, sdkAddress); err != nil {
+		return err
+	}
+	bot.WarnLowGas(bot.MinGasBalance)
+
+	botID := bot.ID
+	if botID == "" {
+		botID = sdkAddress.String()
+	}
+
+	_, err = bot.DB.SaveSnapshot(Snapshot{
+		BlockHeight: blockHeight,
+		BotID:       botID,
+		RunID:       bot.RunID,
+		Trader:      sdkAddress.String(),
+		Amms:        bot.State.Amms,
+		Prices:      bot.State.Prices,
+		Positions:   bot.State.Positions,
+		Balances:    bot.State.PortfolioBalances.Balances.WalletCoins,
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot SaveSnapshot(): %s", err)
+	}
+
+	trip, err := bot.CheckBreakers(bot.Breakers, sdkAddress.String(), botID, time.Now().UTC())
 	if err != nil {
-		return fmt.Errorf("Cannot QueryWalletCoins(): %s", err)
+		return err
+	}
+	if trip != nil {
+		bot.State.BreakerTrip = trip
+		if err = bot.RecordBreakerTrip(trip, blockHeight, botID); err != nil {
+			log.Printf("Cannot RecordBreakerTrip(): %v", err)
+		}
+		return trip
+	}
+
+	// Margin is fixed before trading, so a position about to be liquidated
+	// is topped up even if the strategy doesn't touch it. ManageMargin logs
+	// its errors.
+	if bot.MarginPolicy.Enabled() {
+		bot.ManageMargin(context, sdkAddress)
 	}
 
-	bot.State.PortfolioBalances.Balances.PopWalletCoins(balancesResp)
+	if bot.Throttle.Enabled() {
+		since := time.Now().Add(-bot.Throttle.Lookback())
+		if err = bot.LoadOrderActivity(sdkAddress.String(), since); err != nil {
+			log.Printf("Cannot LoadOrderActivity(): %v", err)
+		}
+	}
 
-	bot.DB.PopulateBalancesTable(bot.State.PortfolioBalances.Balances.WalletCoins,
-		sdkAddress.String(), blockHeight)
+	// Exits don't depend on the strategy, and a pair just exited isn't
+	// traded again before the next iteration. CheckExits logs its errors.
+	exited := make(map[string]bool)
+	if len(bot.ExitRules) > 0 {
+		signals, _ := bot.CheckExits(context, sdkAddress)
+		for _, signal := range signals {
+			exited[signal.Pair] = true
+		}
+	}
 
 	quoteToMove, err := bot.QuoteNeededToMovePrice()
 
@@ -145,23 +252,55 @@ func Run(bot *Bot) error {
 	}
 
 	for pair, quote := range quoteToMove {
-		quoteAmount := quote.RoundInt()
-		_, action, err := bot.PerformTradeAction(pair, quoteAmount, sdkAddress, context)
+		if exited[pair] {
+			delete(bot.State.TWAPs, pair)
+			continue
+		}
+		twap := bot.State.TWAPs[pair]
+		if twap == nil {
+			order := bot.PlanTrade(pair, quote.RoundInt())
+			if !bot.TWAP.Applies(order) {
+				if _, err := bot.ExecuteTrade(order, sdkAddress, context); err != nil {
+					// JournalTrade counted the failure, the failed_txs
+					// breaker decides whether to stop trading.
+					log.Printf("Cannot ExecuteTrade() on %s: %v", pair, err)
+					continue
+				}
+				bot.UpdateTradeBalance(order.Action, pair, order.QuoteAmount)
+				continue
+			}
+			if twap, err = bot.StartTWAP(context, sdkAddress, order, bot.TWAP); err != nil {
+				log.Printf("Cannot StartTWAP() on %s: %v", pair, err)
+				continue
+			}
+		}
+
+		// The pair isn't traded otherwise until its TWAP is done.
+		executed := twap.Result.Executed
+		done, err := bot.ExecuteTWAPSlice(context, sdkAddress, twap, quote, blockHeight)
 		if err != nil {
-			log.Fatalf("Cannot PerformTradeAction(): %v", err)
+			log.Printf("Cannot ExecuteTWAPSlice() on %s: %v", pair, err)
+		}
+		bot.UpdateTradeBalance(twap.Order.Action, pair, twap.Result.Executed.Sub(executed))
+		if done {
+			delete(bot.State.TWAPs, pair)
+		} else {
+			if bot.State.TWAPs == nil {
+				bot.State.TWAPs = make(map[string]*TWAPOrder)
+			}
+			bot.State.TWAPs[pair] = twap
 		}
+	}
 
-		bot.UpdateTradeBalance(action, pair, quoteAmount)
+	if err = bot.SyncPositionChanges(context, sdkAddress, blockHeight); err != nil {
+		log.Printf("Cannot SyncPositionChanges(): %v", err)
 	}
 
-	balancesResp, err = bot.State.PortfolioBalances.Balances.QueryWalletCoins(
-		context, sdkAddress, bot.Gosdk.GrpcClient,
-	)
+	diffs, err := bot.RefreshBalances(context, sdkAddress)
 	if err != nil {
-		return fmt.Errorf("Cannot QueryWalletCoins(): %s", err)
+		return err
 	}
-
-	bot.State.PortfolioBalances.Balances.PopWalletCoins(balancesResp)
+	LogBalanceDiffs(blockHeight, diffs)
 
 	return nil
 }
@@ -188,6 +327,18 @@ func (bot *Bot) UpdateTradeBalance(action TradeAction, pair string, quoteAmount
 
 func (bot *Bot) PerformTradeAction(pair string, quoteAmount sdk.Int,
 	trader sdk.AccAddress, ctx context.Context) (*sdk.TxResponse, TradeAction, error) {
+
+	order := bot.PlanTrade(pair, quoteAmount)
+	txResp, err := bot.ExecuteTrade(order, trader, ctx)
+	return txResp, order.Action, err
+}
+
+// PlanTrade evaluates the strategy action for pair, holds it back as told
+// by the bot's Throttle, and clips the quote amount of its open leg to the
+// bot's RiskLimits, then to what the wallet
+// can pay, see CheckFunds. If either rejects the open, an OpenOrder becomes
+// DontTrade and a CloseAndOpenOrder a CloseOrder.
+func (bot *Bot) PlanTrade(pair string, quoteAmount sdk.Int) TradeOrder {
 	_, posExists := bot.State.Positions[pair]
 
 	currPosition := CurrPosStats{
@@ -205,24 +356,117 @@ func (bot *Bot) PerformTradeAction(pair string, quoteAmount sdk.Int,
 	}
 
 	action := EvaluateTradeAction(quoteAmount, bot.State.Amms[pair].Markets, posExists, currPosition)
-	switch action {
+	action = bot.Throttle.ApplyHysteresis(action, quoteAmount, bot.State.Amms[pair].Markets, currPosition)
+	throttled := bot.Throttle.CheckOrder(pair, action, bot.State.Orders, bot.now())
+	if throttled.Throttled() {
+		log.Printf("Throttle %s: %s order on %s becomes %s, %s",
+			throttled.Rule, action, pair, throttled.Allowed, throttled.Reason)
+		action = throttled.Allowed
+	}
+	order := TradeOrder{
+		Pair:        pair,
+		Action:      action,
+		QuoteAmount: quoteAmount,
+		Leverage:    sdk.NewDec(1),
+		QuoteToMove: quoteAmount,
+		Inputs:      currPosition,
+	}
+
+	if action != OpenOrder && action != CloseAndOpenOrder {
+		return order
+	}
+
+	decision := bot.RiskLimits.CheckOrder(pair, quoteAmount, order.Leverage, bot.CurrentExposure())
+	order.QuoteAmount = decision.Allowed
+	if decision.Clipped() {
+		log.Printf("Risk limit %s: %s order on %s of %s cut to %s",
+			decision.Limit, action, pair, decision.Requested, decision.Allowed)
+	}
+	if decision.Rejected() {
+		return order.withoutOpen()
+	}
+
+	txs, released := 1, sdk.ZeroInt()
+	if action == CloseAndOpenOrder {
+		txs = 2
+		position := bot.State.Positions[pair]
+		if !position.Positon.Margin.IsNil() && !position.UnrealizedPnl.IsNil() {
+			released = position.Positon.Margin.Add(position.UnrealizedPnl).TruncateInt()
+		}
+	}
+	funds := CheckFunds(pair, order.QuoteAmount, order.Leverage, bot.State.Amms[pair].Market,
+		bot.State.PortfolioBalances.Balances.WalletCoins, txs, released)
+	order.QuoteAmount = funds.Allowed
+	if funds.Downsized() {
+		log.Printf("Funds: %s order on %s of %s cut to %s, %s",
+			action, pair, funds.Requested, funds.Allowed, funds.Reason)
+	}
+	if funds.Skipped() {
+		return order.withoutOpen()
+	}
+
+	return order
+}
+
+func (bot *Bot) now() time.Time {
+	if bot.Clock != nil {
+		return bot.Clock()
+	}
+	return time.Now()
+}
+
+// withoutOpen drops the open leg of an order: an OpenOrder becomes
+// DontTrade and a CloseAndOpenOrder a CloseOrder.
+func (order TradeOrder) withoutOpen() TradeOrder {
+	if order.Action == CloseAndOpenOrder {
+		order.Action = CloseOrder
+	} else {
+		order.Action = DontTrade
+	}
+	return order
+}
+
+// ExecuteTrade sends the txs of order, journaling each of them.
+func (bot *Bot) ExecuteTrade(order TradeOrder, trader sdk.AccAddress, ctx context.Context) (*sdk.TxResponse, error) {
+
+	switch order.Action {
 	case OpenOrder:
-		txResp, err := bot.OpenPosition(trader, quoteAmount, sdk.NewDec(1), pair, ctx)
-		return txResp, action, err
-	case CloseOrder:
-		txResp, err := bot.ClosePosition(trader, pair, ctx)
-		return txResp, action, err
+		txResp, err := bot.OpenPosition(trader, order.QuoteAmount, order.Leverage, order.Pair, ctx)
+		bot.journalTrade(ctx, trader, order.openLeg(order.QuoteAmount, order.Leverage), txResp, err)
+		return txResp, err
+	case CloseOrder, StopLossExit, TakeProfitExit, TrailingStopExit:
+		txResp, err := bot.ClosePosition(trader, order.Pair, ctx)
+		bot.journalTrade(ctx, trader, order.closeLeg(), txResp, err)
+		return txResp, err
 	case CloseAndOpenOrder:
-		txResp, err := bot.CloseAndOpenPosition(trader, quoteAmount, pair, ctx)
-		return txResp, action, err
+		// Same as CloseAndOpenPosition, journaling each tx.
+		closeResp, err := bot.ClosePosition(trader, order.Pair, ctx)
+		bot.journalTrade(ctx, trader, order.closeLeg(), closeResp, err)
+		if err != nil {
+			return nil, err
+		}
+		txResp, err := bot.OpenPosition(trader, order.QuoteAmount, order.Leverage, order.Pair, ctx)
+		bot.journalTrade(ctx, trader, order.openLeg(order.QuoteAmount, order.Leverage), txResp, err)
+		return txResp, err
 	case DontTrade:
-		return nil, action, nil
+		return nil, nil
 	default:
-		return nil, action, fmt.Errorf("Invalid action type: %v", action)
+		return nil, fmt.Errorf("Invalid action type: %v", order.Action)
 	}
 
 }
 
+// journalTrade logs instead of failing the trade if the journal can't be
+// written, and returns the delivered tx like JournalTrade.
+func (bot *Bot) journalTrade(ctx context.Context, trader sdk.AccAddress,
+	order TradeOrder, resp *sdk.TxResponse, txErr error) *coretypes.ResultTx {
+	resultTx, err := bot.JournalTrade(ctx, trader, order, resp, txErr)
+	if err != nil {
+		log.Printf("Cannot JournalTrade(): %v", err)
+	}
+	return resultTx
+}
+
 func (bot *Bot) PopulateCurrPosStats(pair string) CurrPosStats {
 	MarkPrice := bot.State.Prices[pair].MarkPrice
 	IndexPrice := bot.State.Prices[pair].IndexPrice
@@ -246,17 +490,36 @@ func (bot *Bot) PopulateCurrPosStats(pair string) CurrPosStats {
 	return position
 }
 
+// Trade thresholds of EvaluateTradeAction, as divisors of the value they are
+// a fraction of. ApplyHysteresis widens the same thresholds.
+const (
+	// TRADE_QUOTE_RESERVE_DIVISOR: Trades need a quote to move the price of
+	// at least the quote reserve over it, see ShouldNotTrade.
+	TRADE_QUOTE_RESERVE_DIVISOR = 20
+	// CLOSE_MARKET_DELTA_DIVISOR: Closes need a market delta above the index
+	// price over it.
+	CLOSE_MARKET_DELTA_DIVISOR = 10
+	// CLOSE_AND_OPEN_PNL_DIVISOR: Close-and-opens need an unrealized PnL
+	// above the position notional over it.
+	CLOSE_AND_OPEN_PNL_DIVISOR = 10
+)
+
+// EvaluateTradeAction picks the strategy's action for a pair: close a
+// position paying funding once the market is far from the index, open one
+// when the quote to move the price is large enough, and close and reopen a
+// position whose unrealized PnL is a large enough part of its notional at
+// the mark price.
 func EvaluateTradeAction(QuoteToMove sdk.Int, amm perpTypes.AMM, posExists bool, position CurrPosStats) TradeAction {
 
 	QuoteToMovePrice := sdk.NewDecFromInt(QuoteToMove)
 	if ShouldNotTrade(QuoteToMovePrice, amm.QuoteReserve) &&
 		posExists && position.IsAgainstMarket &&
-		position.MarketDelta.GT(position.CurrIndexPrice.Quo(sdk.NewDec(10))) {
+		position.MarketDelta.GT(position.CurrIndexPrice.QuoInt64(CLOSE_MARKET_DELTA_DIVISOR)) {
 		return CloseOrder
 	} else if !posExists && !ShouldNotTrade(QuoteToMovePrice, amm.QuoteReserve) {
 		return OpenOrder
-	} else if !position.IsAgainstMarket &&
-		position.UnrealizedPnl.GT(position.CurrSize.Abs().Quo(sdk.NewDec(10))) {
+	} else if posExists && !position.IsAgainstMarket &&
+		position.UnrealizedPnl.GT(position.Notional().QuoInt64(CLOSE_AND_OPEN_PNL_DIVISOR)) {
 		return CloseAndOpenOrder
 	} else {
 		return DontTrade
@@ -292,6 +555,10 @@ type BotArgs struct {
 	Mnemonic    string
 	UseMnemonic bool
 	KeyName     string
+	// DBDriver and DBDSN select the DB, see BotDB.Open. Unset means the
+	// SQLite file DEFAULT_DB_NAME.
+	DBDriver string
+	DBDSN    string
 }
 
 const KEY_NAME = "bot"
@@ -312,22 +579,17 @@ func NewBot(args BotArgs) (*Bot, error) {
 
 	var keyName string = KEY_NAME
 
-	dontUseMnemonic := args.Mnemonic != "" || args.UseMnemonic == false
+	dontUseMnemonic := args.Mnemonic == "" || args.UseMnemonic == false
 
 	if !dontUseMnemonic {
-		_, privKey, err := gonibi.CreateSigner(args.Mnemonic, gosdk.Keyring,
+		// CreateSigner also saves the key under keyName in the keyring.
+		_, _, err := gonibi.CreateSigner(args.Mnemonic, gosdk.Keyring,
 			keyName)
 
 		if err != nil {
 
 			return nil, err
 		}
-
-		err = gonibi.AddSignerToKeyring(gosdk.Keyring, privKey, keyName)
-		if err != nil {
-			return nil, err
-
-		}
 	} else {
 		if args.KeyName == "" {
 			return nil, fmt.Errorf("No Key Name passed in")
@@ -335,6 +597,11 @@ func NewBot(args BotArgs) (*Bot, error) {
 		keyName = args.KeyName
 	}
 
+	botDB, err := CreateAndConnect(args.DBDriver, args.DBDSN)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Bot{
 		State: BotState{
 			Positions:         make(map[string]PositionFields),
@@ -344,8 +611,9 @@ func NewBot(args BotArgs) (*Bot, error) {
 		},
 		Gosdk:     &gosdk,
 		TmrpcAddr: args.RpcEndpt,
-		DB:        CreateAndConnectDB("bot.db"),
+		DB:        botDB,
 		KeyName:   keyName,
+		RunID:     NewRunID(),
 	}, nil
 }
 
@@ -359,24 +627,54 @@ func (bot *Bot) OpenPosition(trader sdk.AccAddress, quoteToMove sdk.Int,
 		side = 2
 	}
 
+	baseLimit := BaseAssetAmountLimit(quoteToMove, leverage,
+		bot.State.Prices[pair].MarkPrice, bot.MaxSlippage)
+
 	resp, err := bot.Gosdk.BroadcastMsgsGrpc(trader, &perpTypes.MsgMarketOrder{
 		Sender:               trader.String(),
 		Pair:                 asset.Pair(pair),
 		Side:                 perpTypes.Direction(side),
 		QuoteAssetAmount:     quoteToMove.Abs(),
 		Leverage:             leverage,
-		BaseAssetAmountLimit: sdk.NewInt(0),
+		BaseAssetAmountLimit: baseLimit,
 	})
 
 	if err != nil {
 		return nil, err
 	}
+
+	if resp.Code == 0 {
+		if _, err = bot.WaitForTx(ctx, resp.TxHash); err != nil {
+			return resp, err
+		}
+	}
 	bot.FetchAndPopPositionsDB(trader, ctx)
 
 	return resp, err
 
 }
 
+// BaseAssetAmountLimit: Slippage limit for a market order of quoteToMove
+// (positive for long, negative for short) at the given mark price. Longs
+// must receive at least and shorts may sell at most the expected base amount
+// adjusted by maxSlippage. Returns zero, meaning no limit, if maxSlippage or
+// markPrice is unset.
+func BaseAssetAmountLimit(quoteToMove sdk.Int, leverage sdk.Dec,
+	markPrice sdk.Dec, maxSlippage sdk.Dec) sdk.Int {
+
+	if maxSlippage.IsNil() || !maxSlippage.IsPositive() ||
+		markPrice.IsNil() || !markPrice.IsPositive() {
+		return sdk.ZeroInt()
+	}
+
+	expectedBase := sdk.NewDecFromInt(quoteToMove.Abs()).Mul(leverage).Quo(markPrice)
+
+	if quoteToMove.IsPositive() {
+		return expectedBase.Mul(sdk.OneDec().Sub(maxSlippage)).TruncateInt()
+	}
+	return expectedBase.Mul(sdk.OneDec().Add(maxSlippage)).Ceil().TruncateInt()
+}
+
 func (bot *Bot) CloseAndOpenPosition(trader sdk.AccAddress,
 	quoteToMove sdk.Int, pair string, ctx context.Context) (*sdk.TxResponse, error) {
 
@@ -404,11 +702,48 @@ func (bot *Bot) ClosePosition(trader sdk.AccAddress, pair string, ctx context.Co
 
 	bot.MakeZeroPosition(trader, pair, ctx)
 
+	if err == nil && resp.Code == 0 {
+		if _, err = bot.WaitForTx(ctx, resp.TxHash); err != nil {
+			return resp, err
+		}
+	}
+
 	bot.FetchAndPopPositionsDB(trader, ctx)
 
 	return resp, err
 }
 
+const (
+	TX_WAIT_TIMEOUT  = 30 * time.Second
+	TX_POLL_INTERVAL = time.Second
+)
+
+// WaitForTx polls the RPC until the tx with txHash is included in a block,
+// giving up after TX_WAIT_TIMEOUT.
+func (bot *Bot) WaitForTx(ctx context.Context, txHash string) (*coretypes.ResultTx, error) {
+
+	hashBz, err := hex.DecodeString(txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(TX_WAIT_TIMEOUT)
+
+	for {
+		resultTx, err := bot.Gosdk.CometRPC.Tx(ctx, hashBz, false)
+		if err == nil {
+			return resultTx, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Tx %s not included after %s: %w",
+				txHash, TX_WAIT_TIMEOUT, err)
+		}
+
+		time.Sleep(TX_POLL_INTERVAL)
+	}
+}
+
 func (bot *Bot) FetchAndPopPositionsDB(trader sdk.AccAddress, ctx context.Context) error {
 
 	// Querying positions and storing in bot.State and then in DB
@@ -421,9 +756,8 @@ func (bot *Bot) FetchAndPopPositionsDB(trader sdk.AccAddress, ctx context.Contex
 	if err != nil {
 		return err
 	}
-	bot.DB.PopulatePositionTable(bot.State.Positions, height)
 
-	return nil
+	return bot.DB.PopulatePositionTable(bot.State.Positions, height)
 }
 
 func (bot *Bot) GetKeyringRecord() (*keyring.Record, error) {
@@ -462,11 +796,53 @@ func (bot *Bot) FetchPositions(trader string, ctx context.Context) error {
 		return err
 	}
 
+	// Positions closed since the last fetch aren't returned, start over.
+	bot.State.Positions = make(map[string]PositionFields)
 	bot.PopulatePositions(positions)
 
 	return nil
 }
 
+// RefreshBalances replaces the wallet coins and positions of the bot's state
+// with those on chain, and the traded balances with the positions' margin.
+// It returns where the local view, e.g. updated by UpdateTradeBalance since
+// the last refresh, differed from the chain.
+func (bot *Bot) RefreshBalances(ctx context.Context, trader sdk.AccAddress) ([]BalanceDiff, error) {
+
+	balancesResp, err := bot.State.PortfolioBalances.Balances.QueryWalletCoins(
+		ctx, trader, bot.Gosdk.GrpcClient,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot QueryWalletCoins(): %s", err)
+	}
+
+	if err = bot.FetchPositions(trader.String(), ctx); err != nil {
+		return nil, fmt.Errorf("Cannot FetchPositions(): %s", err)
+	}
+
+	local := bot.State.PortfolioBalances.Balances
+	chain := PortfolioBalances{}
+	chain.PopWalletCoins(balancesResp)
+	chain.SetTradedBalances(bot.State.Positions)
+
+	bot.State.PortfolioBalances.Balances = chain
+	bot.State.BalanceDiffs = ReconcileBalances(local, chain)
+
+	return bot.State.BalanceDiffs, nil
+}
+
+// LogBalanceDiffs logs the differences found by RefreshBalances, if any.
+func LogBalanceDiffs(height int64, diffs []BalanceDiff) {
+	for _, diff := range diffs {
+		where := "wallet"
+		if diff.Pair != "" {
+			where = diff.Pair + " margin"
+		}
+		log.Printf("Reconciliation at block %d: %s %s local %s, chain %s (%s)",
+			height, where, diff.Denom, diff.Local, diff.Chain, diff.Delta())
+	}
+}
+
 func (bot *Bot) FetchNewPrices(ctx context.Context) error {
 
 	_, err := bot.Gosdk.Querier.Oracle.ExchangeRates(ctx, &oracleTypes.QueryExchangeRatesRequest{})
@@ -491,8 +867,10 @@ func (bot *Bot) PopulatePositions(positions *perpTypes.QueryPositionsResponse) {
 	for _, positionResponse := range positions.GetPositions() {
 		pair := positionResponse.Position.Pair
 		bot.State.Positions[pair.String()] = PositionFields{
-			Positon:       positionResponse.Position,
-			UnrealizedPnl: positionResponse.UnrealizedPnl,
+			Positon:          positionResponse.Position,
+			UnrealizedPnl:    positionResponse.UnrealizedPnl,
+			MarginRatio:      positionResponse.MarginRatio,
+			PositionNotional: positionResponse.PositionNotional,
 		}
 	}
 
@@ -504,6 +882,7 @@ func (bot *Bot) PopulateAmms(queryMarketsResp *perpTypes.QueryMarketsResponse) {
 		bot.State.Amms[pair.String()] = AmmFields{
 			Markets: queryMarketsResp.AmmMarkets[index].Amm,
 			Bias:    value.Amm.Bias(),
+			Market:  value.Market,
 		}
 	}
 
@@ -556,7 +935,7 @@ func MockQueryRates() oracleTypes.QueryExchangeRatesResponse {
 }
 
 func ShouldNotTrade(quoteToMovePrice sdk.Dec, quoteReserve sdk.Dec) bool {
-	if quoteToMovePrice.Abs().LT(quoteReserve.QuoInt64(20)) {
+	if quoteToMovePrice.Abs().LT(quoteReserve.QuoInt64(TRADE_QUOTE_RESERVE_DIVISOR)) {
 		return true
 	}
 	return false
@@ -0,0 +1,264 @@
+package fbot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// Circuit breakers, see CircuitBreaker.
+const (
+	// BREAKER_DRAWDOWN: Fraction the NAV fell from its peak over the window.
+	BREAKER_DRAWDOWN = "drawdown"
+	// BREAKER_FAILED_TXS: Number of txs in a row that failed.
+	BREAKER_FAILED_TXS = "failed_txs"
+	// BREAKER_PAIR_LOSS: Net PnL lost on one pair since midnight UTC, in
+	// quote units.
+	BREAKER_PAIR_LOSS = "pair_loss"
+	// BREAKER_DIVERGENCE: Fraction the mark price of a pair deviates from its
+	// index price.
+	BREAKER_DIVERGENCE = "divergence"
+)
+
+// Breakers: Names a CircuitBreaker may have.
+var Breakers = []string{BREAKER_DRAWDOWN, BREAKER_FAILED_TXS, BREAKER_PAIR_LOSS, BREAKER_DIVERGENCE}
+
+// Responses of a tripped CircuitBreaker.
+const (
+	// BREAKER_PAUSE pauses trading until the bot is resumed.
+	BREAKER_PAUSE = "pause"
+	// BREAKER_FLATTEN closes every position and stops the bot, see EndBot.
+	BREAKER_FLATTEN = "flatten"
+	// BREAKER_HALT exits the process.
+	BREAKER_HALT = "halt"
+)
+
+// BreakerResponses: Responses a CircuitBreaker may have.
+var BreakerResponses = []string{BREAKER_PAUSE, BREAKER_FLATTEN, BREAKER_HALT}
+
+// DEFAULT_DRAWDOWN_WINDOW: NAV history the drawdown breaker looks at unless
+// configured otherwise.
+const DEFAULT_DRAWDOWN_WINDOW = 24 * time.Hour
+
+// CircuitBreaker: Trips when the value it watches exceeds Threshold, and
+// stops the bot as told by Response.
+type CircuitBreaker struct {
+	// Name: One of Breakers.
+	Name      string
+	Threshold sdk.Dec
+	// Window: NAV history of the drawdown breaker.
+	Window time.Duration
+	// Response: One of BreakerResponses.
+	Response string
+}
+
+// ParseCircuitBreakers parses a comma separated list of
+// NAME=THRESHOLD[/WINDOW]:RESPONSE, e.g.
+// "drawdown=0.1/24h:flatten,failed_txs=5:pause". WINDOW, only for drawdown,
+// is a Go duration or a number of days like "7d".
+func ParseCircuitBreakers(spec string) ([]CircuitBreaker, error) {
+
+	breakers := []CircuitBreaker{}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, rule, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("Circuit breaker %q is not NAME=THRESHOLD[/WINDOW]:RESPONSE", item)
+		}
+		if !containsString(Breakers, name) {
+			return nil, fmt.Errorf("Unknown circuit breaker %q, use one of %s",
+				name, strings.Join(Breakers, ", "))
+		}
+
+		rule, response, found := strings.Cut(rule, ":")
+		if !containsString(BreakerResponses, response) {
+			return nil, fmt.Errorf("Circuit breaker %q: response must be one of %s",
+				item, strings.Join(BreakerResponses, ", "))
+		}
+
+		breaker := CircuitBreaker{Name: name, Response: response}
+		threshold, window, hasWindow := strings.Cut(rule, "/")
+
+		var err error
+		if breaker.Threshold, err = sdk.NewDecFromStr(threshold); err != nil || !breaker.Threshold.IsPositive() {
+			return nil, fmt.Errorf("Circuit breaker %q: invalid threshold %q", item, threshold)
+		}
+		if hasWindow && name != BREAKER_DRAWDOWN {
+			return nil, fmt.Errorf("Circuit breaker %q: only %s takes a window", item, BREAKER_DRAWDOWN)
+		}
+		if name == BREAKER_DRAWDOWN {
+			breaker.Window = DEFAULT_DRAWDOWN_WINDOW
+			if hasWindow {
+				if breaker.Window, err = parseRetention(window); err != nil || breaker.Window <= 0 {
+					return nil, fmt.Errorf("Circuit breaker %q: invalid window %q", item, window)
+				}
+			}
+		}
+
+		breakers = append(breakers, breaker)
+	}
+
+	return breakers, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// BreakerTrip: A CircuitBreaker that tripped. It is the error Run returns
+// when it stops before trading.
+type BreakerTrip struct {
+	Breaker CircuitBreaker
+	// Pair: Pair the breaker tripped on, empty for account wide breakers.
+	Pair  string
+	Value sdk.Dec
+	// Reason: What the breaker saw, for the logs and the trips table.
+	Reason string
+}
+
+func (trip *BreakerTrip) Error() string {
+	return fmt.Sprintf("Circuit breaker %s tripped (%s): %s",
+		trip.Breaker.Name, trip.Breaker.Response, trip.Reason)
+}
+
+// CheckBreakers evaluates breakers, in order, against the bot's state and
+// DB at now, and returns the first that trips or nil. The drawdown breaker
+// uses the NAV of botID's snapshots and the current NAV, the pair loss
+// breaker the position changes of trader.
+func (bot *Bot) CheckBreakers(breakers []CircuitBreaker, trader string, botID string,
+	now time.Time) (*BreakerTrip, error) {
+
+	for _, breaker := range breakers {
+		var trip *BreakerTrip
+		var err error
+
+		switch breaker.Name {
+		case BREAKER_DRAWDOWN:
+			trip, err = bot.checkDrawdown(breaker, botID, now)
+		case BREAKER_FAILED_TXS:
+			failed := sdk.NewDec(int64(bot.State.FailedTxs))
+			if failed.GTE(breaker.Threshold) {
+				trip = &BreakerTrip{Breaker: breaker, Value: failed,
+					Reason: fmt.Sprintf("%d txs failed in a row, limit %s", bot.State.FailedTxs, breaker.Threshold)}
+			}
+		case BREAKER_PAIR_LOSS:
+			trip, err = bot.checkPairLoss(breaker, trader, now)
+		case BREAKER_DIVERGENCE:
+			trip = bot.checkDivergence(breaker)
+		default:
+			err = fmt.Errorf("Unknown circuit breaker %q", breaker.Name)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot check circuit breaker %s: %w", breaker.Name, err)
+		}
+		if trip != nil {
+			return trip, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (bot *Bot) checkDrawdown(breaker CircuitBreaker, botID string, now time.Time) (*BreakerTrip, error) {
+
+	points, err := bot.DB.QueryNav(DBQuery{FromTime: now.Add(-breaker.Window)})
+	if err != nil {
+		return nil, err
+	}
+
+	nav := bot.State.PortfolioBalances.NAV(bot.State.Prices, bot.State.Positions).Total
+	peak := nav
+	for _, point := range points {
+		if point.BotID == botID && point.Nav.GT(peak) {
+			peak = point.Nav
+		}
+	}
+	if !peak.IsPositive() {
+		return nil, nil
+	}
+
+	drawdown := peak.Sub(nav).Quo(peak)
+	if drawdown.LTE(breaker.Threshold) {
+		return nil, nil
+	}
+
+	return &BreakerTrip{Breaker: breaker, Value: drawdown,
+		Reason: fmt.Sprintf("NAV %s is %s below its peak %s over %s, limit %s",
+			nav, drawdown, peak, breaker.Window, breaker.Threshold)}, nil
+}
+
+func (bot *Bot) checkPairLoss(breaker CircuitBreaker, trader string, now time.Time) (*BreakerTrip, error) {
+
+	midnight := now.UTC().Truncate(24 * time.Hour)
+	changes, err := bot.DB.QueryPositionChanges(DBQuery{Trader: trader, FromTime: midnight})
+	if err != nil {
+		return nil, err
+	}
+
+	pairs, _, err := SummarizePnl(changes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pair := range pairs {
+		if loss := pair.NetPnl.Neg(); loss.GT(breaker.Threshold) {
+			return &BreakerTrip{Breaker: breaker, Pair: pair.Pair, Value: loss,
+				Reason: fmt.Sprintf("%s lost %s since %s, limit %s",
+					pair.Pair, loss, midnight.Format(time.RFC3339), breaker.Threshold)}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (bot *Bot) checkDivergence(breaker CircuitBreaker) *BreakerTrip {
+
+	pairs := make([]string, 0, len(bot.State.Prices))
+	for pair := range bot.State.Prices {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+
+	for _, pair := range pairs {
+		prices := bot.State.Prices[pair]
+		if prices.IndexPrice.IsNil() || !prices.IndexPrice.IsPositive() || prices.MarkPrice.IsNil() {
+			continue
+		}
+		divergence := prices.MarkPrice.Sub(prices.IndexPrice).Abs().Quo(prices.IndexPrice)
+		if divergence.GT(breaker.Threshold) {
+			return &BreakerTrip{Breaker: breaker, Pair: pair, Value: divergence,
+				Reason: fmt.Sprintf("%s mark %s deviates %s from index %s, limit %s",
+					pair, prices.MarkPrice, divergence, prices.IndexPrice, breaker.Threshold)}
+		}
+	}
+
+	return nil
+}
+
+// RecordBreakerTrip persists trip at blockHeight for botID.
+func (bot *Bot) RecordBreakerTrip(trip *BreakerTrip, blockHeight int64, botID string) error {
+	return bot.DB.RecordBreakerTrip(&TableBreakerTrips{
+		BlockHeight: blockHeight,
+		BotID:       botID,
+		Breaker:     trip.Breaker.Name,
+		Pair:        trip.Pair,
+		Value:       decString(trip.Value),
+		Threshold:   decString(trip.Breaker.Threshold),
+		Response:    trip.Breaker.Response,
+		Reason:      trip.Reason,
+	})
+}
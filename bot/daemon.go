@@ -0,0 +1,120 @@
+package fbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Paths served by the daemon's status API.
+const (
+	DAEMON_STATUS_PATH = "/status"
+	DAEMON_PAUSE_PATH  = "/pause"
+	DAEMON_STOP_PATH   = "/stop"
+)
+
+// ServeStatus starts the daemon's HTTP API on Server.Addr in the background:
+//
+//   - GET  /status: the last published BotStatus as JSON
+//   - POST /pause: pause the bot, or resume it if it is paused
+//   - POST /stop: close all positions and stop the daemon
+//
+// Commands never wait for the daemon loop, which may be in the middle of an
+// iteration: they are queued on Server.PauseCh or Server.StopCh and answered
+// 202, or 409 if the same command is already queued.
+func (runner *Runner) ServeStatus() error {
+
+	listener, err := net.Listen("tcp", runner.Server.Addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(DAEMON_STATUS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(runner.Server.Status())
+	})
+
+	mux.HandleFunc(DAEMON_PAUSE_PATH, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		queueCommand(w, runner.Server.PauseCh)
+	})
+
+	mux.HandleFunc(DAEMON_STOP_PATH, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		queueCommand(w, runner.Server.StopCh)
+	})
+
+	go http.Serve(listener, mux)
+
+	return nil
+}
+
+// queueCommand sends a command to the daemon loop without blocking, the
+// channel must be buffered for the command to be queued while the loop is
+// busy.
+func queueCommand(w http.ResponseWriter, ch chan bool) {
+	select {
+	case ch <- true:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "Command already queued", http.StatusConflict)
+	}
+}
+
+var daemonClient = &http.Client{Timeout: 5 * time.Second}
+
+// QueryDaemonStatus fetches the status of a daemon serving on addr.
+func QueryDaemonStatus(addr string) (*BotStatus, error) {
+
+	resp, err := daemonClient.Get("http://" + addr + DAEMON_STATUS_PATH)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Daemon returned %s", resp.Status)
+	}
+
+	var status BotStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+
+	return &status, err
+}
+
+// SendDaemonCommand posts to one of the daemon's command paths, e.g.
+// DAEMON_PAUSE_PATH. The daemon runs the command once its current
+// iteration is done.
+func SendDaemonCommand(addr string, path string) error {
+
+	resp, err := daemonClient.Post("http://"+addr+path, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("Daemon returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// IsDaemonUnreachable reports whether err, from QueryDaemonStatus or
+// SendDaemonCommand, means no daemon is listening, as opposed to a daemon
+// that is slow or refused the command.
+func IsDaemonUnreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" && !opErr.Timeout()
+}
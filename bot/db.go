@@ -1,37 +1,211 @@
 package fbot
 
 import (
+	"fmt"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/NibiruChain/nibiru/x/common/asset"
 	sdk "github.com/cosmos/cosmos-sdk/types"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
+const DEFAULT_DB_NAME = "bot.db"
+
+// Drivers accepted by BotDB.Open and the DB_DRIVER config field.
+const (
+	DB_DRIVER_SQLITE   = "sqlite"
+	DB_DRIVER_POSTGRES = "postgres"
+)
+
 type BotDB struct {
-	DB   *gorm.DB
-	Name string
+	DB *gorm.DB
+	// Name: File of a SQLite DB, or the DSN of a PostgreSQL DB without its
+	// password.
+	Name   string
+	Driver string
+}
+
+// botTables: Every table created by the migrations with a block_height,
+// i.e. all but table_rollups, table_sync_state and schema_version.
+var botTables = []interface{}{&TablePrices{}, &TableAmms{}, &TablePosition{},
+	&TableBalances{}, &TableTrades{}, &TablePositionChanges{}, &TableSnapshots{},
+	&TableBreakerTrips{}}
+
+// DBQuery filters the rows returned by the Query functions. Zero values match
+// every row.
+type DBQuery struct {
+	Pair string
+	// Trader: Address whose positions, balances, trades, position changes
+	// and snapshots match, for a DB shared by several bots. Prices and amms
+	// are the same for every bot and match any trader.
+	Trader    string
+	FromBlock int64
+	ToBlock   int64
+	FromTime  time.Time
+	ToTime    time.Time
+}
+
+// BlockQuery matches the rows of a single block.
+func BlockQuery(blockHeight int64) DBQuery {
+	return DBQuery{FromBlock: blockHeight, ToBlock: blockHeight}
+}
+
+// filter applies the block and time range of query. The pair filter depends
+// on the table, see pairScope and denomScope, which also order the rows.
+func (query DBQuery) filter(db *gorm.DB) *gorm.DB {
+	return query.filterColumns(db, "")
+}
+
+// filterColumns is filter with the columns qualified by prefix, e.g.
+// "table_positions.", for queries that join tables.
+func (query DBQuery) filterColumns(db *gorm.DB, prefix string) *gorm.DB {
+	if query.FromBlock != 0 {
+		db = db.Where(prefix+"block_height >= ?", query.FromBlock)
+	}
+	if query.ToBlock != 0 {
+		db = db.Where(prefix+"block_height <= ?", query.ToBlock)
+	}
+	if !query.FromTime.IsZero() {
+		db = db.Where(prefix+"created_at >= ?", query.FromTime)
+	}
+	if !query.ToTime.IsZero() {
+		db = db.Where(prefix+"created_at <= ?", query.ToTime)
+	}
+	return db
+}
+
+// blockScope is filter, for tables without a pair, with the rows ordered.
+func (query DBQuery) blockScope(db *gorm.DB) *gorm.DB {
+	return query.filter(db).Order("block_height, id")
+}
+
+// snapshotScope is blockScope for table_snapshots, which has a trader.
+func (query DBQuery) snapshotScope(db *gorm.DB) *gorm.DB {
+	return query.blockScope(query.traderFilter(db))
+}
+
+func (query DBQuery) pairScope(db *gorm.DB) *gorm.DB {
+	return query.pairFilter(db).Order("block_height, id")
 }
 
-func CreateAndConnectDB(dbName string) BotDB {
+// traderScope is pairScope for the tables with a trader column.
+func (query DBQuery) traderScope(db *gorm.DB) *gorm.DB {
+	return query.pairScope(query.traderFilter(db))
+}
+
+func (query DBQuery) traderFilter(db *gorm.DB) *gorm.DB {
+	if query.Trader != "" {
+		db = db.Where("trader = ?", query.Trader)
+	}
+	return db
+}
+
+func (query DBQuery) pairFilter(db *gorm.DB) *gorm.DB {
+	if query.Pair != "" {
+		db = db.Where("pair = ?", query.Pair)
+	}
+	return query.filter(db)
+}
+
+// denomScope matches balances of the queried trader in either denom of the
+// queried pair.
+func (query DBQuery) denomScope(db *gorm.DB) *gorm.DB {
+	return query.denomFilter(db).Order("block_height, id")
+}
+
+func (query DBQuery) denomFilter(db *gorm.DB) *gorm.DB {
+	if query.Pair != "" {
+		pair := asset.Pair(query.Pair)
+		db = db.Where("denom IN ?", []string{pair.BaseDenom(), pair.QuoteDenom()})
+	}
+	return query.filter(query.traderFilter(db))
+}
+
+// CreateAndConnectDB opens and migrates the SQLite file dbName.
+func CreateAndConnectDB(dbName string) (BotDB, error) {
+	return CreateAndConnect(DB_DRIVER_SQLITE, dbName)
+}
+
+// CreateAndConnect opens and migrates the DB of driver at dsn.
+func CreateAndConnect(driver string, dsn string) (BotDB, error) {
 	botDB := new(BotDB)
 
-	botDB.ConnectToDB(dbName)
-	return *botDB
+	err := botDB.Connect(driver, dsn)
+	return *botDB, err
+}
+
+// ConnectToDB opens the SQLite file dbName and applies any pending
+// migrations.
+func (botdb *BotDB) ConnectToDB(dbName string) error {
+	return botdb.Connect(DB_DRIVER_SQLITE, dbName)
+}
+
+// Connect opens the DB and applies any pending migrations.
+func (botdb *BotDB) Connect(driver string, dsn string) error {
+	if err := botdb.Open(driver, dsn); err != nil {
+		return err
+	}
+
+	_, err := botdb.Migrate()
+	return err
 }
 
-func (botdb *BotDB) ConnectToDB(dbName string) {
-	db, err := gorm.Open(sqlite.Open(dbName), &gorm.Config{})
+// OpenDB opens the SQLite file dbName without migrating it.
+func (botdb *BotDB) OpenDB(dbName string) error {
+	return botdb.Open(DB_DRIVER_SQLITE, dbName)
+}
+
+// Open opens the DB without migrating it. An empty driver means SQLite, and
+// an empty SQLite dsn DEFAULT_DB_NAME.
+func (botdb *BotDB) Open(driver string, dsn string) error {
+
+	var dialector gorm.Dialector
+
+	switch driver {
+	case "", DB_DRIVER_SQLITE:
+		driver = DB_DRIVER_SQLITE
+		if dsn == "" {
+			dsn = DEFAULT_DB_NAME
+		}
+		dialector = sqlite.Open(dsn)
+	case DB_DRIVER_POSTGRES:
+		if dsn == "" {
+			return fmt.Errorf("A DSN is required for the %s driver", driver)
+		}
+		dialector = postgres.Open(dsn)
+	default:
+		return fmt.Errorf("Unknown DB driver %q, use %s or %s",
+			driver, DB_DRIVER_SQLITE, DB_DRIVER_POSTGRES)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
-		panic("failed to connect database")
+		return fmt.Errorf("failed to connect database: %w", err)
 	}
 	botdb.DB = db
-	botdb.Name = dbName
+	botdb.Driver = driver
+	botdb.Name = RedactDSN(dsn)
 
-	botdb.DB.AutoMigrate(&TablePrices{})
-	botdb.DB.AutoMigrate(&TableAmms{})
-	botdb.DB.AutoMigrate(&TableAmms{})
-	botdb.DB.AutoMigrate(&TableBalances{})
+	return nil
+}
+
+var dsnPasswordRegexp = regexp.MustCompile(`(password\s*=\s*)('[^']*'|\S+)`)
+
+// RedactDSN masks the password of a PostgreSQL URL or key=value DSN.
+func RedactDSN(dsn string) string {
+	if strings.Contains(dsn, "://") {
+		if dsnURL, err := url.Parse(dsn); err == nil {
+			return dsnURL.Redacted()
+		}
+	}
+	return dsnPasswordRegexp.ReplaceAllString(dsn, "${1}xxxxx")
 }
 
 func (botdb *BotDB) ClearDB() {
@@ -41,116 +215,205 @@ func (botdb *BotDB) ClearDB() {
 	botdb.DB.Where("pair IS NOT NULL").Delete(&TablePosition{})
 }
 
+// DeleteDB removes the SQLite file, or drops the bot's tables from a
+// PostgreSQL DB, which may be shared with other bots.
 func (botdb *BotDB) DeleteDB() {
+	if botdb.Driver == DB_DRIVER_POSTGRES {
+		botdb.DB.Migrator().DropTable(append(botTables, &TableRollups{}, &TableSyncState{},
+			&TableSchemaVersion{})...)
+		return
+	}
 	os.Remove(botdb.Name)
 }
 
 // Populating Tables
+//
+// The Populate functions write one bulk insert per table and return its
+// error. Run writes them together through SaveSnapshot.
+
+// DB_BATCH_SIZE: Rows per INSERT of the Populate functions.
+const DB_BATCH_SIZE = 100
 
-func (botdb *BotDB) PopulatePricesTable(prices map[string]Prices, blockHeight int64) {
-	for pair, priceField := range prices {
-		botdb.DB.Create(&TablePrices{
+func (botdb *BotDB) PopulatePricesTable(prices map[string]Prices, blockHeight int64) error {
+	return createRows(botdb.DB, priceRows(prices, blockHeight, 0))
+}
+
+func (botdb *BotDB) PopulateAmmsTable(amm map[string]AmmFields, blockHeight int64) error {
+	return createRows(botdb.DB, ammRows(amm, blockHeight, 0))
+}
+
+func (botdb *BotDB) PopulatePositionTable(positions map[string]PositionFields, blockHeight int64) error {
+	return createRows(botdb.DB, positionRows(positions, blockHeight, 0))
+}
+
+func (botdb *BotDB) PopulateBalancesTable(wallet sdk.Coins, trader string, blockHeight int64) error {
+	return createRows(botdb.DB, balanceRows(wallet, trader, blockHeight, 0))
+}
+
+func createRows[T any](db *gorm.DB, rows []T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	return db.CreateInBatches(rows, DB_BATCH_SIZE).Error
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func priceRows(prices map[string]Prices, blockHeight int64, snapshotID uint) []TablePrices {
+	rows := make([]TablePrices, 0, len(prices))
+	for _, pair := range sortedKeys(prices) {
+		priceField := prices[pair]
+		rows = append(rows, TablePrices{
 			Pair: pair, IndexPrice: priceField.IndexPrice.String(),
 			MarkPrice:   priceField.MarkPrice.String(),
 			BlockHeight: blockHeight,
+			SnapshotID:  snapshotID,
 		})
 	}
+	return rows
 }
 
-func (botdb *BotDB) PopulateAmmsTable(amm map[string]AmmFields, blockHeight int64) {
-	for pair, ammField := range amm {
-		botdb.DB.Create(&TableAmms{
+func ammRows(amm map[string]AmmFields, blockHeight int64, snapshotID uint) []TableAmms {
+	rows := make([]TableAmms, 0, len(amm))
+	for _, pair := range sortedKeys(amm) {
+		ammField := amm[pair]
+		rows = append(rows, TableAmms{
 			Pair:         pair,
 			BaseReserve:  ammField.Markets.BaseReserve.String(),
 			QuoteReserve: ammField.Markets.QuoteReserve.String(),
 			BlockHeight:  blockHeight,
 			Bias:         ammField.Bias.String(),
+			SnapshotID:   snapshotID,
 		})
 	}
+	return rows
 }
 
-func (botdb *BotDB) PopulatePositionTable(positions map[string]PositionFields, blockHeight int64) {
-	for pair, posField := range positions {
-		botdb.DB.Create(&TablePosition{
+func positionRows(positions map[string]PositionFields, blockHeight int64, snapshotID uint) []TablePosition {
+	rows := make([]TablePosition, 0, len(positions))
+	for _, pair := range sortedKeys(positions) {
+		posField := positions[pair]
+		rows = append(rows, TablePosition{
 			Pair:          pair,
 			UnrealizedPnl: posField.UnrealizedPnl.String(),
 			Size:          posField.Positon.Size_.String(),
 			Trader:        posField.Positon.TraderAddress,
 			BlockHeight:   blockHeight,
+			SnapshotID:    snapshotID,
 		})
 	}
+	return rows
 }
 
-func (botdb *BotDB) PopulateBalancesTable(wallet sdk.Coins, trader string, blockHeight int64) {
+func balanceRows(wallet sdk.Coins, trader string, blockHeight int64, snapshotID uint) []TableBalances {
+	rows := make([]TableBalances, 0, len(wallet))
 	for _, coin := range wallet {
-		botdb.DB.Create(&TableBalances{
+		rows = append(rows, TableBalances{
 			Trader:      trader,
 			Denom:       coin.Denom,
 			Amount:      coin.Amount.String(),
 			BlockHeight: blockHeight,
+			SnapshotID:  snapshotID,
 		})
 	}
+	return rows
 }
 
 // Querying Prices
 
-func (botdb *BotDB) QueryPricesByBlock(blockHeight int64) ([]TablePrices, error) {
+func (botdb *BotDB) QueryPrices(query DBQuery) ([]TablePrices, error) {
 	var prices []TablePrices
-	db := botdb.DB.Find(&prices, "block_height = ?", blockHeight)
+	db := botdb.DB.Scopes(query.pairScope).Find(&prices)
 	return prices, db.Error
 }
 
-func (botdb *BotDB) QueryPricesTable() ([]TablePrices, error) {
-	var allPrices []TablePrices
-	db := botdb.DB.Find(&allPrices)
+func (botdb *BotDB) QueryPricesByBlock(blockHeight int64) ([]TablePrices, error) {
+	return botdb.QueryPrices(BlockQuery(blockHeight))
+}
 
-	return allPrices, db.Error
+func (botdb *BotDB) QueryPricesTable() ([]TablePrices, error) {
+	return botdb.QueryPrices(DBQuery{})
 }
 
 // Querying Positions
 
-func (botdb *BotDB) QueryPositionByBlock(blockHeight int64) ([]TablePosition, error) {
+func (botdb *BotDB) QueryPositions(query DBQuery) ([]TablePosition, error) {
 	var positions []TablePosition
-	db := botdb.DB.Find(&positions, "block_height = ?", blockHeight)
+	db := botdb.DB.Scopes(query.traderScope).Find(&positions)
 	return positions, db.Error
 }
 
+func (botdb *BotDB) QueryPositionByBlock(blockHeight int64) ([]TablePosition, error) {
+	return botdb.QueryPositions(BlockQuery(blockHeight))
+}
+
 func (botdb *BotDB) QueryPositionTable() ([]TablePosition, error) {
-	var allPositions []TablePosition
-	db := botdb.DB.Find(&allPositions)
-	return allPositions, db.Error
+	return botdb.QueryPositions(DBQuery{})
 }
 
 // Querying Amms
 
-func (botdb *BotDB) QueryAmmByBlock(blockHeight int64) ([]TableAmms, error) {
+func (botdb *BotDB) QueryAmms(query DBQuery) ([]TableAmms, error) {
 	var amms []TableAmms
-	db := botdb.DB.Find(&amms, "block_height = ?", blockHeight)
-
+	db := botdb.DB.Scopes(query.pairScope).Find(&amms)
 	return amms, db.Error
 }
 
-func (botdb *BotDB) QueryAmmTable() ([]TableAmms, error) {
-	var allAmms []TableAmms
-	db := botdb.DB.Find(&allAmms)
+func (botdb *BotDB) QueryAmmByBlock(blockHeight int64) ([]TableAmms, error) {
+	return botdb.QueryAmms(BlockQuery(blockHeight))
+}
 
-	return allAmms, db.Error
+func (botdb *BotDB) QueryAmmTable() ([]TableAmms, error) {
+	return botdb.QueryAmms(DBQuery{})
 }
 
 // Querying Balances
 
-func (botdb *BotDB) QueryBalancesByBlock(blockHeight int64) ([]TableBalances, error) {
+func (botdb *BotDB) QueryBalances(query DBQuery) ([]TableBalances, error) {
 	var balances []TableBalances
-	db := botdb.DB.Find(&balances, "block_height = ?", blockHeight)
-
+	db := botdb.DB.Scopes(query.denomScope).Find(&balances)
 	return balances, db.Error
 }
 
+func (botdb *BotDB) QueryBalancesByBlock(blockHeight int64) ([]TableBalances, error) {
+	return botdb.QueryBalances(BlockQuery(blockHeight))
+}
+
 func (botdb *BotDB) QueryBalancesTable() ([]TableBalances, error) {
-	var allBalances []TableBalances
-	db := botdb.DB.Find(&allBalances)
+	return botdb.QueryBalances(DBQuery{})
+}
+
+// Querying Trades
+
+func (botdb *BotDB) QueryTrades(query DBQuery) ([]TableTrades, error) {
+	var trades []TableTrades
+	db := botdb.DB.Scopes(query.traderScope).Find(&trades)
+	return trades, db.Error
+}
+
+// RecordTrade adds a row to the trades journal.
+func (botdb *BotDB) RecordTrade(trade *TableTrades) error {
+	return botdb.DB.Create(trade).Error
+}
 
-	return allBalances, db.Error
+// QueryBreakerTrips returns the circuit breaker trips in the block and time
+// range of query. A query pair matches trips on that pair only.
+func (botdb *BotDB) QueryBreakerTrips(query DBQuery) ([]TableBreakerTrips, error) {
+	var trips []TableBreakerTrips
+	db := botdb.DB.Scopes(query.pairScope).Find(&trips)
+	return trips, db.Error
+}
+
+// RecordBreakerTrip adds a row to the circuit breaker trips.
+func (botdb *BotDB) RecordBreakerTrip(trip *TableBreakerTrips) error {
+	return botdb.DB.Create(trip).Error
 }
 
 // Querying All
@@ -177,3 +440,68 @@ func (botdb *BotDB) QueryAllTablesByBlockToJson(blockHeight int64) (string, []er
 
 	return DBRecordsToString(positions, amms, balances, prices), errors
 }
+
+func (botdb *BotDB) QueryAllTables(query DBQuery) (DBRecords, []error) {
+	var errors []error
+	amms, ammErr := botdb.QueryAmms(query)
+	prices, pricesErr := botdb.QueryPrices(query)
+	balances, balErr := botdb.QueryBalances(query)
+	positions, posErr := botdb.QueryPositions(query)
+	trades, tradesErr := botdb.QueryTrades(query)
+	changes, changesErr := botdb.QueryPositionChanges(query)
+	snapshots, snapshotsErr := botdb.QuerySnapshots(query)
+
+	errors = append(errors, ammErr, pricesErr, balErr, posErr, tradesErr, changesErr, snapshotsErr)
+
+	return DBRecords{
+		PositionRecords: positions,
+		AmmRecords:      amms,
+		BalanceRecords:  balances,
+		PriceRecords:    prices,
+		TradeRecords:    trades,
+		ChangeRecords:   changes,
+		SnapshotRecords: snapshots,
+	}, errors
+}
+
+// TableStats: Row count and block coverage of one table.
+type TableStats struct {
+	Table    string
+	Rows     int64
+	Blocks   int64
+	MinBlock int64
+	MaxBlock int64
+}
+
+// Stats reports the row count and block coverage of every bot table.
+func (botdb *BotDB) Stats() ([]TableStats, error) {
+
+	stats := make([]TableStats, 0, len(botTables))
+
+	for _, table := range botTables {
+		stmt := &gorm.Statement{DB: botdb.DB}
+		if err := stmt.Parse(table); err != nil {
+			return nil, err
+		}
+
+		tableStats := TableStats{Table: stmt.Schema.Table}
+
+		if !botdb.DB.Migrator().HasTable(table) {
+			stats = append(stats, tableStats)
+			continue
+		}
+
+		err := botdb.DB.Model(table).Select(
+			"COUNT(*) AS rows, COUNT(DISTINCT block_height) AS blocks, " +
+				"COALESCE(MIN(block_height), 0) AS min_block, " +
+				"COALESCE(MAX(block_height), 0) AS max_block",
+		).Scan(&tableStats).Error
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, tableStats)
+	}
+
+	return stats, nil
+}
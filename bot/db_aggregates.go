@@ -0,0 +1,104 @@
+package fbot
+
+// Aggregate queries over the numeric shadow columns. They are computed in SQL
+// on REAL values, so results are approximate to float64 precision.
+
+// SpreadStats: Mark minus index price of one pair over the queried range.
+type SpreadStats struct {
+	Pair      string
+	Samples   int64
+	MinSpread float64
+	MaxSpread float64
+	AvgSpread float64
+}
+
+// QuerySpreadStats returns the min, max and average mark-index spread of each
+// pair matching query.
+func (botdb *BotDB) QuerySpreadStats(query DBQuery) ([]SpreadStats, error) {
+	var stats []SpreadStats
+
+	err := botdb.DB.Model(&TablePrices{}).Scopes(query.pairFilter).Select(
+		"pair, COUNT(*) AS samples, " +
+			"MIN(mark_price_num - index_price_num) AS min_spread, " +
+			"MAX(mark_price_num - index_price_num) AS max_spread, " +
+			"AVG(mark_price_num - index_price_num) AS avg_spread",
+	).Group("pair").Order("pair").Scan(&stats).Error
+
+	return stats, err
+}
+
+// BalancePoint: Balance of one denom at one block, summed over the queried
+// traders. Change is the difference to the first block of the queried range.
+type BalancePoint struct {
+	BlockHeight int64
+	Denom       string
+	Amount      float64
+	Change      float64
+}
+
+// QueryCumulativeBalances returns the balance of each denom at every block
+// matching query, with its cumulative change over the range.
+func (botdb *BotDB) QueryCumulativeBalances(query DBQuery) ([]BalancePoint, error) {
+	var points []BalancePoint
+
+	err := botdb.DB.Model(&TableBalances{}).Scopes(query.denomFilter).Select(
+		"block_height, denom, SUM(amount_num) AS amount",
+	).Group("block_height, denom").Order("block_height, denom").Scan(&points).Error
+	if err != nil {
+		return nil, err
+	}
+
+	first := make(map[string]float64)
+	for i, point := range points {
+		start, seen := first[point.Denom]
+		if !seen {
+			start = point.Amount
+			first[point.Denom] = start
+		}
+		points[i].Change = point.Amount - start
+	}
+
+	return points, nil
+}
+
+// ExposurePoint: Position of one pair at one block. Notional is the absolute
+// size valued at the mark price of the same block.
+type ExposurePoint struct {
+	BlockHeight   int64
+	Pair          string
+	Size          float64
+	Notional      float64
+	UnrealizedPnl float64
+}
+
+// QueryExposure returns the size, notional and unrealized PnL of each pair at
+// every block matching query, summed over the queried traders. Positions are
+// valued at the latest price row of their block, and left out if there is
+// none.
+func (botdb *BotDB) QueryExposure(query DBQuery) ([]ExposurePoint, error) {
+	var points []ExposurePoint
+
+	latestPrices := botdb.DB.Model(&TablePrices{}).Select("MAX(id)").Group("pair, block_height")
+	db := botdb.DB.Model(&TablePosition{}).
+		Joins("JOIN table_prices ON table_prices.pair = table_positions.pair"+
+			" AND table_prices.block_height = table_positions.block_height"+
+			" AND table_prices.id IN (?)", latestPrices)
+	if query.Pair != "" {
+		db = db.Where("table_positions.pair = ?", query.Pair)
+	}
+	if query.Trader != "" {
+		db = db.Where("table_positions.trader = ?", query.Trader)
+	}
+
+	err := query.filterColumns(db, "table_positions.").Select(
+		"table_positions.block_height AS block_height, " +
+			"table_positions.pair AS pair, " +
+			"SUM(table_positions.size_num) AS size, " +
+			"SUM(ABS(table_positions.size_num) * table_prices.mark_price_num) AS notional, " +
+			"SUM(table_positions.unrealized_pnl_num) AS unrealized_pnl",
+	).Group("table_positions.block_height, table_positions.pair").
+		Order("table_positions.block_height, table_positions.pair").
+		Scan(&points).Error
+
+	return points, err
+}
@@ -0,0 +1,158 @@
+package fbot
+
+import (
+	"fmt"
+	"strings"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// exportTable: How ExportTable reads a table.
+type exportTable struct {
+	// newRow returns a pointer to an empty row to scan into.
+	newRow func() DBRow
+	scope  func(DBQuery, *gorm.DB) *gorm.DB
+	// decimals: Columns stored as decimal strings.
+	decimals []string
+}
+
+var exportTables = map[string]exportTable{
+	"prices": {func() DBRow { return &TablePrices{} }, DBQuery.pairScope,
+		[]string{"index_price", "mark_price"}},
+	"amms": {func() DBRow { return &TableAmms{} }, DBQuery.pairScope,
+		[]string{"base_reserve", "quote_reserve", "bias"}},
+	"positions": {func() DBRow { return &TablePosition{} }, DBQuery.traderScope,
+		[]string{"size", "unrealized_pnl"}},
+	"balances": {func() DBRow { return &TableBalances{} }, DBQuery.denomScope,
+		[]string{"amount"}},
+	"trades": {func() DBRow { return &TableTrades{} }, DBQuery.traderScope,
+		[]string{"quote_amount", "leverage", "filled_base", "avg_price", "fee", "quote_to_move",
+			"mark_price", "index_price", "position_size", "market_delta", "unrealized_pnl"}},
+	"position_changes": {func() DBRow { return &TablePositionChanges{} }, DBQuery.traderScope,
+		[]string{"size", "position_notional", "realized_pnl", "funding_payment", "fee",
+			"bad_debt", "margin_to_user"}},
+	"snapshots": {func() DBRow { return &TableSnapshots{} }, DBQuery.snapshotScope,
+		[]string{"nav"}},
+	"rollups": {func() DBRow { return &TableRollups{} }, DBQuery.rollupScope, nil},
+	"breaker_trips": {func() DBRow { return &TableBreakerTrips{} }, DBQuery.pairScope,
+		[]string{"value", "threshold"}},
+}
+
+// ExportTables: Tables ExportTable accepts, by their short name.
+var ExportTables = []string{"prices", "amms", "positions", "balances", "trades",
+	"position_changes", "snapshots", "rollups", "breaker_trips"}
+
+// Kinds of ExportColumn.
+const (
+	EXPORT_KIND_INT     = "int"
+	EXPORT_KIND_FLOAT   = "float"
+	EXPORT_KIND_BOOL    = "bool"
+	EXPORT_KIND_STRING  = "string"
+	EXPORT_KIND_DECIMAL = "decimal"
+)
+
+// ExportColumn: A column of the rows ExportTable passes. Kind is the type of
+// the column in the DB, or decimal for the exact decimal strings. Times are
+// RFC3339 strings, of kind string.
+type ExportColumn struct {
+	Name string
+	Kind string
+}
+
+// ExportColumns returns the columns of the rows ExportTable passes for table,
+// in the order of DBRow.Row.
+func (botdb *BotDB) ExportColumns(table string) ([]ExportColumn, error) {
+
+	export, err := exportTableNamed(table)
+	if err != nil {
+		return nil, err
+	}
+
+	row := export.newRow()
+	stmt := &gorm.Statement{DB: botdb.DB}
+	if err := stmt.Parse(row); err != nil {
+		return nil, err
+	}
+
+	columns := []ExportColumn{}
+	for _, name := range row.Header() {
+		column := ExportColumn{Name: name, Kind: EXPORT_KIND_STRING}
+		if containsString(export.decimals, name) {
+			column.Kind = EXPORT_KIND_DECIMAL
+		} else if field := stmt.Schema.LookUpField(name); field != nil {
+			switch field.DataType {
+			case schema.Int, schema.Uint:
+				column.Kind = EXPORT_KIND_INT
+			case schema.Float:
+				column.Kind = EXPORT_KIND_FLOAT
+			case schema.Bool:
+				column.Kind = EXPORT_KIND_BOOL
+			}
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, nil
+}
+
+func exportTableNamed(table string) (exportTable, error) {
+	export, exists := exportTables[table]
+	if !exists {
+		return export, fmt.Errorf("Cannot export unknown table %q, use one of %s",
+			table, strings.Join(ExportTables, ", "))
+	}
+	return export, nil
+}
+
+// ExportTable calls write with the DBRow.Row of each row of table matching
+// query, in the order of the table's Query function. Decimals are written
+// as sdk.Dec formats them, whatever string they were stored as; empty ones
+// stay empty. Rows are read from a cursor one at a time, so tables of any
+// size can be exported without loading them.
+func (botdb *BotDB) ExportTable(table string, query DBQuery, write func([]string) error) error {
+
+	export, err := exportTableNamed(table)
+	if err != nil {
+		return err
+	}
+
+	header := export.newRow().Header()
+	decimals := []int{}
+	for i, name := range header {
+		if containsString(export.decimals, name) {
+			decimals = append(decimals, i)
+		}
+	}
+
+	scope := func(db *gorm.DB) *gorm.DB { return export.scope(query, db) }
+	rows, err := botdb.DB.Model(export.newRow()).Scopes(scope).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := export.newRow()
+		if err := botdb.DB.ScanRows(rows, row); err != nil {
+			return err
+		}
+		values := row.Row()
+		for _, i := range decimals {
+			if values[i] == "" {
+				continue
+			}
+			dec, err := sdk.NewDecFromStr(values[i])
+			if err != nil {
+				return fmt.Errorf("Cannot export %s %s of row %s: %w", table, header[i], values[0], err)
+			}
+			values[i] = dec.String()
+		}
+		if err := write(values); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
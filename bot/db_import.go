@@ -0,0 +1,305 @@
+package fbot
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// ImportMode: What ImportDbRecords does with a record whose natural key, e.g.
+// (pair, block height) for prices, is already in the DB.
+type ImportMode string
+
+const (
+	// IMPORT_SKIP keeps the existing row.
+	IMPORT_SKIP ImportMode = "skip"
+	// IMPORT_OVERWRITE replaces the existing row's values, keeping its ID.
+	IMPORT_OVERWRITE ImportMode = "overwrite"
+	// IMPORT_RENUMBER inserts every record without matching natural keys,
+	// except position changes, which are skipped as with IMPORT_SKIP.
+	IMPORT_RENUMBER ImportMode = "renumber"
+)
+
+// ImportModes lists the valid ImportModes.
+var ImportModes = []ImportMode{IMPORT_SKIP, IMPORT_OVERWRITE, IMPORT_RENUMBER}
+
+// ImportTableSummary: What ImportDbRecords did with the records of a table.
+type ImportTableSummary struct {
+	Table    string
+	Inserted int
+	Updated  int
+	Skipped  int
+	Failed   int
+}
+
+// ImportFailure: A record ImportDbRecords rejected. Index is its position in
+// its DBRecords slice.
+type ImportFailure struct {
+	Table string
+	Index int
+	Error string
+}
+
+// ImportSummary: Result of ImportDbRecords, per table in import order.
+type ImportSummary struct {
+	Tables   []ImportTableSummary
+	Failures []ImportFailure
+}
+
+// importRecord is implemented by pointers to the table structs
+// ImportDbRecords accepts.
+type importRecord[T any] interface {
+	*T
+	model() *gorm.Model
+	// naturalKey: Columns identifying the row independently of its ID.
+	naturalKey() map[string]interface{}
+	// validate checks the record before anything is written.
+	validate() error
+}
+
+// snapshotRecord is implemented by the tables that reference a snapshot.
+type snapshotRecord interface {
+	snapshotID() *uint
+}
+
+// ImportDbRecords writes records, e.g. the export of another bot's DB, in a
+// single transaction. Record IDs are never reused: inserted rows get new
+// IDs, and the SnapshotID of amms, prices, positions and balances is mapped
+// to the ID their snapshot got in this DB, or 0 if it isn't among records.
+// Invalid records are counted as failed and left out; a DB error rolls the
+// whole import back.
+func (botdb *BotDB) ImportDbRecords(records DBRecords, mode ImportMode) (ImportSummary, error) {
+
+	summary := ImportSummary{}
+
+	if !containsMode(ImportModes, mode) {
+		return summary, fmt.Errorf("Unknown import mode %q", mode)
+	}
+
+	err := botdb.DB.Transaction(func(tx *gorm.DB) error {
+		summary = ImportSummary{}
+
+		snapshotIDs, err := importRows(tx, "snapshots", records.SnapshotRecords, mode, nil, &summary)
+		if err != nil {
+			return err
+		}
+		if _, err = importRows(tx, "prices", records.PriceRecords, mode, snapshotIDs, &summary); err != nil {
+			return err
+		}
+		if _, err = importRows(tx, "amms", records.AmmRecords, mode, snapshotIDs, &summary); err != nil {
+			return err
+		}
+		if _, err = importRows(tx, "positions", records.PositionRecords, mode, snapshotIDs, &summary); err != nil {
+			return err
+		}
+		if _, err = importRows(tx, "balances", records.BalanceRecords, mode, snapshotIDs, &summary); err != nil {
+			return err
+		}
+		if _, err = importRows(tx, "trades", records.TradeRecords, mode, nil, &summary); err != nil {
+			return err
+		}
+		// idx_position_change is unique, so changes are never renumbered.
+		changesMode := mode
+		if mode == IMPORT_RENUMBER {
+			changesMode = IMPORT_SKIP
+		}
+		_, err = importRows(tx, "position_changes", records.ChangeRecords, changesMode, nil, &summary)
+		return err
+	})
+
+	return summary, err
+}
+
+// importRows imports rows into their table and returns the IDs the rows got,
+// by their ID in records.
+func importRows[T any, P importRecord[T]](tx *gorm.DB, table string, rows []T, mode ImportMode,
+	snapshotIDs map[uint]uint, summary *ImportSummary) (map[uint]uint, error) {
+
+	tableSummary := ImportTableSummary{Table: table}
+	ids := make(map[uint]uint)
+
+	for i := range rows {
+		// Copy, so the caller's records keep their IDs.
+		row := rows[i]
+		record := P(&row)
+		recordID := record.model().ID
+
+		if err := record.validate(); err != nil {
+			tableSummary.Failed++
+			summary.Failures = append(summary.Failures,
+				ImportFailure{Table: table, Index: i, Error: err.Error()})
+			continue
+		}
+
+		if linked, ok := any(record).(snapshotRecord); ok {
+			id := linked.snapshotID()
+			*id = snapshotIDs[*id]
+		}
+
+		if mode != IMPORT_RENUMBER {
+			var existing T
+			found := tx.Where(record.naturalKey()).Limit(1).Find(&existing)
+			if found.Error != nil {
+				return nil, fmt.Errorf("Cannot import %s record %d: %w", table, i, found.Error)
+			}
+			if found.RowsAffected > 0 {
+				existingModel := P(&existing).model()
+				ids[recordID] = existingModel.ID
+
+				if mode == IMPORT_SKIP {
+					tableSummary.Skipped++
+					continue
+				}
+
+				model := record.model()
+				model.ID = existingModel.ID
+				model.DeletedAt = gorm.DeletedAt{}
+				if model.CreatedAt.IsZero() {
+					model.CreatedAt = existingModel.CreatedAt
+				}
+				if err := tx.Save(record).Error; err != nil {
+					return nil, fmt.Errorf("Cannot import %s record %d: %w", table, i, err)
+				}
+				tableSummary.Updated++
+				continue
+			}
+		}
+
+		model := record.model()
+		model.ID = 0
+		model.DeletedAt = gorm.DeletedAt{}
+		if err := tx.Create(record).Error; err != nil {
+			return nil, fmt.Errorf("Cannot import %s record %d: %w", table, i, err)
+		}
+		ids[recordID] = model.ID
+		tableSummary.Inserted++
+	}
+
+	summary.Tables = append(summary.Tables, tableSummary)
+
+	return ids, nil
+}
+
+func containsMode(modes []ImportMode, mode ImportMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func requireFields(fields map[string]string) error {
+	for _, name := range sortedKeys(fields) {
+		if fields[name] == "" {
+			return fmt.Errorf("Missing %s", name)
+		}
+	}
+	return nil
+}
+
+func (prices *TablePrices) model() *gorm.Model { return &prices.Model }
+func (prices *TablePrices) snapshotID() *uint  { return &prices.SnapshotID }
+
+func (prices *TablePrices) naturalKey() map[string]interface{} {
+	return map[string]interface{}{"pair": prices.Pair, "block_height": prices.BlockHeight}
+}
+
+func (prices *TablePrices) validate() error {
+	if err := requireFields(map[string]string{"Pair": prices.Pair}); err != nil {
+		return err
+	}
+	return prices.BeforeSave(nil)
+}
+
+func (amms *TableAmms) model() *gorm.Model { return &amms.Model }
+func (amms *TableAmms) snapshotID() *uint  { return &amms.SnapshotID }
+
+func (amms *TableAmms) naturalKey() map[string]interface{} {
+	return map[string]interface{}{"pair": amms.Pair, "block_height": amms.BlockHeight}
+}
+
+func (amms *TableAmms) validate() error {
+	if err := requireFields(map[string]string{"Pair": amms.Pair}); err != nil {
+		return err
+	}
+	return amms.BeforeSave(nil)
+}
+
+func (position *TablePosition) model() *gorm.Model { return &position.Model }
+func (position *TablePosition) snapshotID() *uint  { return &position.SnapshotID }
+
+func (position *TablePosition) naturalKey() map[string]interface{} {
+	return map[string]interface{}{"trader": position.Trader, "pair": position.Pair,
+		"block_height": position.BlockHeight}
+}
+
+func (position *TablePosition) validate() error {
+	err := requireFields(map[string]string{"Pair": position.Pair, "Trader": position.Trader})
+	if err != nil {
+		return err
+	}
+	return position.BeforeSave(nil)
+}
+
+func (balances *TableBalances) model() *gorm.Model { return &balances.Model }
+func (balances *TableBalances) snapshotID() *uint  { return &balances.SnapshotID }
+
+func (balances *TableBalances) naturalKey() map[string]interface{} {
+	return map[string]interface{}{"trader": balances.Trader, "denom": balances.Denom,
+		"block_height": balances.BlockHeight}
+}
+
+func (balances *TableBalances) validate() error {
+	err := requireFields(map[string]string{"Denom": balances.Denom, "Trader": balances.Trader})
+	if err != nil {
+		return err
+	}
+	return balances.BeforeSave(nil)
+}
+
+func (snapshot *TableSnapshots) model() *gorm.Model { return &snapshot.Model }
+
+func (snapshot *TableSnapshots) naturalKey() map[string]interface{} {
+	return map[string]interface{}{"bot_id": snapshot.BotID, "run_id": snapshot.RunID,
+		"block_height": snapshot.BlockHeight}
+}
+
+func (snapshot *TableSnapshots) validate() error {
+	err := requireFields(map[string]string{"BotID": snapshot.BotID, "RunID": snapshot.RunID})
+	if err != nil {
+		return err
+	}
+	return snapshot.BeforeSave(nil)
+}
+
+func (trades *TableTrades) model() *gorm.Model { return &trades.Model }
+
+// naturalKey of a trade: Failed orders have no tx hash, so the order's
+// fields are part of it.
+func (trades *TableTrades) naturalKey() map[string]interface{} {
+	return map[string]interface{}{"tx_hash": trades.TxHash, "block_height": trades.BlockHeight,
+		"trader": trades.Trader, "pair": trades.Pair, "action": trades.Action, "side": trades.Side}
+}
+
+func (trades *TableTrades) validate() error {
+	return requireFields(map[string]string{"Pair": trades.Pair, "Trader": trades.Trader,
+		"Action": trades.Action})
+}
+
+func (change *TablePositionChanges) model() *gorm.Model { return &change.Model }
+
+// naturalKey of a position change: The columns of idx_position_change.
+func (change *TablePositionChanges) naturalKey() map[string]interface{} {
+	return map[string]interface{}{"block_height": change.BlockHeight, "tx_hash": change.TxHash,
+		"source": change.Source, "event_index": change.EventIndex}
+}
+
+func (change *TablePositionChanges) validate() error {
+	err := requireFields(map[string]string{"Pair": change.Pair, "Trader": change.Trader,
+		"Source": change.Source})
+	if err != nil {
+		return err
+	}
+	return change.BeforeSave(nil)
+}
@@ -0,0 +1,569 @@
+package fbot
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration: One step of the BotDB schema. Applied migrations are recorded in
+// the schema_version table with their checksum, so a migration must never be
+// edited once released; add a new one instead.
+type Migration struct {
+	Version int
+	Name    string
+	// Models: Table structs to AutoMigrate. These are frozen copies of the
+	// tables as of this migration, not the live Table* structs, so replaying
+	// old migrations on a new DB gives the same schema.
+	Models []interface{}
+	// Statements: SQL run after Models are migrated. Keep it portable between
+	// SQLite and PostgreSQL.
+	Statements []string
+	// Up: Optional data migration run last. Unlike Models and Statements it is
+	// not covered by the checksum.
+	Up func(tx *gorm.DB) error
+}
+
+// TableSchemaVersion: Row of the schema_version table, one per applied
+// migration.
+type TableSchemaVersion struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func (TableSchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// Checksum hashes the migration's name, model schemas and statements.
+func (migration Migration) Checksum() string {
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d:%s\n", migration.Version, migration.Name)
+
+	for _, model := range migration.Models {
+		modelType := reflect.Indirect(reflect.ValueOf(model)).Type()
+		fmt.Fprintf(hash, "model %s\n", tableNameOf(model))
+		for i := 0; i < modelType.NumField(); i++ {
+			field := modelType.Field(i)
+			fmt.Fprintf(hash, "%s %s `%s`\n", field.Name, field.Type, field.Tag)
+		}
+	}
+
+	for _, statement := range migration.Statements {
+		fmt.Fprintf(hash, "sql %s\n", strings.TrimSpace(statement))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func tableNameOf(model interface{}) string {
+	if tabler, ok := model.(interface{ TableName() string }); ok {
+		return tabler.TableName()
+	}
+	return reflect.Indirect(reflect.ValueOf(model)).Type().Name()
+}
+
+// SchemaVersion returns the highest applied migration version, or 0 for a
+// DB that has never been migrated.
+func (botdb *BotDB) SchemaVersion() (int, error) {
+
+	if !botdb.DB.Migrator().HasTable(&TableSchemaVersion{}) {
+		return 0, nil
+	}
+
+	var version int
+	err := botdb.DB.Model(&TableSchemaVersion{}).
+		Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+
+	return version, err
+}
+
+// PendingMigrations checks the checksums of applied migrations and returns
+// the ones not yet applied, in order.
+func (botdb *BotDB) PendingMigrations() ([]Migration, error) {
+
+	if err := botdb.DB.AutoMigrate(&TableSchemaVersion{}); err != nil {
+		return nil, err
+	}
+
+	var applied []TableSchemaVersion
+	if err := botdb.DB.Order("version").Find(&applied).Error; err != nil {
+		return nil, err
+	}
+
+	appliedByVersion := make(map[int]TableSchemaVersion)
+	for _, row := range applied {
+		appliedByVersion[row.Version] = row
+	}
+
+	latest := Migrations[len(Migrations)-1].Version
+	pending := []Migration{}
+
+	for _, migration := range Migrations {
+		row, isApplied := appliedByVersion[migration.Version]
+		if !isApplied {
+			pending = append(pending, migration)
+			continue
+		}
+		if row.Checksum != migration.Checksum() {
+			return nil, fmt.Errorf(
+				"Migration %d (%s) was changed after it was applied to %s",
+				migration.Version, migration.Name, botdb.Name)
+		}
+	}
+
+	if len(applied) > 0 && applied[len(applied)-1].Version > latest {
+		return nil, fmt.Errorf(
+			"%s has schema version %d, newer than this bot's %d",
+			botdb.Name, applied[len(applied)-1].Version, latest)
+	}
+
+	return pending, nil
+}
+
+// Migrate applies pending migrations in order, each in its own transaction,
+// and returns the ones it applied.
+func (botdb *BotDB) Migrate() ([]Migration, error) {
+
+	pending, err := botdb.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, migration := range pending {
+		err := botdb.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(migration.Models...); err != nil {
+				return err
+			}
+			for _, statement := range migration.Statements {
+				if err := tx.Exec(statement).Error; err != nil {
+					return err
+				}
+			}
+			if migration.Up != nil {
+				if err := migration.Up(tx); err != nil {
+					return err
+				}
+			}
+			return tx.Create(&TableSchemaVersion{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Checksum:  migration.Checksum(),
+				AppliedAt: time.Now().UTC(),
+			}).Error
+		})
+
+		if err != nil {
+			return pending[:i], fmt.Errorf("Migration %d (%s) failed: %w",
+				migration.Version, migration.Name, err)
+		}
+	}
+
+	return pending, nil
+}
+
+// Migrations: Every BotDB schema version, in order. Append only.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create bot tables",
+		Models: []interface{}{
+			&tablePricesV1{}, &tableAmmsV1{}, &tablePositionV1{}, &tableBalancesV1{},
+		},
+	},
+	{
+		Version: 2,
+		Name:    "index block heights",
+		Statements: []string{
+			"CREATE INDEX IF NOT EXISTS idx_table_prices_block_height ON table_prices (block_height)",
+			"CREATE INDEX IF NOT EXISTS idx_table_amms_block_height ON table_amms (block_height)",
+			"CREATE INDEX IF NOT EXISTS idx_table_positions_block_height ON table_positions (block_height)",
+			"CREATE INDEX IF NOT EXISTS idx_table_balances_block_height ON table_balances (block_height)",
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add numeric shadow columns",
+		Models: []interface{}{
+			&tablePricesV3{}, &tableAmmsV3{}, &tablePositionV3{}, &tableBalancesV3{},
+		},
+		Up: func(tx *gorm.DB) error {
+			return backfillNumeric(tx, map[string][]string{
+				"table_prices":    {"index_price", "mark_price"},
+				"table_amms":      {"base_reserve", "quote_reserve", "bias"},
+				"table_positions": {"unrealized_pnl", "size"},
+				"table_balances":  {"amount"},
+			})
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create trades journal",
+		Models:  []interface{}{&tableTradesV4{}},
+		Statements: []string{
+			"CREATE INDEX IF NOT EXISTS idx_table_trades_block_height ON table_trades (block_height)",
+		},
+	},
+	{
+		Version: 5,
+		Name:    "create position changes",
+		Models:  []interface{}{&tablePositionChangesV5{}},
+	},
+	{
+		Version: 6,
+		Name:    "create snapshots",
+		Models: []interface{}{
+			&tableSnapshotsV6{}, &tablePricesV6{}, &tableAmmsV6{},
+			&tablePositionV6{}, &tableBalancesV6{},
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create rollups",
+		Models:  []interface{}{&tableRollupsV7{}},
+		Statements: []string{
+			"CREATE INDEX IF NOT EXISTS idx_table_prices_created_at ON table_prices (created_at)",
+			"CREATE INDEX IF NOT EXISTS idx_table_amms_created_at ON table_amms (created_at)",
+			"CREATE INDEX IF NOT EXISTS idx_table_positions_created_at ON table_positions (created_at)",
+			"CREATE INDEX IF NOT EXISTS idx_table_balances_created_at ON table_balances (created_at)",
+			"CREATE INDEX IF NOT EXISTS idx_table_snapshots_created_at ON table_snapshots (created_at)",
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add snapshot nav",
+		Models:  []interface{}{&tableSnapshotsV8{}},
+	},
+	{
+		Version: 9,
+		Name:    "create breaker trips",
+		Models:  []interface{}{&tableBreakerTripsV9{}},
+	},
+	{
+		Version: 10,
+		Name:    "scope rows by trader",
+		Models:  []interface{}{&tableSnapshotsV10{}, &tableRollupsV10{}},
+		Statements: []string{
+			"UPDATE table_snapshots SET trader = COALESCE(" +
+				"(SELECT MIN(trader) FROM table_balances WHERE table_balances.snapshot_id = table_snapshots.id), " +
+				"(SELECT MIN(trader) FROM table_positions WHERE table_positions.snapshot_id = table_snapshots.id), " +
+				"'') WHERE trader IS NULL OR trader = ''",
+			"CREATE INDEX IF NOT EXISTS idx_table_positions_trader ON table_positions (trader, block_height)",
+			"CREATE INDEX IF NOT EXISTS idx_table_balances_trader ON table_balances (trader, block_height)",
+			"CREATE INDEX IF NOT EXISTS idx_table_position_changes_trader ON table_position_changes (trader, block_height)",
+		},
+	},
+	{
+		Version: 11,
+		Name:    "create sync state",
+		Models:  []interface{}{&tableSyncStateV11{}},
+		Statements: []string{
+			// Run syncs the position changes after every snapshot, so the
+			// last snapshot of a trader is about as far as it synced.
+			"INSERT INTO table_sync_state (trader, events_synced_height, updated_at) " +
+				"SELECT trader, MAX(block_height), CURRENT_TIMESTAMP FROM table_snapshots " +
+				"WHERE trader <> '' GROUP BY trader",
+		},
+	},
+	{
+		Version: 12,
+		Name:    "add position change block times",
+		Models:  []interface{}{&tablePositionChangesV12{}},
+		Statements: []string{
+			// Changes are synced before the next snapshot, whose time is
+			// the closest known to their block's.
+			"UPDATE table_position_changes SET block_time = COALESCE(" +
+				"(SELECT MIN(taken_at) FROM table_snapshots " +
+				"WHERE table_snapshots.block_height >= table_position_changes.block_height), " +
+				"created_at) WHERE block_time IS NULL",
+		},
+	},
+}
+
+// backfillNumeric fills the <column>_num shadow of each decimal string column
+// in rows written before the shadows existed.
+func backfillNumeric(tx *gorm.DB, tables map[string][]string) error {
+
+	for table, columns := range tables {
+		rows, err := tx.Table(table).
+			Select(append([]string{"id"}, columns...)).Rows()
+		if err != nil {
+			return err
+		}
+
+		updates := make(map[uint]map[string]interface{})
+		for rows.Next() {
+			var id uint
+			values := make([]sql.NullString, len(columns))
+			dest := []interface{}{&id}
+			for i := range values {
+				dest = append(dest, &values[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return err
+			}
+
+			update := make(map[string]interface{})
+			for i, column := range columns {
+				num, err := numericColumn(column, values[i].String)
+				if err != nil {
+					rows.Close()
+					return fmt.Errorf("%s row %d: %w", table, id, err)
+				}
+				update[column+"_num"] = num
+			}
+			updates[id] = update
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for id, update := range updates {
+			if err := tx.Table(table).Where("id = ?", id).Updates(update).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Frozen table schemas used by the migrations above.
+
+type tablePricesV1 struct {
+	gorm.Model
+	Pair        string
+	IndexPrice  string
+	MarkPrice   string
+	BlockHeight int64
+}
+
+func (tablePricesV1) TableName() string { return "table_prices" }
+
+type tableAmmsV1 struct {
+	gorm.Model
+	Pair         string
+	BaseReserve  string
+	QuoteReserve string
+	BlockHeight  int64
+	Bias         string
+}
+
+func (tableAmmsV1) TableName() string { return "table_amms" }
+
+type tablePositionV1 struct {
+	gorm.Model
+	Pair          string
+	UnrealizedPnl string
+	Size          string
+	Trader        string
+	BlockHeight   int64
+}
+
+func (tablePositionV1) TableName() string { return "table_positions" }
+
+type tableBalancesV1 struct {
+	gorm.Model
+	Trader      string
+	Denom       string
+	Amount      string
+	BlockHeight int64
+}
+
+func (tableBalancesV1) TableName() string { return "table_balances" }
+
+// The V3 structs only hold the columns added by migration 3, AutoMigrate adds
+// them to the existing tables.
+
+type tablePricesV3 struct {
+	IndexPriceNum float64
+	MarkPriceNum  float64
+}
+
+func (tablePricesV3) TableName() string { return "table_prices" }
+
+type tableAmmsV3 struct {
+	BaseReserveNum  float64
+	QuoteReserveNum float64
+	BiasNum         float64
+}
+
+func (tableAmmsV3) TableName() string { return "table_amms" }
+
+type tablePositionV3 struct {
+	UnrealizedPnlNum float64
+	SizeNum          float64
+}
+
+func (tablePositionV3) TableName() string { return "table_positions" }
+
+type tableBalancesV3 struct {
+	AmountNum float64
+}
+
+func (tableBalancesV3) TableName() string { return "table_balances" }
+
+type tableTradesV4 struct {
+	gorm.Model
+	TxHash          string
+	BlockHeight     int64
+	Pair            string
+	Trader          string
+	Action          string
+	Side            string
+	QuoteAmount     string
+	Leverage        string
+	FilledBase      string
+	AvgPrice        string
+	Fee             string
+	GasUsed         int64
+	Code            uint32
+	RawLog          string
+	Error           string
+	QuoteToMove     string
+	MarkPrice       string
+	IndexPrice      string
+	PositionSize    string
+	MarketDelta     string
+	UnrealizedPnl   string
+	IsAgainstMarket bool
+}
+
+func (tableTradesV4) TableName() string { return "table_trades" }
+
+type tablePositionChangesV5 struct {
+	gorm.Model
+	BlockHeight       int64  `gorm:"uniqueIndex:idx_position_change"`
+	TxHash            string `gorm:"uniqueIndex:idx_position_change"`
+	Source            string `gorm:"uniqueIndex:idx_position_change"`
+	EventIndex        int    `gorm:"uniqueIndex:idx_position_change"`
+	Pair              string
+	Trader            string
+	ChangeReason      string
+	Size              string
+	PositionNotional  string
+	RealizedPnl       string
+	FundingPayment    string
+	Fee               string
+	FeeDenom          string
+	BadDebt           string
+	MarginToUser      string
+	RealizedPnlNum    float64
+	FundingPaymentNum float64
+	FeeNum            float64
+}
+
+func (tablePositionChangesV5) TableName() string { return "table_position_changes" }
+
+type tableSnapshotsV6 struct {
+	gorm.Model
+	BlockHeight int64 `gorm:"index"`
+	TakenAt     time.Time
+	BotID       string `gorm:"index"`
+	RunID       string
+}
+
+func (tableSnapshotsV6) TableName() string { return "table_snapshots" }
+
+// The other V6 structs add snapshot_id to the snapshot tables.
+
+type tablePricesV6 struct {
+	SnapshotID uint `gorm:"index"`
+}
+
+func (tablePricesV6) TableName() string { return "table_prices" }
+
+type tableAmmsV6 struct {
+	SnapshotID uint `gorm:"index"`
+}
+
+func (tableAmmsV6) TableName() string { return "table_amms" }
+
+type tablePositionV6 struct {
+	SnapshotID uint `gorm:"index"`
+}
+
+func (tablePositionV6) TableName() string { return "table_positions" }
+
+type tableBalancesV6 struct {
+	SnapshotID uint `gorm:"index"`
+}
+
+func (tableBalancesV6) TableName() string { return "table_balances" }
+
+type tableRollupsV7 struct {
+	gorm.Model
+	SourceTable string `gorm:"index:idx_rollup_source"`
+	GroupKey    string `gorm:"index:idx_rollup_source"`
+	ColumnName  string
+	FromBlock   int64 `gorm:"index:idx_rollup_source"`
+	ToBlock     int64
+	Samples     int64
+	MinValue    float64
+	MaxValue    float64
+	AvgValue    float64
+}
+
+func (tableRollupsV7) TableName() string { return "table_rollups" }
+
+// tableSnapshotsV8 adds the NAV columns to table_snapshots.
+type tableSnapshotsV8 struct {
+	Nav    string
+	NavNum float64
+}
+
+func (tableSnapshotsV8) TableName() string { return "table_snapshots" }
+
+type tableBreakerTripsV9 struct {
+	gorm.Model
+	BlockHeight int64 `gorm:"index"`
+	BotID       string
+	Breaker     string
+	Pair        string
+	Value       string
+	Threshold   string
+	Response    string
+	Reason      string
+}
+
+func (tableBreakerTripsV9) TableName() string { return "table_breaker_trips" }
+
+// tableSnapshotsV10 adds the trader to table_snapshots.
+type tableSnapshotsV10 struct {
+	Trader string `gorm:"index"`
+}
+
+func (tableSnapshotsV10) TableName() string { return "table_snapshots" }
+
+// tableRollupsV10 adds the trader to table_rollups.
+type tableRollupsV10 struct {
+	Trader string
+}
+
+func (tableRollupsV10) TableName() string { return "table_rollups" }
+
+type tableSyncStateV11 struct {
+	Trader             string `gorm:"primaryKey"`
+	EventsSyncedHeight int64
+	UpdatedAt          time.Time
+}
+
+func (tableSyncStateV11) TableName() string { return "table_sync_state" }
+
+// tablePositionChangesV12 adds the block time to table_position_changes.
+type tablePositionChangesV12 struct {
+	BlockTime time.Time
+}
+
+func (tablePositionChangesV12) TableName() string { return "table_position_changes" }
@@ -3,10 +3,13 @@ package fbot
 import "encoding/json"
 
 type DBRecords struct {
-	PositionRecords []TablePosition `json:"positions"`
-	AmmRecords      []TableAmms     `json:"amms"`
-	BalanceRecords  []TableBalances `json:"balances"`
-	PriceRecords    []TablePrices   `json:"prices"`
+	PositionRecords []TablePosition        `json:"positions"`
+	AmmRecords      []TableAmms            `json:"amms"`
+	BalanceRecords  []TableBalances        `json:"balances"`
+	PriceRecords    []TablePrices          `json:"prices"`
+	TradeRecords    []TableTrades          `json:"trades,omitempty"`
+	ChangeRecords   []TablePositionChanges `json:"position_changes,omitempty"`
+	SnapshotRecords []TableSnapshots       `json:"snapshots,omitempty"`
 }
 
 func NewDBRecordsFromString(recordsJson string) (DBRecords, error) {
@@ -18,6 +21,9 @@ func NewDBRecordsFromString(recordsJson string) (DBRecords, error) {
 		AmmRecords:      dbRecords.AmmRecords,
 		BalanceRecords:  dbRecords.BalanceRecords,
 		PriceRecords:    dbRecords.PriceRecords,
+		TradeRecords:    dbRecords.TradeRecords,
+		ChangeRecords:   dbRecords.ChangeRecords,
+		SnapshotRecords: dbRecords.SnapshotRecords,
 	}
 	return records, err
 }
@@ -32,22 +38,6 @@ func DBRecordsToString(positions []TablePosition, amms []TableAmms, balances []T
 	return dbRecords.String()
 }
 
-func (botdb *BotDB) ImportDbRecords(records DBRecords) {
-	for _, positions := range records.PositionRecords {
-		botdb.DB.Create(&positions)
-	}
-
-	for _, prices := range records.PriceRecords {
-		botdb.DB.Create(&prices)
-	}
-	for _, amms := range records.AmmRecords {
-		botdb.DB.Create(&amms)
-	}
-	for _, balances := range records.BalanceRecords {
-		botdb.DB.Create(&balances)
-	}
-}
-
 // json golang struct tags
 
 // Create a dbrecord to test funcs
@@ -0,0 +1,283 @@
+package fbot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RetentionPolicy: How long a table keeps its raw rows. Older rows are
+// downsampled into table_rollups, one row per pair or denom, column and
+// DownsampleBlocks blocks, then deleted. A DownsampleBlocks of 0 deletes them
+// without a rollup.
+type RetentionPolicy struct {
+	// Table: Short name of the table, one of RetentionTables.
+	Table            string
+	KeepRaw          time.Duration
+	DownsampleBlocks int64
+}
+
+// retentionTable: What Prune needs to know about a table.
+type retentionTable struct {
+	model interface{}
+	name  string
+	// key: Column the rollups are grouped by, with the block bucket.
+	key string
+	// columns: Decimal columns whose numeric shadows are rolled up.
+	columns []string
+	// byTrader: The rows belong to a trader, so they are rolled up per
+	// trader too.
+	byTrader bool
+	// children: Tables whose snapshot_id references the rows. Pruned rows
+	// are detached from their children, which keep their own policy.
+	children []interface{}
+}
+
+var retentionTables = map[string]retentionTable{
+	"prices":    {&TablePrices{}, "table_prices", "pair", []string{"index_price", "mark_price"}, false, nil},
+	"amms":      {&TableAmms{}, "table_amms", "pair", []string{"base_reserve", "quote_reserve", "bias"}, false, nil},
+	"positions": {&TablePosition{}, "table_positions", "pair", []string{"size", "unrealized_pnl"}, true, nil},
+	"balances":  {&TableBalances{}, "table_balances", "denom", []string{"amount"}, true, nil},
+	"snapshots": {&TableSnapshots{}, "table_snapshots", "bot_id", nil, false,
+		[]interface{}{&TablePrices{}, &TableAmms{}, &TablePosition{}, &TableBalances{}}},
+}
+
+// RetentionTables: Tables a RetentionPolicy may name. Trades and position
+// changes are the audit trail and are never pruned.
+var RetentionTables = []string{"prices", "amms", "positions", "balances", "snapshots"}
+
+// PruneResult: What Prune did to one table.
+type PruneResult struct {
+	Table   string
+	Cutoff  time.Time
+	Rollups int64
+	Deleted int64
+}
+
+// ParseRetentionPolicies parses a comma separated list of
+// TABLE=KEEP[:BLOCKS], e.g. "prices=7d:100,snapshots=30d". KEEP is a Go
+// duration or a number of days like "7d".
+func ParseRetentionPolicies(spec string) ([]RetentionPolicy, error) {
+
+	policies := []RetentionPolicy{}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		table, rule, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("Retention policy %q is not TABLE=KEEP[:BLOCKS]", item)
+		}
+		if _, exists := retentionTables[table]; !exists {
+			return nil, fmt.Errorf("Retention policy for unknown table %q, use one of %s",
+				table, strings.Join(RetentionTables, ", "))
+		}
+
+		keep, blocks, hasBlocks := strings.Cut(rule, ":")
+		policy := RetentionPolicy{Table: table}
+
+		var err error
+		if policy.KeepRaw, err = parseRetention(keep); err != nil {
+			return nil, fmt.Errorf("Retention policy %q: %w", item, err)
+		}
+		if hasBlocks {
+			policy.DownsampleBlocks, err = strconv.ParseInt(blocks, 10, 64)
+			if err != nil || policy.DownsampleBlocks < 0 {
+				return nil, fmt.Errorf("Retention policy %q: invalid block count %q", item, blocks)
+			}
+		}
+		if policy.DownsampleBlocks > 0 && retentionTables[table].columns == nil {
+			return nil, fmt.Errorf("Retention policy %q: %s can't be downsampled", item, table)
+		}
+
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+func parseRetention(keep string) (time.Duration, error) {
+	if strings.HasSuffix(keep, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(keep, "d"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", keep)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(keep)
+}
+
+// Prune applies policies to rows created before now minus their KeepRaw.
+// Each table is pruned in its own transaction. Rollup buckets only cover
+// blocks before the first raw row kept, so a bucket is never split between
+// two rollups. The rows of pruned snapshots are kept with a zero
+// snapshot_id, as if written before snapshots existed, see LoadStateAt.
+func (botdb *BotDB) Prune(policies []RetentionPolicy, now time.Time) ([]PruneResult, error) {
+
+	results := []PruneResult{}
+
+	for _, policy := range policies {
+		table, exists := retentionTables[policy.Table]
+		if !exists {
+			return results, fmt.Errorf("Unknown retention table %q", policy.Table)
+		}
+
+		result := PruneResult{Table: table.name, Cutoff: now.Add(-policy.KeepRaw)}
+
+		err := botdb.DB.Transaction(func(tx *gorm.DB) error {
+			boundary, err := pruneBoundary(tx, table, result.Cutoff, policy.DownsampleBlocks)
+			if err != nil {
+				return err
+			}
+
+			old := func(db *gorm.DB) *gorm.DB {
+				db = db.Where("created_at < ?", result.Cutoff)
+				if boundary > 0 {
+					db = db.Where("block_height < ?", boundary)
+				}
+				return db
+			}
+
+			if policy.DownsampleBlocks > 0 {
+				for _, column := range table.columns {
+					rollups, err := rollUp(tx, table, column, policy.DownsampleBlocks, old, now)
+					if err != nil {
+						return err
+					}
+					result.Rollups += rollups
+				}
+			}
+
+			for _, child := range table.children {
+				ids := tx.Unscoped().Model(table.model).Scopes(old).Select("id")
+				err := tx.Unscoped().Model(child).Where("snapshot_id IN (?)", ids).
+					Update("snapshot_id", 0).Error
+				if err != nil {
+					return err
+				}
+			}
+
+			deleted := tx.Unscoped().Scopes(old).Delete(table.model)
+			result.Deleted = deleted.RowsAffected
+			return deleted.Error
+		})
+		if err != nil {
+			return results, fmt.Errorf("Cannot prune %s: %w", table.name, err)
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// pruneBoundary returns the first block that must not be pruned when
+// downsampling by blocks: the start of the bucket of the first row kept, or
+// of the latest row, which may still get rows. It returns 0, meaning no
+// bound, when not downsampling.
+func pruneBoundary(tx *gorm.DB, table retentionTable, cutoff time.Time, blocks int64) (int64, error) {
+
+	if blocks <= 0 {
+		return 0, nil
+	}
+
+	var firstKept, latest int64
+	err := tx.Model(table.model).Where("created_at >= ?", cutoff).
+		Select("COALESCE(MIN(block_height), 0)").Scan(&firstKept).Error
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Model(table.model).
+		Select("COALESCE(MAX(block_height), 0)").Scan(&latest).Error
+	if err != nil {
+		return 0, err
+	}
+
+	boundary := latest
+	if firstKept > 0 && firstKept < latest {
+		boundary = firstKept
+	}
+
+	return boundary / blocks * blocks, nil
+}
+
+// rollUp inserts the rollups of column for the rows matched by old.
+func rollUp(tx *gorm.DB, table retentionTable, column string, blocks int64,
+	old func(*gorm.DB) *gorm.DB, now time.Time) (int64, error) {
+
+	bucket := fmt.Sprintf("(block_height / %d) * %d", blocks, blocks)
+	num := column + "_num"
+	groups := table.key + ", " + bucket
+	trader := "'' AS trader"
+	if table.byTrader {
+		groups += ", trader"
+		trader = "trader"
+	}
+
+	var rollups []TableRollups
+	err := tx.Model(table.model).Scopes(old).Select(
+		fmt.Sprintf("%s AS group_key, %s, %s AS from_block, COUNT(*) AS samples, "+
+			"MIN(%s) AS min_value, MAX(%s) AS max_value, AVG(%s) AS avg_value",
+			table.key, trader, bucket, num, num, num),
+	).Group(groups).Order("group_key, trader, from_block").
+		Scan(&rollups).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range rollups {
+		rollups[i].SourceTable = table.name
+		rollups[i].ColumnName = column
+		rollups[i].ToBlock = rollups[i].FromBlock + blocks - 1
+		rollups[i].CreatedAt = now
+		rollups[i].UpdatedAt = now
+	}
+
+	return int64(len(rollups)), createRows(tx, rollups)
+}
+
+// QueryRollups returns the rollups of the short table name, all if empty,
+// whose blocks overlap the block range of query. A query pair matches the
+// key of pair keyed tables, and a query trader the rollups of positions and
+// balances of that trader.
+func (botdb *BotDB) QueryRollups(table string, query DBQuery) ([]TableRollups, error) {
+
+	db := botdb.DB.Model(&TableRollups{})
+	if table != "" {
+		db = db.Where("source_table = ?", retentionTables[table].name)
+	}
+
+	var rollups []TableRollups
+	err := db.Scopes(query.rollupScope).Find(&rollups).Error
+	return rollups, err
+}
+
+// rollupScope matches the rollups overlapping the block range of query, in
+// the order of QueryRollups.
+func (query DBQuery) rollupScope(db *gorm.DB) *gorm.DB {
+	if query.Pair != "" {
+		db = db.Where("group_key = ?", query.Pair)
+	}
+	if query.Trader != "" {
+		db = db.Where("trader IN ?", []string{"", query.Trader})
+	}
+	if query.FromBlock != 0 {
+		db = db.Where("to_block >= ?", query.FromBlock)
+	}
+	if query.ToBlock != 0 {
+		db = db.Where("from_block <= ?", query.ToBlock)
+	}
+	return db.Order("source_table, group_key, trader, column_name, from_block")
+}
+
+// Vacuum rebuilds the DB file to give the space of pruned rows back to the
+// file system.
+func (botdb *BotDB) Vacuum() error {
+	return botdb.DB.Exec("VACUUM").Error
+}
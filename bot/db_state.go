@@ -0,0 +1,233 @@
+package fbot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/NibiruChain/nibiru/x/common/asset"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"gorm.io/gorm"
+
+	perpTypes "github.com/NibiruChain/nibiru/x/perp/v2/types"
+)
+
+// LoadStateAt rebuilds the BotState the bot of trader saw at its latest
+// snapshot at or before height, from its amms, prices, positions and
+// balances. A DB written before snapshots existed falls back to the rows of
+// the latest block at or before height, table by table, with the positions
+// and balances of trader. trader may be empty if only one trader recorded
+// state. PortfolioBalances.BlockNumber is the block the state was read at.
+//
+// A snapshot whose prices were pruned is an error, not an empty state.
+//
+// Only what the tables store is restored: position margin ratios are nil,
+// AMM SqrtDepth and PriceMultiplier are derived from the reserves and the
+// mark price, and TotalLong and TotalShort are set so that Bias matches.
+func (botdb *BotDB) LoadStateAt(height int64, trader string) (BotState, error) {
+
+	state := BotState{
+		Positions:         make(map[string]PositionFields),
+		Amms:              make(map[string]AmmFields),
+		Prices:            make(map[string]Prices),
+		PortfolioBalances: *InitializePortfolio(),
+	}
+
+	byTrader := DBQuery{Trader: trader}.traderFilter
+	if trader == "" {
+		var traders []string
+		err := botdb.DB.Model(&TableSnapshots{}).Where("block_height <= ?", height).
+			Distinct().Order("trader").Pluck("trader", &traders).Error
+		if err != nil {
+			return state, err
+		}
+		if len(traders) > 1 {
+			return state, fmt.Errorf("Snapshots of several traders (%s) at or before block %d, pick one",
+				strings.Join(traders, ", "), height)
+		}
+	}
+
+	var snapshot TableSnapshots
+	found := botdb.DB.Scopes(byTrader).Where("block_height <= ?", height).
+		Order("block_height DESC, id DESC").Limit(1).Find(&snapshot)
+	if found.Error != nil {
+		return state, found.Error
+	}
+
+	var (
+		prices    []TablePrices
+		amms      []TableAmms
+		positions []TablePosition
+		balances  []TableBalances
+	)
+
+	if found.RowsAffected > 0 {
+		bySnapshot := func(db *gorm.DB) *gorm.DB {
+			return db.Where("snapshot_id = ?", snapshot.ID).Order("id")
+		}
+		if err := botdb.DB.Scopes(bySnapshot).Find(&prices).Error; err != nil {
+			return state, err
+		}
+		if err := botdb.DB.Scopes(bySnapshot).Find(&amms).Error; err != nil {
+			return state, err
+		}
+		if err := botdb.DB.Scopes(bySnapshot).Find(&positions).Error; err != nil {
+			return state, err
+		}
+		if err := botdb.DB.Scopes(bySnapshot).Find(&balances).Error; err != nil {
+			return state, err
+		}
+		if len(prices) == 0 {
+			return state, fmt.Errorf("Snapshot %d at block %d has no prices, were they pruned?",
+				snapshot.ID, snapshot.BlockHeight)
+		}
+		state.PortfolioBalances.BlockNumber = snapshot.BlockHeight
+	} else {
+		var err error
+		blocks := make([]int64, 4)
+		if blocks[0], err = latestBlockAt(botdb.DB, &TablePrices{}, height, &prices); err != nil {
+			return state, err
+		}
+		if blocks[1], err = latestBlockAt(botdb.DB, &TableAmms{}, height, &amms); err != nil {
+			return state, err
+		}
+		db := byTrader(botdb.DB).Session(&gorm.Session{})
+		if blocks[2], err = latestBlockAt(db, &TablePosition{}, height, &positions); err != nil {
+			return state, err
+		}
+		if blocks[3], err = latestBlockAt(db, &TableBalances{}, height, &balances); err != nil {
+			return state, err
+		}
+		for _, block := range blocks {
+			if block > state.PortfolioBalances.BlockNumber {
+				state.PortfolioBalances.BlockNumber = block
+			}
+		}
+
+		traders := make(map[string]bool)
+		for _, row := range positions {
+			traders[row.Trader] = true
+		}
+		for _, row := range balances {
+			traders[row.Trader] = true
+		}
+		if len(traders) > 1 {
+			return state, fmt.Errorf("Positions and balances of several traders at block %d, pick one",
+				state.PortfolioBalances.BlockNumber)
+		}
+	}
+
+	if state.PortfolioBalances.BlockNumber == 0 {
+		return state, fmt.Errorf("No state recorded at or before block %d", height)
+	}
+
+	for _, row := range prices {
+		price, err := PricesFromRow(row)
+		if err != nil {
+			return state, err
+		}
+		state.Prices[row.Pair] = price
+	}
+
+	for _, row := range amms {
+		amm, err := AmmFromRow(row, state.Prices[row.Pair])
+		if err != nil {
+			return state, err
+		}
+		state.Amms[row.Pair] = amm
+	}
+
+	for _, row := range positions {
+		size, err := sdk.NewDecFromStr(row.Size)
+		if err != nil {
+			return state, fmt.Errorf("Position %d: %w", row.ID, err)
+		}
+		unrealizedPnl, err := sdk.NewDecFromStr(row.UnrealizedPnl)
+		if err != nil {
+			return state, fmt.Errorf("Position %d: %w", row.ID, err)
+		}
+		state.Positions[row.Pair] = PositionFields{
+			Positon: perpTypes.Position{
+				TraderAddress: row.Trader,
+				Pair:          asset.Pair(row.Pair),
+				Size_:         size,
+			},
+			UnrealizedPnl: unrealizedPnl,
+		}
+	}
+
+	for _, row := range balances {
+		amount, ok := sdk.NewIntFromString(row.Amount)
+		if !ok {
+			return state, fmt.Errorf("Balance %d: invalid amount %q", row.ID, row.Amount)
+		}
+		state.PortfolioBalances.Balances.WalletCoins = state.PortfolioBalances.Balances.WalletCoins.
+			Add(sdk.NewCoin(row.Denom, amount))
+	}
+
+	return state, nil
+}
+
+// latestBlockAt finds the rows of model at the latest block at or before
+// height and returns that block, or 0 if there is none.
+func latestBlockAt(db *gorm.DB, model interface{}, height int64, rows interface{}) (int64, error) {
+
+	var block int64
+	err := db.Model(model).Where("block_height <= ?", height).
+		Select("COALESCE(MAX(block_height), 0)").Scan(&block).Error
+	if err != nil || block == 0 {
+		return 0, err
+	}
+
+	return block, db.Where("block_height = ?", block).Order("id").Find(rows).Error
+}
+
+// PricesFromRow parses the prices of row.
+func PricesFromRow(row TablePrices) (Prices, error) {
+
+	indexPrice, err := sdk.NewDecFromStr(row.IndexPrice)
+	if err != nil {
+		return Prices{}, fmt.Errorf("Price %d: %w", row.ID, err)
+	}
+	markPrice, err := sdk.NewDecFromStr(row.MarkPrice)
+	if err != nil {
+		return Prices{}, fmt.Errorf("Price %d: %w", row.ID, err)
+	}
+
+	return Prices{IndexPrice: indexPrice, MarkPrice: markPrice}, nil
+}
+
+// AmmFromRow rebuilds the AMM of row with the prices of its block, see
+// LoadStateAt for what is restored.
+func AmmFromRow(row TableAmms, prices Prices) (AmmFields, error) {
+
+	baseReserve, err := sdk.NewDecFromStr(row.BaseReserve)
+	if err != nil {
+		return AmmFields{}, fmt.Errorf("Amm %d: %w", row.ID, err)
+	}
+	quoteReserve, err := sdk.NewDecFromStr(row.QuoteReserve)
+	if err != nil {
+		return AmmFields{}, fmt.Errorf("Amm %d: %w", row.ID, err)
+	}
+	bias, err := sdk.NewDecFromStr(row.Bias)
+	if err != nil {
+		return AmmFields{}, fmt.Errorf("Amm %d: %w", row.ID, err)
+	}
+
+	amm := perpTypes.AMM{
+		Pair:            asset.Pair(row.Pair),
+		BaseReserve:     baseReserve,
+		QuoteReserve:    quoteReserve,
+		SqrtDepth:       sdk.ZeroDec(),
+		PriceMultiplier: sdk.OneDec(),
+		TotalLong:       sdk.MaxDec(bias, sdk.ZeroDec()),
+		TotalShort:      sdk.MaxDec(bias.Neg(), sdk.ZeroDec()),
+	}
+	if amm.SqrtDepth, err = baseReserve.Mul(quoteReserve).ApproxSqrt(); err != nil {
+		return AmmFields{}, fmt.Errorf("Amm %d: %w", row.ID, err)
+	}
+	if !prices.MarkPrice.IsNil() && quoteReserve.IsPositive() {
+		amm.PriceMultiplier = prices.MarkPrice.Mul(baseReserve).Quo(quoteReserve)
+	}
+
+	return AmmFields{Markets: amm, Bias: bias}, nil
+}
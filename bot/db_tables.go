@@ -2,35 +2,108 @@ package fbot
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
 
+	sdk "github.com/cosmos/cosmos-sdk/types"
 	"gorm.io/gorm"
 )
 
+// DBRow is implemented by the table structs to print them as rows, e.g. in
+// CSV. Header names the columns returned by Row.
+type DBRow interface {
+	Header() []string
+	Row() []string
+}
+
+var (
+	_ DBRow = TableAmms{}
+	_ DBRow = TablePrices{}
+	_ DBRow = TablePosition{}
+	_ DBRow = TableBalances{}
+	_ DBRow = TableTrades{}
+	_ DBRow = TablePositionChanges{}
+	_ DBRow = TableSnapshots{}
+	_ DBRow = TableRollups{}
+	_ DBRow = TableBreakerTrips{}
+)
+
+func modelRow(model gorm.Model) []string {
+	return []string{
+		strconv.FormatUint(uint64(model.ID), 10),
+		model.CreatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// numericColumn parses the exact decimal string of a column into its numeric
+// shadow. An empty string is stored as 0.
+func numericColumn(column string, value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	dec, err := sdk.NewDecFromStr(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid decimal in %s: %w", column, err)
+	}
+	return dec.Float64()
+}
+
+// snapshotColumn formats a SnapshotID, empty for rows outside a snapshot.
+func snapshotColumn(snapshotID uint) string {
+	if snapshotID == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(snapshotID), 10)
+}
+
+// timeColumn formats a time as RFC3339, empty if it is unset.
+func timeColumn(at time.Time) string {
+	if at.IsZero() {
+		return ""
+	}
+	return at.UTC().Format(time.RFC3339)
+}
+
 // DB structs
+//
+// Amounts are stored as exact decimal strings. The *Num columns are REAL
+// shadows filled by BeforeSave, so SQL can sort and aggregate them; read the
+// string columns when exact values matter.
 type TableAmms struct {
 	gorm.Model
-	Pair         string
-	BaseReserve  string
-	QuoteReserve string
-	BlockHeight  int64
-	Bias         string
+	Pair            string
+	BaseReserve     string
+	QuoteReserve    string
+	BlockHeight     int64
+	Bias            string
+	SnapshotID      uint    `gorm:"index"`
+	BaseReserveNum  float64 `json:"-"`
+	QuoteReserveNum float64 `json:"-"`
+	BiasNum         float64 `json:"-"`
 }
 
 type TablePrices struct {
 	gorm.Model
-	Pair        string
-	IndexPrice  string
-	MarkPrice   string
-	BlockHeight int64
+	Pair          string
+	IndexPrice    string
+	MarkPrice     string
+	BlockHeight   int64
+	SnapshotID    uint    `gorm:"index"`
+	IndexPriceNum float64 `json:"-"`
+	MarkPriceNum  float64 `json:"-"`
 }
 
 type TablePosition struct {
 	gorm.Model
-	Pair          string
-	UnrealizedPnl string
-	Size          string
-	Trader        string
-	BlockHeight   int64
+	Pair             string
+	UnrealizedPnl    string
+	Size             string
+	Trader           string
+	BlockHeight      int64
+	SnapshotID       uint    `gorm:"index"`
+	UnrealizedPnlNum float64 `json:"-"`
+	SizeNum          float64 `json:"-"`
 }
 
 type TableBalances struct {
@@ -39,6 +112,190 @@ type TableBalances struct {
 	Denom       string
 	Amount      string
 	BlockHeight int64
+	SnapshotID  uint    `gorm:"index"`
+	AmountNum   float64 `json:"-"`
+}
+
+// TableSnapshots: One row per Run iteration. The amms, prices, balances and
+// positions of the iteration reference it by SnapshotID and are written in
+// the same transaction, so a snapshot is either complete or absent. Rows
+// with SnapshotID 0 were written outside a snapshot, e.g. after a trade.
+type TableSnapshots struct {
+	gorm.Model
+	BlockHeight int64 `gorm:"index"`
+	TakenAt     time.Time
+	// BotID: Identifies the bot among those sharing the DB.
+	BotID string `gorm:"index"`
+	// RunID: Identifies the process that took the snapshot.
+	RunID string
+	// Trader: Address of the bot, empty for snapshots taken before it was
+	// recorded.
+	Trader string `gorm:"index"`
+	// Nav: Total NAV in NAV_DENOM, see Portfolio.NAV. Empty for snapshots
+	// taken before it was recorded.
+	Nav    string
+	NavNum float64 `json:"-"`
+}
+
+// TableTrades: Journal of the orders sent by the bot, one row per tx, with the
+// strategy inputs that led to it.
+type TableTrades struct {
+	gorm.Model
+	TxHash      string
+	BlockHeight int64
+	Pair        string
+	Trader      string
+	// Action: TradeAction that sent the order, e.g. close_and_open.
+	Action string
+	// Side: long, short or close.
+	Side        string
+	QuoteAmount string
+	Leverage    string
+	FilledBase  string
+	AvgPrice    string
+	Fee         string
+	GasUsed     int64
+	// Code: Result code of the tx, 0 on success.
+	Code   uint32
+	RawLog string
+	// Error: Error returned while sending the order, if any.
+	Error string
+
+	// Strategy inputs, see CurrPosStats.
+	QuoteToMove     string
+	MarkPrice       string
+	IndexPrice      string
+	PositionSize    string
+	MarketDelta     string
+	UnrealizedPnl   string
+	IsAgainstMarket bool
+}
+
+// TablePositionChanges: Perp PositionChangedEvents of the bot's trader, the
+// source of realized, funding and fee PnL. A change is identified by its
+// block, tx hash (empty for block events), source and event index.
+type TablePositionChanges struct {
+	gorm.Model
+	BlockHeight int64 `gorm:"uniqueIndex:idx_position_change"`
+	// BlockTime: Time of the block, unlike CreatedAt, the time the change
+	// was recorded, which may be much later for changes synced after
+	// downtime. Zero if the block couldn't be fetched.
+	BlockTime        time.Time
+	TxHash           string `gorm:"uniqueIndex:idx_position_change"`
+	Source           string `gorm:"uniqueIndex:idx_position_change"`
+	EventIndex       int    `gorm:"uniqueIndex:idx_position_change"`
+	Pair             string
+	Trader           string
+	ChangeReason     string
+	Size             string
+	PositionNotional string
+	RealizedPnl      string
+	// FundingPayment: Positive if the trader paid funding.
+	FundingPayment    string
+	Fee               string
+	FeeDenom          string
+	BadDebt           string
+	MarginToUser      string
+	RealizedPnlNum    float64 `json:"-"`
+	FundingPaymentNum float64 `json:"-"`
+	FeeNum            float64 `json:"-"`
+}
+
+// TableSyncState: How far SyncPositionChanges scanned the blocks for the
+// position changes of a trader, so a restarted bot resumes from there.
+type TableSyncState struct {
+	Trader             string `gorm:"primaryKey"`
+	EventsSyncedHeight int64
+	UpdatedAt          time.Time
+}
+
+func (TableSyncState) TableName() string {
+	return "table_sync_state"
+}
+
+// TableRollups: Min, max and average of one column of a pruned table, for one
+// GroupKey (pair or denom) over the blocks FromBlock to ToBlock.
+type TableRollups struct {
+	gorm.Model
+	SourceTable string `gorm:"index:idx_rollup_source"`
+	GroupKey    string `gorm:"index:idx_rollup_source"`
+	// Trader: Trader of the rolled up rows of positions and balances, empty
+	// for market data.
+	Trader     string
+	ColumnName string
+	FromBlock  int64 `gorm:"index:idx_rollup_source"`
+	ToBlock    int64
+	Samples    int64
+	MinValue   float64
+	MaxValue   float64
+	AvgValue   float64
+}
+
+// TableBreakerTrips: A circuit breaker that tripped, with what it saw and
+// how the bot responded, see CircuitBreaker.
+type TableBreakerTrips struct {
+	gorm.Model
+	BlockHeight int64 `gorm:"index"`
+	BotID       string
+	// Breaker: Name of the breaker, e.g. drawdown.
+	Breaker string
+	// Pair: Pair the breaker tripped on, empty for account wide breakers.
+	Pair      string
+	Value     string
+	Threshold string
+	// Response: pause, flatten or halt.
+	Response string
+	Reason   string
+}
+
+// BeforeSave hooks fill the numeric shadow columns.
+
+func (amms *TableAmms) BeforeSave(tx *gorm.DB) (err error) {
+	if amms.BaseReserveNum, err = numericColumn("base_reserve", amms.BaseReserve); err != nil {
+		return err
+	}
+	if amms.QuoteReserveNum, err = numericColumn("quote_reserve", amms.QuoteReserve); err != nil {
+		return err
+	}
+	amms.BiasNum, err = numericColumn("bias", amms.Bias)
+	return err
+}
+
+func (prices *TablePrices) BeforeSave(tx *gorm.DB) (err error) {
+	if prices.IndexPriceNum, err = numericColumn("index_price", prices.IndexPrice); err != nil {
+		return err
+	}
+	prices.MarkPriceNum, err = numericColumn("mark_price", prices.MarkPrice)
+	return err
+}
+
+func (position *TablePosition) BeforeSave(tx *gorm.DB) (err error) {
+	if position.UnrealizedPnlNum, err = numericColumn("unrealized_pnl", position.UnrealizedPnl); err != nil {
+		return err
+	}
+	position.SizeNum, err = numericColumn("size", position.Size)
+	return err
+}
+
+func (change *TablePositionChanges) BeforeSave(tx *gorm.DB) (err error) {
+	if change.RealizedPnlNum, err = numericColumn("realized_pnl", change.RealizedPnl); err != nil {
+		return err
+	}
+	if change.FundingPaymentNum, err = numericColumn("funding_payment", change.FundingPayment); err != nil {
+		return err
+	}
+	change.FeeNum, err = numericColumn("fee", change.Fee)
+	return err
+}
+
+func (snapshot *TableSnapshots) BeforeSave(tx *gorm.DB) (err error) {
+	snapshot.NavNum, err = numericColumn("nav", snapshot.Nav)
+	return err
+}
+
+func (balances *TableBalances) BeforeSave(tx *gorm.DB) (err error) {
+	balances.AmountNum, err = numericColumn("amount", balances.Amount)
+	return err
 }
 
 func (prices TablePrices) String() string {
@@ -56,7 +313,132 @@ func (amms TableAmms) String() string {
 	return string(bz)
 }
 
+func (snapshot TableSnapshots) String() string {
+	bz, _ := json.Marshal(snapshot)
+	return string(bz)
+}
+
+func (trades TableTrades) String() string {
+	bz, _ := json.Marshal(trades)
+	return string(bz)
+}
+
+func (change TablePositionChanges) String() string {
+	bz, _ := json.Marshal(change)
+	return string(bz)
+}
+
 func (balances TableBalances) String() string {
 	bz, _ := json.Marshal(balances)
 	return string(bz)
 }
+
+func (TablePrices) Header() []string {
+	return []string{"id", "created_at", "block_height", "pair", "index_price", "mark_price", "snapshot_id"}
+}
+
+func (prices TablePrices) Row() []string {
+	return append(modelRow(prices.Model),
+		strconv.FormatInt(prices.BlockHeight, 10), prices.Pair,
+		prices.IndexPrice, prices.MarkPrice, snapshotColumn(prices.SnapshotID))
+}
+
+func (TablePosition) Header() []string {
+	return []string{"id", "created_at", "block_height", "pair", "trader", "size", "unrealized_pnl", "snapshot_id"}
+}
+
+func (position TablePosition) Row() []string {
+	return append(modelRow(position.Model),
+		strconv.FormatInt(position.BlockHeight, 10), position.Pair,
+		position.Trader, position.Size, position.UnrealizedPnl,
+		snapshotColumn(position.SnapshotID))
+}
+
+func (TableAmms) Header() []string {
+	return []string{"id", "created_at", "block_height", "pair", "base_reserve", "quote_reserve", "bias", "snapshot_id"}
+}
+
+func (amms TableAmms) Row() []string {
+	return append(modelRow(amms.Model),
+		strconv.FormatInt(amms.BlockHeight, 10), amms.Pair,
+		amms.BaseReserve, amms.QuoteReserve, amms.Bias, snapshotColumn(amms.SnapshotID))
+}
+
+func (TableBalances) Header() []string {
+	return []string{"id", "created_at", "block_height", "trader", "denom", "amount", "snapshot_id"}
+}
+
+func (balances TableBalances) Row() []string {
+	return append(modelRow(balances.Model),
+		strconv.FormatInt(balances.BlockHeight, 10), balances.Trader,
+		balances.Denom, balances.Amount, snapshotColumn(balances.SnapshotID))
+}
+
+func (TableTrades) Header() []string {
+	return []string{"id", "created_at", "block_height", "tx_hash", "pair", "trader", "action", "side",
+		"quote_amount", "leverage", "filled_base", "avg_price", "fee", "code", "gas_used",
+		"raw_log", "error", "quote_to_move", "mark_price", "index_price", "position_size", "market_delta",
+		"unrealized_pnl", "is_against_market"}
+}
+
+func (trades TableTrades) Row() []string {
+	return append(modelRow(trades.Model),
+		strconv.FormatInt(trades.BlockHeight, 10), trades.TxHash, trades.Pair,
+		trades.Trader, trades.Action, trades.Side, trades.QuoteAmount, trades.Leverage,
+		trades.FilledBase, trades.AvgPrice, trades.Fee,
+		strconv.FormatUint(uint64(trades.Code), 10),
+		strconv.FormatInt(trades.GasUsed, 10), trades.RawLog, trades.Error,
+		trades.QuoteToMove, trades.MarkPrice, trades.IndexPrice,
+		trades.PositionSize, trades.MarketDelta, trades.UnrealizedPnl,
+		strconv.FormatBool(trades.IsAgainstMarket))
+}
+
+func (TablePositionChanges) Header() []string {
+	return []string{"id", "created_at", "block_height", "block_time", "tx_hash", "source", "pair",
+		"trader", "change_reason", "size", "position_notional", "realized_pnl",
+		"funding_payment", "fee", "fee_denom", "bad_debt", "margin_to_user"}
+}
+
+func (change TablePositionChanges) Row() []string {
+	return append(modelRow(change.Model),
+		strconv.FormatInt(change.BlockHeight, 10), timeColumn(change.BlockTime),
+		change.TxHash, change.Source, change.Pair, change.Trader, change.ChangeReason, change.Size,
+		change.PositionNotional, change.RealizedPnl, change.FundingPayment,
+		change.Fee, change.FeeDenom, change.BadDebt, change.MarginToUser)
+}
+
+func (TableSnapshots) Header() []string {
+	return []string{"id", "created_at", "block_height", "taken_at", "bot_id", "run_id", "trader", "nav"}
+}
+
+func (snapshot TableSnapshots) Row() []string {
+	return append(modelRow(snapshot.Model),
+		strconv.FormatInt(snapshot.BlockHeight, 10),
+		snapshot.TakenAt.UTC().Format(time.RFC3339), snapshot.BotID, snapshot.RunID,
+		snapshot.Trader, snapshot.Nav)
+}
+
+func (TableBreakerTrips) Header() []string {
+	return []string{"id", "created_at", "block_height", "bot_id", "breaker", "pair",
+		"value", "threshold", "response", "reason"}
+}
+
+func (trip TableBreakerTrips) Row() []string {
+	return append(modelRow(trip.Model),
+		strconv.FormatInt(trip.BlockHeight, 10), trip.BotID, trip.Breaker, trip.Pair,
+		trip.Value, trip.Threshold, trip.Response, trip.Reason)
+}
+
+func (TableRollups) Header() []string {
+	return []string{"id", "created_at", "source_table", "group_key", "trader", "column_name",
+		"from_block", "to_block", "samples", "min_value", "max_value", "avg_value"}
+}
+
+func (rollup TableRollups) Row() []string {
+	return append(modelRow(rollup.Model), rollup.SourceTable, rollup.GroupKey,
+		rollup.Trader, rollup.ColumnName, strconv.FormatInt(rollup.FromBlock, 10),
+		strconv.FormatInt(rollup.ToBlock, 10), strconv.FormatInt(rollup.Samples, 10),
+		strconv.FormatFloat(rollup.MinValue, 'f', -1, 64),
+		strconv.FormatFloat(rollup.MaxValue, 'f', -1, 64),
+		strconv.FormatFloat(rollup.AvgValue, 'f', -1, 64))
+}
@@ -0,0 +1,97 @@
+package fbot
+
+import (
+	abci "github.com/cometbft/cometbft/abci/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/gogoproto/proto"
+
+	perpTypes "github.com/NibiruChain/nibiru/x/perp/v2/types"
+)
+
+// TradeFill: What a market order or close actually exchanged, read from the
+// msg responses and events of its tx.
+type TradeFill struct {
+	// FilledBase: Signed base amount exchanged, positive when buying.
+	FilledBase sdk.Dec
+	// Notional: Signed quote value of FilledBase.
+	Notional sdk.Dec
+	// Fee: Exchange fees charged by the perp module.
+	Fee sdk.Coins
+}
+
+// AvgPrice: Average price of the fill, zero if nothing was filled.
+func (fill TradeFill) AvgPrice() sdk.Dec {
+	if fill.FilledBase.IsNil() || fill.FilledBase.IsZero() || fill.Notional.IsNil() {
+		return sdk.ZeroDec()
+	}
+	return fill.Notional.Abs().Quo(fill.FilledBase.Abs())
+}
+
+// ParseTradeFill reads the fill of the perp msgs in a delivered tx.
+func ParseTradeFill(txResult abci.ResponseDeliverTx) (TradeFill, error) {
+
+	fill := TradeFill{
+		FilledBase: sdk.ZeroDec(),
+		Notional:   sdk.ZeroDec(),
+		Fee:        sdk.NewCoins(),
+	}
+
+	var msgData sdk.TxMsgData
+	if err := proto.Unmarshal(txResult.Data, &msgData); err != nil {
+		return fill, err
+	}
+
+	for _, msgResp := range msgData.MsgResponses {
+		switch msgResp.TypeUrl {
+		case "/" + proto.MessageName(&perpTypes.MsgMarketOrderResponse{}):
+			var resp perpTypes.MsgMarketOrderResponse
+			if err := proto.Unmarshal(msgResp.Value, &resp); err != nil {
+				return fill, err
+			}
+			fill.FilledBase = fill.FilledBase.Add(resp.ExchangedPositionSize)
+			fill.Notional = fill.Notional.Add(resp.ExchangedNotionalValue)
+		case "/" + proto.MessageName(&perpTypes.MsgClosePositionResponse{}):
+			var resp perpTypes.MsgClosePositionResponse
+			if err := proto.Unmarshal(msgResp.Value, &resp); err != nil {
+				return fill, err
+			}
+			fill.FilledBase = fill.FilledBase.Add(resp.ExchangedPositionSize)
+			fill.Notional = fill.Notional.Add(resp.ExchangedNotionalValue)
+		}
+	}
+
+	changes, err := ParsePositionChangedEvents(txResult.Events)
+	if err != nil {
+		return fill, err
+	}
+	for _, change := range changes {
+		if change.TransactionFee.IsPositive() {
+			fill.Fee = fill.Fee.Add(change.TransactionFee)
+		}
+	}
+
+	return fill, nil
+}
+
+// ParsePositionChangedEvents returns the perp PositionChangedEvents among
+// events, in order.
+func ParsePositionChangedEvents(events []abci.Event) ([]perpTypes.PositionChangedEvent, error) {
+
+	eventType := proto.MessageName(&perpTypes.PositionChangedEvent{})
+	changes := []perpTypes.PositionChangedEvent{}
+
+	for _, event := range events {
+		if event.Type != eventType {
+			continue
+		}
+		msg, err := sdk.ParseTypedEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		if change, ok := msg.(*perpTypes.PositionChangedEvent); ok {
+			changes = append(changes, *change)
+		}
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,272 @@
+package fbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// Exit triggers, see ExitRule.
+const (
+	EXIT_STOP_LOSS     = "stop_loss"
+	EXIT_TAKE_PROFIT   = "take_profit"
+	EXIT_TRAILING_STOP = "trailing_stop"
+)
+
+// ExitTriggers: Triggers an ExitRule may set.
+var ExitTriggers = []string{EXIT_STOP_LOSS, EXIT_TAKE_PROFIT, EXIT_TRAILING_STOP}
+
+// EXIT_ALL_PAIRS: Pair of the ExitRule used by pairs without their own.
+const EXIT_ALL_PAIRS = "*"
+
+// ExitLevel: An amount of unrealized PnL, in quote units or in percent of
+// the position's margin. A nil Value is unset.
+type ExitLevel struct {
+	Value   sdk.Dec
+	Percent bool
+}
+
+// IsSet is false for a level the rule doesn't use.
+func (level ExitLevel) IsSet() bool {
+	return isSet(level.Value)
+}
+
+// Amount returns the level in quote units for a position with margin.
+func (level ExitLevel) Amount(margin sdk.Dec) sdk.Dec {
+	if !level.Percent {
+		return level.Value
+	}
+	if margin.IsNil() {
+		return sdk.ZeroDec()
+	}
+	return margin.Abs().Mul(level.Value).QuoInt64(100)
+}
+
+func (level ExitLevel) String() string {
+	if level.Percent {
+		return level.Value.String() + "%"
+	}
+	return level.Value.String()
+}
+
+// ExitRule: When to close the position of Pair regardless of the funding
+// strategy. The stop loss closes it once its unrealized PnL falls to minus
+// StopLoss, the take profit once it reaches TakeProfit, and the trailing
+// stop once it falls TrailingStop below the best PnL seen since the position
+// was opened or resized.
+type ExitRule struct {
+	Pair         string
+	StopLoss     ExitLevel
+	TakeProfit   ExitLevel
+	TrailingStop ExitLevel
+}
+
+// ExitRules: ExitRule by pair, EXIT_ALL_PAIRS for the default.
+type ExitRules map[string]ExitRule
+
+// For returns the rule of pair, or the default, and whether there is one.
+func (rules ExitRules) For(pair string) (ExitRule, bool) {
+	if rule, exists := rules[pair]; exists {
+		return rule, true
+	}
+	rule, exists := rules[EXIT_ALL_PAIRS]
+	return rule, exists
+}
+
+// ParseExitRules parses a comma separated list of PAIR/TRIGGER=LEVEL, e.g.
+// "ubtc:unusd/stop_loss=20%,*/take_profit=500". TRIGGER is one of
+// ExitTriggers, LEVEL an amount in quote units or a percent of margin, and
+// PAIR "*" sets the default of every pair. A pair's rule replaces the
+// default as a whole.
+func ParseExitRules(spec string) (ExitRules, error) {
+
+	rules := ExitRules{}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(item, "=")
+		pair, trigger, hasTrigger := strings.Cut(key, "/")
+		if !found || !hasTrigger || pair == "" {
+			return nil, fmt.Errorf("Exit rule %q is not PAIR/TRIGGER=LEVEL", item)
+		}
+
+		level := ExitLevel{}
+		if strings.HasSuffix(value, "%") {
+			level.Percent = true
+			value = strings.TrimSuffix(value, "%")
+		}
+		var err error
+		if level.Value, err = sdk.NewDecFromStr(value); err != nil || !level.Value.IsPositive() {
+			return nil, fmt.Errorf("Exit rule %q: invalid level %q", item, value)
+		}
+
+		rule := rules[pair]
+		rule.Pair = pair
+		switch trigger {
+		case EXIT_STOP_LOSS:
+			rule.StopLoss = level
+		case EXIT_TAKE_PROFIT:
+			rule.TakeProfit = level
+		case EXIT_TRAILING_STOP:
+			rule.TrailingStop = level
+		default:
+			return nil, fmt.Errorf("Exit rule %q: trigger must be one of %s",
+				item, strings.Join(ExitTriggers, ", "))
+		}
+		rules[pair] = rule
+	}
+
+	return rules, nil
+}
+
+// PnlPeak: Best unrealized PnL of a position of Size, for trailing stops.
+type PnlPeak struct {
+	Size sdk.Dec
+	Peak sdk.Dec
+}
+
+// ExitSignal: An exit rule that triggered on a position.
+type ExitSignal struct {
+	Pair string
+	// Trigger: One of ExitTriggers.
+	Trigger       string
+	UnrealizedPnl sdk.Dec
+	// Level: The rule's level in quote units, relative to Peak for trailing
+	// stops.
+	Level sdk.Dec
+	Peak  sdk.Dec
+}
+
+func (signal ExitSignal) String() string {
+	if signal.Trigger == EXIT_TRAILING_STOP {
+		return fmt.Sprintf("%s %s: unrealized PnL %s is %s or more below its peak %s",
+			signal.Trigger, signal.Pair, signal.UnrealizedPnl, signal.Level, signal.Peak)
+	}
+	return fmt.Sprintf("%s %s: unrealized PnL %s, level %s",
+		signal.Trigger, signal.Pair, signal.UnrealizedPnl, signal.Level)
+}
+
+// EvaluateExit checks position against rule, with the peak PnL of the
+// position for the trailing stop, and returns the exit to take, if any.
+// The stop loss is checked first.
+func EvaluateExit(pair string, rule ExitRule, position PositionFields, peak sdk.Dec) *ExitSignal {
+
+	pnl := position.UnrealizedPnl
+	size := position.Positon.Size_
+	if pnl.IsNil() || size.IsNil() || size.IsZero() {
+		return nil
+	}
+	margin := position.Positon.Margin
+
+	if rule.StopLoss.IsSet() {
+		if level := rule.StopLoss.Amount(margin); pnl.LTE(level.Neg()) {
+			return &ExitSignal{Pair: pair, Trigger: EXIT_STOP_LOSS, UnrealizedPnl: pnl, Level: level.Neg()}
+		}
+	}
+	if rule.TakeProfit.IsSet() {
+		if level := rule.TakeProfit.Amount(margin); pnl.GTE(level) {
+			return &ExitSignal{Pair: pair, Trigger: EXIT_TAKE_PROFIT, UnrealizedPnl: pnl, Level: level}
+		}
+	}
+	if rule.TrailingStop.IsSet() && !peak.IsNil() {
+		if level := rule.TrailingStop.Amount(margin); peak.Sub(pnl).GTE(level) {
+			return &ExitSignal{Pair: pair, Trigger: EXIT_TRAILING_STOP, UnrealizedPnl: pnl,
+				Level: level, Peak: peak}
+		}
+	}
+
+	return nil
+}
+
+// UpdatePnlPeaks records the best unrealized PnL of each position, starting
+// over when its size changes, and forgets closed positions.
+func (bot *Bot) UpdatePnlPeaks() {
+
+	if bot.State.PnlPeaks == nil {
+		bot.State.PnlPeaks = make(map[string]PnlPeak)
+	}
+
+	for pair := range bot.State.PnlPeaks {
+		if _, exists := bot.State.Positions[pair]; !exists {
+			delete(bot.State.PnlPeaks, pair)
+		}
+	}
+
+	for pair, position := range bot.State.Positions {
+		size, pnl := position.Positon.Size_, position.UnrealizedPnl
+		if size.IsNil() || pnl.IsNil() {
+			continue
+		}
+		peak, exists := bot.State.PnlPeaks[pair]
+		if !exists || !peak.Size.Equal(size) {
+			peak = PnlPeak{Size: size, Peak: pnl}
+		}
+		if pnl.GT(peak.Peak) {
+			peak.Peak = pnl
+		}
+		bot.State.PnlPeaks[pair] = peak
+	}
+}
+
+// CheckExits evaluates the bot's ExitRules on every position and closes
+// those that trigger, logging and journaling each exit with its trigger.
+// It returns the exits taken, with the last error of a close, if any.
+func (bot *Bot) CheckExits(ctx context.Context, trader sdk.AccAddress) ([]ExitSignal, error) {
+
+	bot.UpdatePnlPeaks()
+
+	pairs := make([]string, 0, len(bot.State.Positions))
+	for pair := range bot.State.Positions {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+
+	signals := []ExitSignal{}
+	var lastErr error
+
+	for _, pair := range pairs {
+		rule, exists := bot.ExitRules.For(pair)
+		if !exists {
+			continue
+		}
+		signal := EvaluateExit(pair, rule, bot.State.Positions[pair], bot.State.PnlPeaks[pair].Peak)
+		if signal == nil {
+			continue
+		}
+
+		log.Printf("Exit by %s", signal)
+		signals = append(signals, *signal)
+
+		order := TradeOrder{
+			Pair:   pair,
+			Action: ExitActions[signal.Trigger],
+			Inputs: bot.PopulateCurrPosStats(pair),
+		}
+		if _, err := bot.ExecuteTrade(order, trader, ctx); err != nil {
+			lastErr = fmt.Errorf("Cannot close %s on %s: %w", pair, signal.Trigger, err)
+			log.Print(lastErr)
+			continue
+		}
+
+		if traded, exists := bot.State.PortfolioBalances.Balances.TradedBalances[pair]; exists {
+			bot.State.PortfolioBalances.Balances.RemoveTradedBalances(pair, traded)
+		}
+	}
+
+	return signals, lastErr
+}
+
+// ExitActions: TradeAction journaled for the exits of each trigger.
+var ExitActions = map[string]TradeAction{
+	EXIT_STOP_LOSS:     StopLossExit,
+	EXIT_TAKE_PROFIT:   TakeProfitExit,
+	EXIT_TRAILING_STOP: TrailingStopExit,
+}
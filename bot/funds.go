@@ -0,0 +1,124 @@
+package fbot
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/NibiruChain/nibiru/x/common/asset"
+	perpTypes "github.com/NibiruChain/nibiru/x/perp/v2/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// TX_FEE: Fee gonibi attaches to every tx the bot broadcasts, whatever gas it
+// uses, paid in the bond denom.
+var TX_FEE = sdk.NewInt64Coin("unibi", 1000)
+
+// FundsCheck: What the wallet allows of an order opening a position.
+type FundsCheck struct {
+	Pair string
+	// Requested and Allowed are signed quote amounts, longs positive.
+	// Allowed is zero if the order is skipped.
+	Requested sdk.Int
+	Allowed   sdk.Int
+	// Required: Margin, trading fees and tx fees of the requested order.
+	Required sdk.Coins
+	// Reason: Why the order was cut down or skipped, empty if it wasn't.
+	Reason string
+}
+
+// Skipped is true if none of the order may be sent.
+func (check FundsCheck) Skipped() bool {
+	return check.Allowed.IsZero()
+}
+
+// Downsized is true if the order was cut down or skipped.
+func (check FundsCheck) Downsized() bool {
+	return check.Reason != ""
+}
+
+// TradingFeeRatio returns the fraction of the notional market charges on
+// every fill, paid from the wallet in the quote denom.
+func TradingFeeRatio(market perpTypes.Market) sdk.Dec {
+	ratio := sdk.ZeroDec()
+	if !market.ExchangeFeeRatio.IsNil() {
+		ratio = ratio.Add(market.ExchangeFeeRatio)
+	}
+	if !market.EcosystemFundFeeRatio.IsNil() {
+		ratio = ratio.Add(market.EcosystemFundFeeRatio)
+	}
+	return ratio
+}
+
+// CheckFunds checks an order opening quoteAmount at leverage in pair against
+// the coins in wallet. The order is sent in txs txs, each paying TX_FEE,
+// and released quote coins, e.g. the margin of a position closed first, are
+// counted as available. The order is cut down to the margin the wallet can
+// pay with its trading fees, or skipped if the wallet can't pay the tx fees.
+func CheckFunds(pair string, quoteAmount sdk.Int, leverage sdk.Dec, market perpTypes.Market,
+	wallet sdk.Coins, txs int, released sdk.Int) FundsCheck {
+
+	check := FundsCheck{Pair: pair, Requested: quoteAmount, Allowed: quoteAmount}
+	if quoteAmount.IsZero() {
+		return check
+	}
+
+	denom := asset.Pair(pair).QuoteDenom()
+	feeRatio := TradingFeeRatio(market)
+	txFees := sdk.NewCoin(TX_FEE.Denom, TX_FEE.Amount.MulRaw(int64(txs)))
+
+	margin := quoteAmount.Abs()
+	tradingFee := sdk.NewDecFromInt(margin).Mul(leverage).Mul(feeRatio).Ceil().TruncateInt()
+	check.Required = sdk.NewCoins(sdk.NewCoin(denom, margin.Add(tradingFee)), txFees)
+
+	if available := wallet.AmountOf(TX_FEE.Denom); available.LT(txFees.Amount) {
+		check.Allowed = sdk.ZeroInt()
+		check.Reason = fmt.Sprintf("wallet holds %s%s, tx fees need %s",
+			available, TX_FEE.Denom, txFees)
+		return check
+	}
+
+	available := wallet.AmountOf(denom)
+	if !released.IsNil() && released.IsPositive() {
+		available = available.Add(released)
+	}
+	if denom == TX_FEE.Denom {
+		available = available.Sub(txFees.Amount)
+	}
+
+	needed := margin.Add(tradingFee)
+	if available.GTE(needed) {
+		return check
+	}
+
+	affordable := sdk.ZeroInt()
+	if available.IsPositive() {
+		affordable = sdk.NewDecFromInt(available).
+			Quo(sdk.OneDec().Add(leverage.Mul(feeRatio))).TruncateInt()
+	}
+	check.Reason = fmt.Sprintf("wallet holds %s%s, order needs %s%s",
+		available, denom, needed, denom)
+	if quoteAmount.IsNegative() {
+		affordable = affordable.Neg()
+	}
+	check.Allowed = affordable
+
+	return check
+}
+
+// WarnLowGas logs a warning if the wallet holds less than minBalance of the
+// tx fee denom, and reports whether it did. A zero minBalance never warns.
+func (bot *Bot) WarnLowGas(minBalance sdk.Int) bool {
+
+	if minBalance.IsNil() || !minBalance.IsPositive() {
+		return false
+	}
+
+	balance := bot.State.PortfolioBalances.Balances.WalletCoins.AmountOf(TX_FEE.Denom)
+	if balance.GTE(minBalance) {
+		return false
+	}
+
+	log.Printf("Warning: wallet holds %s%s, below %s%s, enough for %s more txs",
+		balance, TX_FEE.Denom, minBalance, TX_FEE.Denom, balance.Quo(TX_FEE.Amount))
+	return true
+}
@@ -0,0 +1,272 @@
+package fbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/NibiruChain/nibiru/x/common/asset"
+	perpKeeper "github.com/NibiruChain/nibiru/x/perp/v2/keeper"
+	perpTypes "github.com/NibiruChain/nibiru/x/perp/v2/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// MarginPolicy: Margin ratios ManageMargin keeps positions between. A
+// position whose margin ratio falls below MinRatio is topped up from the
+// wallet to TargetRatio, one above MaxRatio has margin removed down to
+// TargetRatio. A zero MinRatio or MaxRatio disables that side.
+type MarginPolicy struct {
+	MinRatio    sdk.Dec
+	TargetRatio sdk.Dec
+	MaxRatio    sdk.Dec
+}
+
+// Enabled is false if the policy neither adds nor removes margin.
+func (policy MarginPolicy) Enabled() bool {
+	return isSet(policy.MinRatio) || isSet(policy.MaxRatio)
+}
+
+// Validate checks that 0 < MinRatio < TargetRatio < MaxRatio, leaving out
+// the disabled sides.
+func (policy MarginPolicy) Validate() error {
+
+	if !policy.Enabled() {
+		return nil
+	}
+	if !isSet(policy.TargetRatio) {
+		return fmt.Errorf("Margin target ratio is required with a min or max ratio")
+	}
+	if isSet(policy.MinRatio) && !policy.MinRatio.LT(policy.TargetRatio) {
+		return fmt.Errorf("Margin min ratio %s must be below the target ratio %s",
+			policy.MinRatio, policy.TargetRatio)
+	}
+	if isSet(policy.MaxRatio) && !policy.TargetRatio.LT(policy.MaxRatio) {
+		return fmt.Errorf("Margin target ratio %s must be below the max ratio %s",
+			policy.TargetRatio, policy.MaxRatio)
+	}
+
+	return nil
+}
+
+func isSet(value sdk.Dec) bool {
+	return !value.IsNil() && value.IsPositive()
+}
+
+// Margin actions of a MarginCheck.
+const (
+	MARGIN_OK     = "ok"
+	MARGIN_ADD    = "add"
+	MARGIN_REMOVE = "remove"
+)
+
+// MarginCheck: Where a position stands against its market's maintenance
+// margin and what ManageMargin does about it.
+type MarginCheck struct {
+	Pair                   string
+	MarginRatio            sdk.Dec
+	MaintenanceMarginRatio sdk.Dec
+	// Distance: MarginRatio minus MaintenanceMarginRatio, the position is
+	// liquidated when it reaches zero.
+	Distance sdk.Dec
+	// Action: MARGIN_OK, MARGIN_ADD or MARGIN_REMOVE.
+	Action string
+	// Amount: Margin to add or remove, in the quote denom.
+	Amount sdk.Coin
+	// Reason: Why an add or remove was cut down or skipped, if it was.
+	Reason string
+}
+
+// MARGIN_REMOVE_HEADROOM: Margin ratio kept above the maintenance margin
+// ratio when a removal's target ratio is below it.
+var MARGIN_REMOVE_HEADROOM = sdk.MustNewDecFromStr("0.01")
+
+// FreeCollateral returns the margin the chain lets position remove: its
+// margin less the funding it owes and any unrealized loss, see
+// perpKeeper.RemoveMargin. It returns a nil Dec if position is incomplete.
+func FreeCollateral(position PositionFields, market perpTypes.Market) sdk.Dec {
+	pos := position.Positon
+	if pos.Margin.IsNil() || pos.OpenNotional.IsNil() || pos.Size_.IsNil() ||
+		pos.LatestCumulativePremiumFraction.IsNil() || position.PositionNotional.IsNil() ||
+		market.LatestCumulativePremiumFraction.IsNil() {
+		return sdk.Dec{}
+	}
+	free := pos.Margin.Sub(perpKeeper.FundingPayment(pos, market.LatestCumulativePremiumFraction))
+	if pnl := perpKeeper.UnrealizedPnl(pos, position.PositionNotional.Abs()); pnl.IsNegative() {
+		free = free.Add(pnl)
+	}
+	return free
+}
+
+// PositionMarginRatio returns the margin ratio of position with the funding
+// it owes at market's latest premium fraction. It falls back to the margin
+// ratio queried with the position if its notional is unknown.
+func PositionMarginRatio(position PositionFields, market perpTypes.Market) sdk.Dec {
+	if position.PositionNotional.IsNil() || market.LatestCumulativePremiumFraction.IsNil() ||
+		position.Positon.Margin.IsNil() || position.Positon.OpenNotional.IsNil() {
+		return position.MarginRatio
+	}
+	return perpKeeper.MarginRatio(position.Positon, position.PositionNotional,
+		market.LatestCumulativePremiumFraction)
+}
+
+// EvaluateMargin checks position against market and policy. Top-ups are
+// capped by the quote coins in wallet. Removals stay MARGIN_REMOVE_HEADROOM
+// above the maintenance margin ratio and are capped by the position's
+// FreeCollateral, as unrealized profits count in the margin ratio but can't
+// be removed.
+func EvaluateMargin(pair string, position PositionFields, market perpTypes.Market,
+	policy MarginPolicy, wallet sdk.Coins) MarginCheck {
+
+	denom := asset.Pair(pair).QuoteDenom()
+	check := MarginCheck{
+		Pair:                   pair,
+		MarginRatio:            PositionMarginRatio(position, market),
+		MaintenanceMarginRatio: market.MaintenanceMarginRatio,
+		Action:                 MARGIN_OK,
+		Amount:                 sdk.NewCoin(denom, sdk.ZeroInt()),
+	}
+	if check.MarginRatio.IsNil() || check.MaintenanceMarginRatio.IsNil() {
+		check.Reason = "margin ratio unknown"
+		return check
+	}
+	check.Distance = check.MarginRatio.Sub(check.MaintenanceMarginRatio)
+
+	notional := position.PositionNotional
+	if notional.IsNil() || notional.IsZero() {
+		return check
+	}
+	notional = notional.Abs()
+
+	switch {
+	case isSet(policy.MinRatio) && check.MarginRatio.LT(policy.MinRatio):
+		check.Action = MARGIN_ADD
+		amount := policy.TargetRatio.Sub(check.MarginRatio).Mul(notional).Ceil().TruncateInt()
+		if available := wallet.AmountOf(denom); available.LT(amount) {
+			amount = available
+			check.Reason = fmt.Sprintf("wallet holds only %s%s", available, denom)
+		}
+		check.Amount.Amount = amount
+
+	case isSet(policy.MaxRatio) && check.MarginRatio.GT(policy.MaxRatio):
+		check.Action = MARGIN_REMOVE
+		target := policy.TargetRatio
+		if floor := check.MaintenanceMarginRatio.Add(MARGIN_REMOVE_HEADROOM); target.LT(floor) {
+			target = floor
+			check.Reason = "target ratio too close to maintenance margin ratio"
+		}
+		amount := check.MarginRatio.Sub(target).Mul(notional).TruncateInt()
+		free := FreeCollateral(position, market)
+		if free.IsNil() {
+			amount = sdk.ZeroInt()
+			check.Reason = "free collateral unknown"
+		} else if freeInt := free.TruncateInt(); freeInt.LT(amount) {
+			amount = sdk.MaxInt(freeInt, sdk.ZeroInt())
+			check.Reason = fmt.Sprintf("only %s%s of the margin is free", amount, denom)
+		}
+		check.Amount.Amount = amount
+	}
+
+	if check.Action != MARGIN_OK && !check.Amount.IsPositive() {
+		check.Action = MARGIN_OK
+	}
+
+	return check
+}
+
+// ManageMargin checks the margin of every position of the bot's state with
+// EvaluateMargin, then adds or removes margin as needed. Each margin tx is
+// journaled as a trade, and the positions are fetched again after it. It
+// returns the checks, with the last error of a margin tx, if any.
+func (bot *Bot) ManageMargin(ctx context.Context, trader sdk.AccAddress) ([]MarginCheck, error) {
+
+	policy := bot.MarginPolicy
+	checks := []MarginCheck{}
+
+	pairs := make([]string, 0, len(bot.State.Positions))
+	for pair := range bot.State.Positions {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+
+	var lastErr error
+	for _, pair := range pairs {
+		check := EvaluateMargin(pair, bot.State.Positions[pair], bot.State.Amms[pair].Market,
+			policy, bot.State.PortfolioBalances.Balances.WalletCoins)
+		checks = append(checks, check)
+
+		if check.Action == MARGIN_OK {
+			continue
+		}
+
+		log.Printf("Margin of %s: ratio %s, maintenance %s, %s %s",
+			pair, check.MarginRatio, check.MaintenanceMarginRatio, check.Action, check.Amount)
+
+		if err := bot.ChangeMargin(ctx, trader, check); err != nil {
+			lastErr = fmt.Errorf("Cannot ChangeMargin() of %s: %w", pair, err)
+			log.Print(lastErr)
+		}
+	}
+
+	return checks, lastErr
+}
+
+// ChangeMargin sends the MsgAddMargin or MsgRemoveMargin of check, journals
+// it and, once the tx is delivered without error, moves the amount between
+// the wallet and the traded balances.
+func (bot *Bot) ChangeMargin(ctx context.Context, trader sdk.AccAddress, check MarginCheck) error {
+
+	order := TradeOrder{
+		Pair:        check.Pair,
+		QuoteAmount: check.Amount.Amount,
+	}
+	if _, exists := bot.State.Positions[check.Pair]; exists {
+		order.Inputs = bot.PopulateCurrPosStats(check.Pair)
+	}
+
+	var msg sdk.Msg
+	switch check.Action {
+	case MARGIN_ADD:
+		order.Action, order.Side = AddMarginOrder, SIDE_ADD_MARGIN
+		msg = &perpTypes.MsgAddMargin{
+			Sender: trader.String(),
+			Pair:   asset.Pair(check.Pair),
+			Margin: check.Amount,
+		}
+	case MARGIN_REMOVE:
+		order.Action, order.Side = RemoveMarginOrder, SIDE_REMOVE_MARGIN
+		msg = &perpTypes.MsgRemoveMargin{
+			Sender: trader.String(),
+			Pair:   asset.Pair(check.Pair),
+			Margin: check.Amount,
+		}
+	default:
+		return nil
+	}
+
+	resp, err := bot.Gosdk.BroadcastMsgsGrpc(trader, msg)
+	if err == nil && resp.Code != 0 {
+		err = fmt.Errorf("Tx %s failed with code %d: %s", resp.TxHash, resp.Code, resp.RawLog)
+	}
+	resultTx := bot.journalTrade(ctx, trader, order, resp, err)
+	if err != nil {
+		return err
+	}
+
+	// Passing CheckTx doesn't move the margin, only a delivered tx does.
+	if resultTx == nil {
+		return fmt.Errorf("Tx %s wasn't included, balances left unchanged", resp.TxHash)
+	}
+	if resultTx.TxResult.Code != 0 {
+		return fmt.Errorf("Tx %s failed in block %d with code %d: %s", resp.TxHash,
+			resultTx.Height, resultTx.TxResult.Code, resultTx.TxResult.Log)
+	}
+
+	if check.Action == MARGIN_ADD {
+		bot.State.PortfolioBalances.Balances.AddTradedBalances(check.Pair, check.Amount)
+	} else {
+		bot.State.PortfolioBalances.Balances.RemoveTradedBalances(check.Pair, check.Amount)
+	}
+
+	return bot.FetchPositions(trader.String(), ctx)
+}
@@ -0,0 +1,306 @@
+package fbot
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// DEFAULT_RETURN_PERIOD: Length of the periods of PerformanceReport.Returns,
+// daily unless asked otherwise.
+const DEFAULT_RETURN_PERIOD = 24 * time.Hour
+
+// PeriodReturn: Change of NAV over one period, from the last NAV of the
+// previous period, or the first NAV of the range, to the last NAV of this
+// one.
+type PeriodReturn struct {
+	Start    time.Time
+	StartNav float64
+	EndNav   float64
+	Return   float64
+}
+
+// RoundTrip: A position from its opening to its closing or flip.
+type RoundTrip struct {
+	Pair       string
+	OpenBlock  int64
+	CloseBlock int64
+	OpenedAt   time.Time
+	ClosedAt   time.Time
+	// NetPnl: Realized, funding and fee PnL of the changes in between.
+	NetPnl sdk.Dec
+}
+
+// PerformanceReport: Analytics of a bot over a block or time range. Returns,
+// drawdown and ratios come from the NAV of its snapshots, win rate and
+// holding time from its closed round trips, and the PnL breakdown from its
+// position changes.
+type PerformanceReport struct {
+	BotID string
+	// Trader: Address of the bot, whose position changes are analyzed.
+	Trader   string
+	Period   time.Duration
+	StartNav float64
+	EndNav   float64
+	// TotalReturn: EndNav / StartNav - 1.
+	TotalReturn float64
+	Returns     []PeriodReturn
+	// MaxDrawdown: Largest fall of NAV from a previous peak, as a fraction
+	// of the peak.
+	MaxDrawdown float64
+	// Sharpe and Sortino are annualized from the period returns, with a risk
+	// free rate of 0. Both are 0 with fewer than two periods.
+	Sharpe  float64
+	Sortino float64
+
+	RoundTrips       []RoundTrip
+	Wins             int
+	Losses           int
+	WinRate          float64
+	AvgHoldingTime   time.Duration
+	AvgHoldingBlocks float64
+
+	Pairs    []PnlSummary
+	TotalPnl PnlSummary
+}
+
+// QueryPerformance builds the PerformanceReport of botID over query, with
+// returns over periods of period. botID may be empty if only one bot
+// recorded snapshots in the range. The position changes are those of
+// query.Trader, or else of the trader of the bot's snapshots.
+func (botdb *BotDB) QueryPerformance(query DBQuery, botID string, period time.Duration) (PerformanceReport, error) {
+
+	if period <= 0 {
+		period = DEFAULT_RETURN_PERIOD
+	}
+	report := PerformanceReport{BotID: botID, Trader: query.Trader, Period: period}
+
+	navQuery := query
+	navQuery.Pair = ""
+	points, err := botdb.QueryNav(navQuery)
+	if err != nil {
+		return report, err
+	}
+
+	botPoints := []NavPoint{}
+	for _, point := range points {
+		if report.BotID == "" {
+			report.BotID = point.BotID
+		} else if point.BotID != report.BotID {
+			if botID == "" {
+				return report, fmt.Errorf(
+					"Snapshots of several bots (%s, %s) in range, pick one", report.BotID, point.BotID)
+			}
+			continue
+		}
+		botPoints = append(botPoints, point)
+		if query.Trader == "" && point.Trader != "" {
+			report.Trader = point.Trader
+		}
+	}
+	report.analyzeNav(botPoints)
+
+	changesQuery := query
+	changesQuery.Trader = report.Trader
+	changes, err := botdb.QueryPositionChanges(changesQuery)
+	if err != nil {
+		return report, err
+	}
+	for _, change := range changes {
+		if report.Trader == "" {
+			report.Trader = change.Trader
+		} else if change.Trader != report.Trader {
+			return report, fmt.Errorf(
+				"Position changes of several traders (%s, %s) in range, pick one", report.Trader, change.Trader)
+		}
+	}
+	if report.Pairs, report.TotalPnl, err = SummarizePnl(changes); err != nil {
+		return report, err
+	}
+	trips, err := RoundTrips(changes)
+	if err != nil {
+		return report, err
+	}
+	report.analyzeRoundTrips(trips)
+
+	return report, nil
+}
+
+// analyzeNav fills the NAV based fields from points in block order.
+func (report *PerformanceReport) analyzeNav(points []NavPoint) {
+
+	if len(points) == 0 {
+		return
+	}
+
+	navs := make([]float64, len(points))
+	for i, point := range points {
+		navs[i] = point.Nav.MustFloat64()
+	}
+	report.StartNav, report.EndNav = navs[0], navs[len(navs)-1]
+	report.TotalReturn = relativeChange(report.StartNav, report.EndNav)
+
+	peak := navs[0]
+	for _, nav := range navs {
+		peak = math.Max(peak, nav)
+		if peak > 0 {
+			report.MaxDrawdown = math.Max(report.MaxDrawdown, (peak-nav)/peak)
+		}
+	}
+
+	startNav := navs[0]
+	for i, point := range points {
+		start := point.TakenAt.UTC().Truncate(report.Period)
+		last := len(report.Returns) - 1
+		if last < 0 || !report.Returns[last].Start.Equal(start) {
+			if last >= 0 {
+				startNav = report.Returns[last].EndNav
+			}
+			report.Returns = append(report.Returns, PeriodReturn{Start: start, StartNav: startNav})
+			last++
+		}
+		report.Returns[last].EndNav = navs[i]
+		report.Returns[last].Return = relativeChange(report.Returns[last].StartNav, navs[i])
+	}
+
+	if len(report.Returns) < 2 {
+		return
+	}
+
+	returns := make([]float64, len(report.Returns))
+	for i, periodReturn := range report.Returns {
+		returns[i] = periodReturn.Return
+	}
+	mean, stdev, downside := returnStats(returns)
+	annualize := math.Sqrt(float64(365*24*time.Hour) / float64(report.Period))
+	if stdev > 0 {
+		report.Sharpe = mean / stdev * annualize
+	}
+	if downside > 0 {
+		report.Sortino = mean / downside * annualize
+	}
+}
+
+// analyzeRoundTrips fills the win rate and holding time from trips.
+func (report *PerformanceReport) analyzeRoundTrips(trips []RoundTrip) {
+
+	report.RoundTrips = trips
+	if len(trips) == 0 {
+		return
+	}
+
+	var holding time.Duration
+	var blocks int64
+	for _, trip := range trips {
+		if trip.NetPnl.IsPositive() {
+			report.Wins++
+		} else {
+			report.Losses++
+		}
+		holding += trip.ClosedAt.Sub(trip.OpenedAt)
+		blocks += trip.CloseBlock - trip.OpenBlock
+	}
+
+	report.WinRate = float64(report.Wins) / float64(len(trips))
+	report.AvgHoldingTime = holding / time.Duration(len(trips))
+	report.AvgHoldingBlocks = float64(blocks) / float64(len(trips))
+}
+
+// RoundTrips pairs up the openings and closings of positions among changes.
+// A position opens when its size leaves zero and closes when it returns to
+// zero or changes side, which also opens the next one. Positions still open
+// at the last change are left out. Times are block times, or when the
+// changes were recorded for changes without one.
+func RoundTrips(changes []TablePositionChanges) ([]RoundTrip, error) {
+
+	sorted := append([]TablePositionChanges{}, changes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].BlockHeight != sorted[j].BlockHeight {
+			return sorted[i].BlockHeight < sorted[j].BlockHeight
+		}
+		return sorted[i].EventIndex < sorted[j].EventIndex
+	})
+
+	trips := []RoundTrip{}
+	open := make(map[string]*RoundTrip)
+	sizes := make(map[string]sdk.Dec)
+
+	for _, change := range sorted {
+		size, err := decOrZero(change.Size)
+		if err != nil {
+			return nil, fmt.Errorf("Position change %d: %w", change.ID, err)
+		}
+		pnl := newPnlSummary(change.Pair)
+		if err = pnl.add(change); err != nil {
+			return nil, fmt.Errorf("Position change %d: %w", change.ID, err)
+		}
+
+		at := change.BlockTime
+		if at.IsZero() {
+			at = change.CreatedAt
+		}
+
+		previous, seen := sizes[change.Pair]
+		sizes[change.Pair] = size
+		flipped := seen && !previous.IsZero() && !size.IsZero() &&
+			previous.IsPositive() != size.IsPositive()
+
+		if trip := open[change.Pair]; trip != nil {
+			trip.NetPnl = trip.NetPnl.Add(pnl.NetPnl)
+			if size.IsZero() || flipped {
+				trip.CloseBlock, trip.ClosedAt = change.BlockHeight, at
+				trips = append(trips, *trip)
+				delete(open, change.Pair)
+			}
+		}
+
+		if open[change.Pair] == nil && !size.IsZero() {
+			// The PnL of a flip belongs to the trip it closes.
+			netPnl := pnl.NetPnl
+			if flipped {
+				netPnl = sdk.ZeroDec()
+			}
+			open[change.Pair] = &RoundTrip{
+				Pair:      change.Pair,
+				OpenBlock: change.BlockHeight,
+				OpenedAt:  at,
+				NetPnl:    netPnl,
+			}
+		}
+	}
+
+	return trips, nil
+}
+
+func relativeChange(from, to float64) float64 {
+	if from == 0 {
+		return 0
+	}
+	return to/from - 1
+}
+
+// returnStats returns the mean, sample standard deviation and downside
+// deviation of returns.
+func returnStats(returns []float64) (mean, stdev, downside float64) {
+
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+
+	var variance, downsideSum float64
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+		if r < 0 {
+			downsideSum += r * r
+		}
+	}
+
+	stdev = math.Sqrt(variance / float64(len(returns)-1))
+	downside = math.Sqrt(downsideSum / float64(len(returns)))
+
+	return mean, stdev, downside
+}
@@ -0,0 +1,304 @@
+package fbot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	abci "github.com/cometbft/cometbft/abci/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/gogoproto/proto"
+	"gorm.io/gorm/clause"
+
+	perpTypes "github.com/NibiruChain/nibiru/x/perp/v2/types"
+)
+
+// Where a position change event was emitted.
+const (
+	EVENT_SOURCE_TX          = "tx"
+	EVENT_SOURCE_BEGIN_BLOCK = "begin_block"
+	EVENT_SOURCE_END_BLOCK   = "end_block"
+)
+
+// EVENT_SYNC_MAX_BLOCKS: Most blocks SyncPositionChanges scans in one call,
+// so catching up after downtime is spread over several iterations.
+const EVENT_SYNC_MAX_BLOCKS = 500
+
+// PositionChangeRows converts the PositionChangedEvents of trader among
+// events to rows of the position changes table. EventIndex is the index in
+// events, which identifies the change within its tx or block.
+func PositionChangeRows(trader string, blockHeight int64, txHash string,
+	source string, events []abci.Event) ([]TablePositionChanges, error) {
+
+	eventType := proto.MessageName(&perpTypes.PositionChangedEvent{})
+	rows := []TablePositionChanges{}
+
+	for i, event := range events {
+		if event.Type != eventType {
+			continue
+		}
+		msg, err := sdk.ParseTypedEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		change, ok := msg.(*perpTypes.PositionChangedEvent)
+		if !ok || change.FinalPosition.TraderAddress != trader {
+			continue
+		}
+
+		rows = append(rows, TablePositionChanges{
+			BlockHeight:      blockHeight,
+			TxHash:           txHash,
+			Source:           source,
+			EventIndex:       i,
+			Pair:             change.FinalPosition.Pair.String(),
+			Trader:           trader,
+			ChangeReason:     string(change.ChangeReason),
+			Size:             change.FinalPosition.Size_.String(),
+			PositionNotional: change.PositionNotional.String(),
+			RealizedPnl:      change.RealizedPnl.String(),
+			FundingPayment:   change.FundingPayment.String(),
+			Fee:              change.TransactionFee.Amount.String(),
+			FeeDenom:         change.TransactionFee.Denom,
+			BadDebt:          change.BadDebt.Amount.String(),
+			MarginToUser:     change.MarginToUser.String(),
+		})
+	}
+
+	return rows, nil
+}
+
+// RecordPositionChanges stores rows, skipping changes already recorded, e.g.
+// by both JournalTrade and SyncPositionChanges.
+func (botdb *BotDB) RecordPositionChanges(rows []TablePositionChanges) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	return botdb.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error
+}
+
+func (botdb *BotDB) QueryPositionChanges(query DBQuery) ([]TablePositionChanges, error) {
+	var changes []TablePositionChanges
+	db := botdb.DB.Scopes(query.traderScope).Find(&changes)
+	return changes, db.Error
+}
+
+// LastPositionChangeHeight returns the height of the latest recorded position
+// change of trader, or 0 if there is none.
+func (botdb *BotDB) LastPositionChangeHeight(trader string) (int64, error) {
+	var height int64
+	err := botdb.DB.Model(&TablePositionChanges{}).Where("trader = ?", trader).
+		Select("COALESCE(MAX(block_height), 0)").Scan(&height).Error
+	return height, err
+}
+
+// EventsSyncedHeight returns the last block SyncPositionChanges scanned for
+// trader, or 0 if it never did.
+func (botdb *BotDB) EventsSyncedHeight(trader string) (int64, error) {
+	var states []TableSyncState
+	err := botdb.DB.Where("trader = ?", trader).Limit(1).Find(&states).Error
+	if err != nil || len(states) == 0 {
+		return 0, err
+	}
+	return states[0].EventsSyncedHeight, nil
+}
+
+// SaveEventsSyncedHeight stores the last block SyncPositionChanges scanned
+// for trader.
+func (botdb *BotDB) SaveEventsSyncedHeight(trader string, height int64) error {
+	return botdb.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "trader"}},
+		DoUpdates: clause.AssignmentColumns([]string{"events_synced_height", "updated_at"}),
+	}).Create(&TableSyncState{Trader: trader, EventsSyncedHeight: height}).Error
+}
+
+// SyncPositionChanges records the position changes of trader in the blocks
+// after the last synced one up to toHeight, from both tx results and begin
+// and end block events, e.g. liquidations sent by others. The synced height
+// is stored, so a restarted bot resumes where it stopped; the first sync of
+// a trader starts at toHeight.
+func (bot *Bot) SyncPositionChanges(ctx context.Context, trader sdk.AccAddress, toHeight int64) error {
+
+	if bot.State.EventsSyncedHeight == 0 {
+		syncedHeight, err := bot.DB.EventsSyncedHeight(trader.String())
+		if err != nil {
+			return err
+		}
+		bot.State.EventsSyncedHeight = syncedHeight
+	}
+
+	fromHeight := bot.State.EventsSyncedHeight + 1
+	if bot.State.EventsSyncedHeight == 0 {
+		fromHeight = toHeight
+	}
+	if toHeight-fromHeight >= EVENT_SYNC_MAX_BLOCKS {
+		toHeight = fromHeight + EVENT_SYNC_MAX_BLOCKS - 1
+	}
+
+	// Blocks synced before an error are kept.
+	var syncErr error
+	for height := fromHeight; height <= toHeight; height++ {
+		rows, err := bot.fetchBlockPositionChanges(ctx, trader.String(), height)
+		if err != nil {
+			syncErr = fmt.Errorf("Cannot fetch events of block %d: %w", height, err)
+			break
+		}
+		if err = bot.DB.RecordPositionChanges(rows); err != nil {
+			syncErr = err
+			break
+		}
+		bot.State.EventsSyncedHeight = height
+	}
+
+	if bot.State.EventsSyncedHeight >= fromHeight {
+		err := bot.DB.SaveEventsSyncedHeight(trader.String(), bot.State.EventsSyncedHeight)
+		if err != nil && syncErr == nil {
+			syncErr = fmt.Errorf("Cannot SaveEventsSyncedHeight(): %w", err)
+		}
+	}
+
+	return syncErr
+}
+
+func (bot *Bot) fetchBlockPositionChanges(ctx context.Context, trader string, height int64) ([]TablePositionChanges, error) {
+
+	results, err := bot.Gosdk.CometRPC.BlockResults(ctx, &height)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := PositionChangeRows(trader, height, "", EVENT_SOURCE_BEGIN_BLOCK, results.BeginBlockEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	txRows := []TablePositionChanges{}
+	txIndexes := []int{}
+	for i, txResult := range results.TxsResults {
+		changes, err := PositionChangeRows(trader, height, "", EVENT_SOURCE_TX, txResult.Events)
+		if err != nil {
+			return nil, err
+		}
+		for range changes {
+			txIndexes = append(txIndexes, i)
+		}
+		txRows = append(txRows, changes...)
+	}
+
+	endRows, err := PositionChangeRows(trader, height, "", EVENT_SOURCE_END_BLOCK, results.EndBlockEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows)+len(txRows)+len(endRows) == 0 {
+		return rows, nil
+	}
+
+	// Tx hashes and the block time are only in the block, fetch it if
+	// anything changed a position.
+	block, err := bot.Gosdk.CometRPC.Block(ctx, &height)
+	if err != nil {
+		return nil, err
+	}
+	for i := range txRows {
+		txRows[i].TxHash = fmt.Sprintf("%X", block.Block.Txs[txIndexes[i]].Hash())
+	}
+	rows = append(append(rows, txRows...), endRows...)
+	for i := range rows {
+		rows[i].BlockTime = block.Block.Time.UTC()
+	}
+
+	return rows, nil
+}
+
+// PnlSummary: Realized profit and loss of a pair from its position changes.
+// FundingPnl and FeePnl are positive when received, so NetPnl adds up all
+// three.
+type PnlSummary struct {
+	Pair        string
+	Changes     int
+	RealizedPnl sdk.Dec
+	FundingPnl  sdk.Dec
+	FeePnl      sdk.Dec
+	NetPnl      sdk.Dec
+}
+
+func newPnlSummary(pair string) PnlSummary {
+	return PnlSummary{
+		Pair:        pair,
+		RealizedPnl: sdk.ZeroDec(),
+		FundingPnl:  sdk.ZeroDec(),
+		FeePnl:      sdk.ZeroDec(),
+		NetPnl:      sdk.ZeroDec(),
+	}
+}
+
+// add accounts for one change. The chain reports funding and fees as paid
+// by the trader, so they are subtracted.
+func (summary *PnlSummary) add(change TablePositionChanges) error {
+
+	realizedPnl, err := decOrZero(change.RealizedPnl)
+	if err != nil {
+		return err
+	}
+	fundingPayment, err := decOrZero(change.FundingPayment)
+	if err != nil {
+		return err
+	}
+	fee, err := decOrZero(change.Fee)
+	if err != nil {
+		return err
+	}
+
+	summary.Changes++
+	summary.RealizedPnl = summary.RealizedPnl.Add(realizedPnl)
+	summary.FundingPnl = summary.FundingPnl.Sub(fundingPayment)
+	summary.FeePnl = summary.FeePnl.Sub(fee)
+	summary.NetPnl = summary.RealizedPnl.Add(summary.FundingPnl).Add(summary.FeePnl)
+
+	return nil
+}
+
+func decOrZero(value string) (sdk.Dec, error) {
+	if value == "" {
+		return sdk.ZeroDec(), nil
+	}
+	return sdk.NewDecFromStr(value)
+}
+
+// SummarizePnl sums changes exactly, per pair sorted by pair, and overall.
+func SummarizePnl(changes []TablePositionChanges) ([]PnlSummary, PnlSummary, error) {
+
+	byPair := make(map[string]*PnlSummary)
+	total := newPnlSummary("total")
+
+	for _, change := range changes {
+		summary, exists := byPair[change.Pair]
+		if !exists {
+			newSummary := newPnlSummary(change.Pair)
+			summary = &newSummary
+			byPair[change.Pair] = summary
+		}
+		if err := summary.add(change); err != nil {
+			return nil, total, fmt.Errorf("Position change %d: %w", change.ID, err)
+		}
+		total.add(change)
+	}
+
+	pairs := make([]PnlSummary, 0, len(byPair))
+	for _, summary := range byPair {
+		pairs = append(pairs, *summary)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Pair < pairs[j].Pair })
+
+	return pairs, total, nil
+}
+
+// QueryPnl summarizes the position changes matching query.
+func (botdb *BotDB) QueryPnl(query DBQuery) ([]PnlSummary, PnlSummary, error) {
+	changes, err := botdb.QueryPositionChanges(query)
+	if err != nil {
+		return nil, newPnlSummary("total"), err
+	}
+	return SummarizePnl(changes)
+}
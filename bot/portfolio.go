@@ -3,6 +3,7 @@ package fbot
 import (
 	"context"
 
+	"github.com/NibiruChain/nibiru/x/common/asset"
 	sdk "github.com/cosmos/cosmos-sdk/types"
 	bankTypes "github.com/cosmos/cosmos-sdk/x/bank/types"
 	"google.golang.org/grpc"
@@ -20,6 +21,63 @@ func (portfolio Portfolio) TotalValue() sdk.Coins {
 	return portfolio.Balances.TotalValue()
 }
 
+// NAV_DENOM: Quote denom of the perp markets, the unit of NAV.
+const NAV_DENOM = "unusd"
+
+// NAV: Net asset value of a portfolio in NAV_DENOM.
+type NAV struct {
+	// Wallet: Value of the wallet coins at index prices.
+	Wallet sdk.Dec
+	// Margin: Margin held by open positions.
+	Margin        sdk.Dec
+	UnrealizedPnl sdk.Dec
+	// Total: Sum of Wallet, Margin and UnrealizedPnl.
+	Total sdk.Dec
+	// Unpriced: Wallet coins without an index price against NAV_DENOM, left
+	// out of Wallet.
+	Unpriced sdk.Coins
+}
+
+// NAV values the wallet coins at the index prices of their pair against
+// NAV_DENOM, and adds the margin and unrealized PnL of positions, which are
+// already in NAV_DENOM.
+func (portfolio Portfolio) NAV(prices map[string]Prices, positions map[string]PositionFields) NAV {
+
+	nav := NAV{
+		Wallet:        sdk.ZeroDec(),
+		Margin:        sdk.ZeroDec(),
+		UnrealizedPnl: sdk.ZeroDec(),
+		Unpriced:      sdk.NewCoins(),
+	}
+
+	for _, coin := range portfolio.Balances.WalletCoins {
+		amount := sdk.NewDecFromInt(coin.Amount)
+		if coin.Denom == NAV_DENOM {
+			nav.Wallet = nav.Wallet.Add(amount)
+			continue
+		}
+		price, exists := prices[asset.NewPair(coin.Denom, NAV_DENOM).String()]
+		if !exists || price.IndexPrice.IsNil() {
+			nav.Unpriced = nav.Unpriced.Add(coin)
+			continue
+		}
+		nav.Wallet = nav.Wallet.Add(amount.Mul(price.IndexPrice))
+	}
+
+	for _, position := range positions {
+		if !position.Positon.Margin.IsNil() {
+			nav.Margin = nav.Margin.Add(position.Positon.Margin)
+		}
+		if !position.UnrealizedPnl.IsNil() {
+			nav.UnrealizedPnl = nav.UnrealizedPnl.Add(position.UnrealizedPnl)
+		}
+	}
+
+	nav.Total = nav.Wallet.Add(nav.Margin).Add(nav.UnrealizedPnl)
+
+	return nav
+}
+
 type PortfolioBalances struct {
 	// TradedBalances: Balances traded in each perp market
 	TradedBalances map[string]sdk.Coin
@@ -32,7 +90,7 @@ type PortfolioBalances struct {
 func (bals *PortfolioBalances) TotalValue() sdk.Coins {
 	coins := sdk.NewCoins(bals.WalletCoins...)
 	for _, balance := range bals.TradedBalances {
-		coins.Add(balance)
+		coins = coins.Add(balance)
 	}
 	return coins
 }
@@ -59,26 +117,110 @@ func (bals *PortfolioBalances) QueryWalletCoins(ctx context.Context,
 	)
 }
 
+// PopWalletCoins replaces WalletCoins with the queried balances; the chain
+// is the authority on what the wallet holds.
 func (bals *PortfolioBalances) PopWalletCoins(balanceResp *bankTypes.QueryAllBalancesResponse) {
+	bals.WalletCoins = sdk.NewCoins(balanceResp.Balances...)
+}
 
-	for _, coin := range balanceResp.Balances {
-		bals.WalletCoins = bals.WalletCoins.Add(coin)
+// SetTradedBalances replaces TradedBalances with the margin of the open
+// positions, in the quote denom of their pair.
+func (bals *PortfolioBalances) SetTradedBalances(positions map[string]PositionFields) {
+
+	bals.TradedBalances = make(map[string]sdk.Coin)
+
+	for pair, position := range positions {
+		margin := position.Positon.Margin
+		if margin.IsNil() || !margin.IsPositive() {
+			continue
+		}
+		bals.TradedBalances[pair] = sdk.NewCoin(asset.Pair(pair).QuoteDenom(), margin.TruncateInt())
 	}
 }
 
+// AddTradedBalances records locally that amount of the wallet was put in
+// market, until the next refresh from chain.
 func (bals *PortfolioBalances) AddTradedBalances(market string, amount sdk.Coin) {
 	if bals.TradedBalances[market].Denom == amount.Denom {
 		bals.TradedBalances[market] = bals.TradedBalances[market].Add(amount)
 	} else {
 		bals.TradedBalances[market] = amount
 	}
+	if wallet, hasNeg := bals.WalletCoins.SafeSub(amount); !hasNeg {
+		bals.WalletCoins = wallet
+	}
 }
 
+// RemoveTradedBalances records locally that amount was taken out of market
+// back to the wallet, until the next refresh from chain.
 func (bals *PortfolioBalances) RemoveTradedBalances(market string, amount sdk.Coin) {
-	if bals.TradedBalances[market].Denom == amount.Denom {
-		bals.TradedBalances[market] = bals.TradedBalances[market].Sub(amount)
+	if traded := bals.TradedBalances[market]; traded.Denom == amount.Denom {
+		if traded.Amount.GT(amount.Amount) {
+			bals.TradedBalances[market] = traded.Sub(amount)
+		} else {
+			delete(bals.TradedBalances, market)
+		}
 	}
-	bals.WalletCoins = append(bals.WalletCoins, amount)
+	bals.WalletCoins = bals.WalletCoins.Add(amount)
+}
+
+// BalanceDiff: An amount that differs between the bot's local view and the
+// chain: a wallet denom, or the traded balance of Pair if it is set.
+type BalanceDiff struct {
+	Pair  string `json:",omitempty"`
+	Denom string
+	Local sdk.Int
+	Chain sdk.Int
+}
+
+// Delta is what the chain holds on top of the local view.
+func (diff BalanceDiff) Delta() sdk.Int {
+	return diff.Chain.Sub(diff.Local)
+}
+
+// ReconcileBalances lists the wallet denoms, then the pairs, whose amounts
+// differ between local and chain, sorted.
+func ReconcileBalances(local PortfolioBalances, chain PortfolioBalances) []BalanceDiff {
+
+	diffs := []BalanceDiff{}
+
+	denoms := make(map[string]bool)
+	for _, coin := range local.WalletCoins {
+		denoms[coin.Denom] = true
+	}
+	for _, coin := range chain.WalletCoins {
+		denoms[coin.Denom] = true
+	}
+	for _, denom := range sortedKeys(denoms) {
+		localAmount := local.WalletCoins.AmountOf(denom)
+		chainAmount := chain.WalletCoins.AmountOf(denom)
+		if !localAmount.Equal(chainAmount) {
+			diffs = append(diffs, BalanceDiff{Denom: denom, Local: localAmount, Chain: chainAmount})
+		}
+	}
+
+	pairs := make(map[string]bool)
+	for pair := range local.TradedBalances {
+		pairs[pair] = true
+	}
+	for pair := range chain.TradedBalances {
+		pairs[pair] = true
+	}
+	for _, pair := range sortedKeys(pairs) {
+		denom := asset.Pair(pair).QuoteDenom()
+		localAmount, chainAmount := sdk.ZeroInt(), sdk.ZeroInt()
+		if coin, exists := local.TradedBalances[pair]; exists {
+			localAmount, denom = coin.Amount, coin.Denom
+		}
+		if coin, exists := chain.TradedBalances[pair]; exists {
+			chainAmount, denom = coin.Amount, coin.Denom
+		}
+		if !localAmount.Equal(chainAmount) {
+			diffs = append(diffs, BalanceDiff{Pair: pair, Denom: denom, Local: localAmount, Chain: chainAmount})
+		}
+	}
+
+	return diffs
 }
 
 // func (bals PortfolioBalances) CalcRatioBalances() {
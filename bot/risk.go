@@ -0,0 +1,200 @@
+package fbot
+
+import (
+	"fmt"
+
+	"github.com/NibiruChain/nibiru/x/common/asset"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// RiskLimits: Hard caps on the positions the strategy may open. Notionals
+// are in quote units. A zero or unset limit is not enforced.
+type RiskLimits struct {
+	// MaxPairNotional: Max notional of the position in one pair.
+	MaxPairNotional sdk.Dec
+	// MaxGrossNotional: Max sum of the absolute notionals of all positions.
+	MaxGrossNotional sdk.Dec
+	// MaxNetNotional: Max absolute sum of the signed notionals, longs
+	// positive, of all positions.
+	MaxNetNotional sdk.Dec
+	// MaxWalletShare: Max fraction of the capital, wallet plus margin in the
+	// quote denom, put as margin in one market.
+	MaxWalletShare sdk.Dec
+	// MaxPositions: Max number of pairs with an open position.
+	MaxPositions int
+}
+
+// Names of the limits that clip or reject an order, see RiskDecision.
+const (
+	RISK_MAX_PAIR_NOTIONAL  = "max_pair_notional"
+	RISK_MAX_GROSS_NOTIONAL = "max_gross_notional"
+	RISK_MAX_NET_NOTIONAL   = "max_net_notional"
+	RISK_MAX_WALLET_SHARE   = "max_wallet_share"
+	RISK_MAX_POSITIONS      = "max_positions"
+)
+
+// Validate checks that no limit is negative.
+func (limits RiskLimits) Validate() error {
+	for name, limit := range map[string]sdk.Dec{
+		RISK_MAX_PAIR_NOTIONAL:  limits.MaxPairNotional,
+		RISK_MAX_GROSS_NOTIONAL: limits.MaxGrossNotional,
+		RISK_MAX_NET_NOTIONAL:   limits.MaxNetNotional,
+		RISK_MAX_WALLET_SHARE:   limits.MaxWalletShare,
+	} {
+		if !limit.IsNil() && limit.IsNegative() {
+			return fmt.Errorf("Risk limit %s can't be negative, got %s", name, limit)
+		}
+	}
+	if limits.MaxPositions < 0 {
+		return fmt.Errorf("Risk limit %s can't be negative, got %d", RISK_MAX_POSITIONS, limits.MaxPositions)
+	}
+	return nil
+}
+
+// Exposure: What the bot holds, as seen by the risk limits.
+type Exposure struct {
+	// Notionals: Signed notional of the open position of each pair, longs
+	// positive.
+	Notionals map[string]sdk.Dec
+	// Capital: Wallet quote coins plus all margin.
+	Capital sdk.Dec
+}
+
+// CurrentExposure builds the Exposure of the bot's positions and wallet.
+// Positions without a queried notional are valued at the mark price.
+func (bot *Bot) CurrentExposure() Exposure {
+
+	exposure := Exposure{
+		Notionals: make(map[string]sdk.Dec),
+		Capital:   sdk.ZeroDec(),
+	}
+
+	for pair, position := range bot.State.Positions {
+		size := position.Positon.Size_
+		if size.IsNil() || size.IsZero() {
+			continue
+		}
+
+		notional := position.PositionNotional
+		if notional.IsNil() {
+			notional = sdk.ZeroDec()
+			if markPrice := bot.State.Prices[pair].MarkPrice; !markPrice.IsNil() {
+				notional = size.Abs().Mul(markPrice)
+			}
+		}
+		notional = notional.Abs()
+		if size.IsNegative() {
+			notional = notional.Neg()
+		}
+		exposure.Notionals[pair] = notional
+
+		margin := position.Positon.Margin
+		if margin.IsNil() {
+			margin = sdk.ZeroDec()
+		}
+		exposure.Capital = exposure.Capital.Add(margin)
+	}
+
+	quoteDenoms := make(map[string]bool)
+	for pair := range bot.State.Amms {
+		quoteDenoms[asset.Pair(pair).QuoteDenom()] = true
+	}
+	for denom := range quoteDenoms {
+		amount := bot.State.PortfolioBalances.Balances.WalletCoins.AmountOf(denom)
+		exposure.Capital = exposure.Capital.Add(sdk.NewDecFromInt(amount))
+	}
+
+	return exposure
+}
+
+// RiskDecision: What the risk limits did to one order.
+type RiskDecision struct {
+	Pair string
+	// Requested and Allowed are signed quote amounts, longs positive.
+	// Allowed is zero if the order is rejected.
+	Requested sdk.Int
+	Allowed   sdk.Int
+	// Limit: The limit that clipped or rejected the order, empty if none
+	// did.
+	Limit string
+}
+
+// Rejected is true if none of the order may be sent.
+func (decision RiskDecision) Rejected() bool {
+	return decision.Allowed.IsZero()
+}
+
+// Clipped is true if the order was cut down or rejected.
+func (decision RiskDecision) Clipped() bool {
+	return decision.Limit != ""
+}
+
+// CheckOrder clips an order opening a position of quoteAmount at leverage
+// in pair to limits. The order replaces any position of the pair, as the
+// bot only opens from a flat or just closed position, so that position is
+// left out of exposure. The tightest limit wins.
+func (limits RiskLimits) CheckOrder(pair string, quoteAmount sdk.Int, leverage sdk.Dec,
+	exposure Exposure) RiskDecision {
+
+	decision := RiskDecision{Pair: pair, Requested: quoteAmount, Allowed: quoteAmount}
+	if quoteAmount.IsZero() {
+		return decision
+	}
+
+	side := sdk.OneDec()
+	if quoteAmount.IsNegative() {
+		side = side.Neg()
+	}
+
+	others := 0
+	gross, net := sdk.ZeroDec(), sdk.ZeroDec()
+	for other, notional := range exposure.Notionals {
+		if other == pair {
+			continue
+		}
+		others++
+		gross = gross.Add(notional.Abs())
+		net = net.Add(notional)
+	}
+
+	if limits.MaxPositions > 0 && others >= limits.MaxPositions {
+		decision.Allowed, decision.Limit = sdk.ZeroInt(), RISK_MAX_POSITIONS
+		return decision
+	}
+
+	type notionalCap struct {
+		limit string
+		bound sdk.Dec
+	}
+	caps := []notionalCap{}
+	if isSet(limits.MaxPairNotional) {
+		caps = append(caps, notionalCap{RISK_MAX_PAIR_NOTIONAL, limits.MaxPairNotional})
+	}
+	if isSet(limits.MaxGrossNotional) {
+		caps = append(caps, notionalCap{RISK_MAX_GROSS_NOTIONAL, limits.MaxGrossNotional.Sub(gross)})
+	}
+	if isSet(limits.MaxNetNotional) {
+		caps = append(caps, notionalCap{RISK_MAX_NET_NOTIONAL, limits.MaxNetNotional.Sub(side.Mul(net))})
+	}
+	if isSet(limits.MaxWalletShare) && !exposure.Capital.IsNil() {
+		caps = append(caps, notionalCap{RISK_MAX_WALLET_SHARE,
+			limits.MaxWalletShare.Mul(exposure.Capital).Mul(leverage)})
+	}
+
+	notional := sdk.NewDecFromInt(quoteAmount.Abs()).Mul(leverage)
+	for _, notionalCap := range caps {
+		if bound := sdk.MaxDec(notionalCap.bound, sdk.ZeroDec()); notional.GT(bound) {
+			notional, decision.Limit = bound, notionalCap.limit
+		}
+	}
+
+	if decision.Clipped() {
+		allowed := notional.Quo(leverage).TruncateInt()
+		if quoteAmount.IsNegative() {
+			allowed = allowed.Neg()
+		}
+		decision.Allowed = allowed
+	}
+
+	return decision
+}
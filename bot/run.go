@@ -2,7 +2,15 @@ package fbot
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
 )
 
 // go build -o bot main.go
@@ -13,10 +21,46 @@ type Runner struct {
 }
 
 type Server struct {
-	StartCh  chan bool
-	StopCh   chan bool
-	PauseCh  chan bool
-	IsPaused bool
+	StartCh   chan bool
+	StopCh    chan bool
+	PauseCh   chan bool
+	IsPaused  bool
+	IsRunning bool
+
+	// Addr: Address the daemon's status API listens on, see ServeStatus.
+	Addr string
+	// Interval: Time between calls to Run while the bot is running.
+	Interval time.Duration
+	// PruneInterval: Time between prunes of the DB by Retention, 0 disables
+	// them.
+	PruneInterval time.Duration
+	Retention     []RetentionPolicy
+
+	statusMu sync.Mutex
+	status   BotStatus
+}
+
+// RunState reports whether the bot is running, paused or stopped.
+func (server *Server) RunState() RunState {
+	if !server.IsRunning {
+		return RunStateStopped
+	} else if server.IsPaused {
+		return RunStatePaused
+	}
+	return RunStateRunning
+}
+
+// Status returns the last status published by the daemon loop.
+func (server *Server) Status() BotStatus {
+	server.statusMu.Lock()
+	defer server.statusMu.Unlock()
+	return server.status
+}
+
+func (server *Server) setStatus(status BotStatus) {
+	server.statusMu.Lock()
+	defer server.statusMu.Unlock()
+	server.status = status
 }
 
 // After setup, check if already trading from account
@@ -43,6 +87,8 @@ func (runner *Runner) SetConfig(config BotConfig) error {
 			Mnemonic:    config.MNEMONIC,
 			UseMnemonic: true,
 			KeyName:     "",
+			DBDriver:    config.DBDriver(),
+			DBDSN:       config.DBDSN(),
 		},
 	)
 
@@ -52,15 +98,70 @@ func (runner *Runner) SetConfig(config BotConfig) error {
 		return err
 	}
 
-	return nil
+	if runner.Bot.MaxSlippage, err = config.MaxSlippage(); err != nil {
+		return err
+	}
+	if runner.Bot.MinGasBalance, err = config.MinGasBalance(); err != nil {
+		return err
+	}
+	if runner.Bot.MarginPolicy, err = config.MarginPolicy(); err != nil {
+		return err
+	}
+	if runner.Bot.Throttle, err = config.Throttle(); err != nil {
+		return err
+	}
+	if runner.Bot.TWAP, err = config.TWAPSchedule(); err != nil {
+		return err
+	}
+	if runner.Bot.RiskLimits, err = config.RiskLimits(); err != nil {
+		return err
+	}
+	if runner.Bot.Breakers, err = config.CircuitBreakers(); err != nil {
+		return err
+	}
+	if runner.Bot.ExitRules, err = config.ExitRules(); err != nil {
+		return err
+	}
+	runner.Bot.ID = config.BOT_ID
+
+	if runner.Server != nil {
+		runner.Server.Addr = config.DaemonAddr()
+		if runner.Server.Interval, err = config.RunInterval(); err != nil {
+			return err
+		}
+		if runner.Server.PruneInterval, err = config.PruneInterval(); err != nil {
+			return err
+		}
+		runner.Server.Retention, err = config.RetentionPolicies()
+	}
+
+	return err
 }
 
 // function for cases of channels -> choose execution path
+// Runs the bot every Server.Interval while it is started and not paused.
 func (runner *Runner) HandleChannels() {
+
+	interval := runner.Server.Interval
+	if interval == 0 {
+		interval = DEFAULT_RUN_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// A nil channel never fires, so pruning stays off without a ticker.
+	var pruneCh <-chan time.Time
+	if runner.Server.PruneInterval > 0 && len(runner.Server.Retention) > 0 {
+		pruneTicker := time.NewTicker(runner.Server.PruneInterval)
+		defer pruneTicker.Stop()
+		pruneCh = pruneTicker.C
+	}
+
 	for {
 		select {
 		case <-runner.Server.StartCh:
 			runner.StartBot()
+			runner.RunIteration()
 		case <-runner.Server.PauseCh:
 			if runner.Server.IsPaused {
 				runner.Server.IsPaused = false
@@ -70,21 +171,110 @@ func (runner *Runner) HandleChannels() {
 				runner.PauseBot()
 			}
 		case <-runner.Server.StopCh:
-			runner.EndBot()
+			if err := runner.EndBot(); err != nil {
+				log.Printf("Cannot EndBot(): %v", err)
+			}
 			return
+		case <-ticker.C:
+			runner.RunIteration()
+		case <-pruneCh:
+			runner.PruneDB()
+		}
+	}
+}
+
+// RunIteration calls Run once if the bot is running and not paused, then
+// publishes the bot's status.
+func (runner *Runner) RunIteration() {
+
+	if runner.Server.RunState() == RunStateRunning {
+		err := Run(runner.Bot)
+		var trip *BreakerTrip
+		if errors.As(err, &trip) {
+			runner.HandleBreakerTrip(trip)
+		} else if err != nil {
+			log.Printf("Cannot Run(): %v", err)
 		}
 	}
+
+	runner.PublishStatus()
+}
+
+// HandleBreakerTrip applies the response of a tripped circuit breaker:
+// pausing, flattening with EndBot, or exiting the process.
+func (runner *Runner) HandleBreakerTrip(trip *BreakerTrip) {
+
+	log.Print(trip)
+
+	switch trip.Breaker.Response {
+	case BREAKER_PAUSE:
+		runner.PauseBot()
+	case BREAKER_FLATTEN:
+		if err := runner.EndBot(); err != nil {
+			log.Printf("Cannot EndBot(): %v", err)
+			runner.PauseBot()
+		}
+	case BREAKER_HALT:
+		log.Fatalf("Halting: %v", trip)
+	}
+}
+
+// PruneDB applies Server.Retention to the bot's DB and logs what it pruned.
+// It runs on the daemon loop, between iterations, so it never races with
+// the snapshot writes of Run.
+func (runner *Runner) PruneDB() {
+
+	results, err := runner.Bot.DB.Prune(runner.Server.Retention, time.Now().UTC())
+	for _, result := range results {
+		log.Printf("Pruned %s before %s: %d rollups, %d rows deleted",
+			result.Table, result.Cutoff.Format(time.RFC3339), result.Rollups, result.Deleted)
+	}
+	if err != nil {
+		log.Printf("Cannot Prune(): %v", err)
+	}
+}
+
+// PublishStatus stores the bot's current status for the status API.
+func (runner *Runner) PublishStatus() {
+
+	status, err := runner.Bot.BuildStatus(runner.Server.RunState())
+	if err != nil {
+		log.Printf("Cannot BuildStatus(): %v", err)
+		return
+	}
+
+	runner.Server.setStatus(status)
 }
 
+// StartBot starts or resumes the bot. The failed tx count starts over, the
+// other circuit breakers trip again if their condition still holds.
 func (runner *Runner) StartBot() error {
 
+	runner.Server.IsRunning = true
+	runner.Server.IsPaused = false
+	runner.Bot.State.FailedTxs = 0
+	runner.Bot.State.BreakerTrip = nil
+	runner.PublishStatus()
+
 	return nil
 }
 
+// PauseBot pauses the bot and drops its TWAPs in progress.
 func (runner *Runner) PauseBot() error {
+
+	for pair, twap := range runner.Bot.State.TWAPs {
+		twap.finish("bot paused")
+		delete(runner.Bot.State.TWAPs, pair)
+	}
+	runner.Server.IsPaused = true
+	runner.PublishStatus()
+
 	return nil
 }
 
+// EndBot closes every open position through ExecuteTrade, so the closes are
+// journaled, and stops the bot. A failed close doesn't stop the others, the
+// errors of all the pairs are returned together.
 func (runner *Runner) EndBot() error {
 	addr, err := runner.Bot.GetAddress()
 
@@ -92,21 +282,46 @@ func (runner *Runner) EndBot() error {
 		return err
 	}
 
+	ctx := context.Background()
+
+	if err = runner.Bot.FetchPositions(addr.String(), ctx); err != nil {
+		return err
+	}
+
+	// Prices are only the journaled inputs of the closes, which go ahead
+	// without them.
+	if err = runner.Bot.FetchNewPrices(ctx); err != nil {
+		log.Printf("Cannot FetchNewPrices(): %v", err)
+	}
+
 	positionPairs := []string{}
 
-	for pair := range runner.Bot.State.Positions {
-		positionPairs = append(positionPairs, pair)
+	for pair, position := range runner.Bot.State.Positions {
+		if !position.Positon.Size_.IsNil() && !position.Positon.Size_.IsZero() {
+			positionPairs = append(positionPairs, pair)
+		}
 	}
 
-	ctx := context.Background()
+	sort.Strings(positionPairs)
 
+	failures := []string{}
 	for _, pair := range positionPairs {
-		_, err := runner.Bot.ClosePosition(addr, pair, ctx)
-		if err != nil {
-			return err
+		order := runner.Bot.ManualOrder(pair, CloseOrder, sdk.Int{}, sdk.Dec{})
+		if _, err := runner.Bot.ExecuteTrade(order, addr, ctx); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", pair, err))
 		}
 	}
 
+	if runner.Server != nil {
+		runner.Server.IsRunning = false
+		runner.PublishStatus()
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Cannot close %d of %d positions: %s",
+			len(failures), len(positionPairs), strings.Join(failures, "; "))
+	}
+
 	return nil
 }
 
@@ -116,7 +331,8 @@ func QueryTables(bot *Bot) {
 }
 
 func QueryTablesByBlock(bot *Bot, height int64) {
-
+	tables, _ := bot.DB.QueryAllTablesByBlockToJson(height)
+	fmt.Print(tables)
 }
 
 func ClearDB(bot *Bot) {
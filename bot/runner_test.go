@@ -3,6 +3,10 @@ package fbot_test
 import (
 	fbot "fbot/bot"
 	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func (s *BotSuite) TestMain() {
@@ -19,3 +23,34 @@ func (s *BotSuite) TestMain() {
 	fmt.Printf("runner: %v\n", runner)
 
 }
+
+func TestDaemonCommands(t *testing.T) {
+
+	// A free port, closed again for the daemon to listen on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	err = fbot.SendDaemonCommand(addr, fbot.DAEMON_STOP_PATH)
+	require.True(t, fbot.IsDaemonUnreachable(err), "%v", err)
+
+	// Nothing reads the channels, like a daemon busy with an iteration.
+	runner := fbot.Runner{
+		Bot: &fbot.Bot{},
+		Server: &fbot.Server{
+			StopCh:  make(chan bool, 1),
+			PauseCh: make(chan bool, 1),
+			Addr:    addr,
+		},
+	}
+	require.NoError(t, runner.ServeStatus())
+
+	require.NoError(t, fbot.SendDaemonCommand(addr, fbot.DAEMON_STOP_PATH))
+	err = fbot.SendDaemonCommand(addr, fbot.DAEMON_STOP_PATH)
+	require.ErrorContains(t, err, "409")
+	require.False(t, fbot.IsDaemonUnreachable(err))
+	require.Len(t, runner.Server.StopCh, 1)
+
+	require.NoError(t, fbot.SendDaemonCommand(addr, fbot.DAEMON_PAUSE_PATH))
+}
@@ -0,0 +1,128 @@
+package fbot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"gorm.io/gorm"
+)
+
+// Snapshot: The market and account state read in one Run iteration.
+type Snapshot struct {
+	BlockHeight int64
+	BotID       string
+	RunID       string
+	Trader      string
+	Amms        map[string]AmmFields
+	Prices      map[string]Prices
+	Positions   map[string]PositionFields
+	Balances    sdk.Coins
+}
+
+// SaveSnapshot writes a TableSnapshots row, with the NAV of the snapshot's
+// balances and positions, and the amms, prices, positions and balances of
+// snapshot in a single transaction, and returns the row.
+func (botdb *BotDB) SaveSnapshot(snapshot Snapshot) (TableSnapshots, error) {
+
+	row := TableSnapshots{
+		BlockHeight: snapshot.BlockHeight,
+		TakenAt:     time.Now().UTC(),
+		BotID:       snapshot.BotID,
+		RunID:       snapshot.RunID,
+		Trader:      snapshot.Trader,
+		Nav:         snapshot.NAV().Total.String(),
+	}
+
+	err := botdb.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+		if err := createRows(tx, ammRows(snapshot.Amms, snapshot.BlockHeight, row.ID)); err != nil {
+			return err
+		}
+		if err := createRows(tx, priceRows(snapshot.Prices, snapshot.BlockHeight, row.ID)); err != nil {
+			return err
+		}
+		if err := createRows(tx, positionRows(snapshot.Positions, snapshot.BlockHeight, row.ID)); err != nil {
+			return err
+		}
+		return createRows(tx, balanceRows(snapshot.Balances, snapshot.Trader, snapshot.BlockHeight, row.ID))
+	})
+
+	return row, err
+}
+
+// NAV values the balances and positions of snapshot at its prices.
+func (snapshot Snapshot) NAV() NAV {
+	portfolio := Portfolio{
+		Balances:    PortfolioBalances{WalletCoins: snapshot.Balances},
+		BlockNumber: snapshot.BlockHeight,
+	}
+	return portfolio.NAV(snapshot.Prices, snapshot.Positions)
+}
+
+// QuerySnapshots returns the snapshots of query.Trader in the block and time
+// range of query. Snapshots span every pair, so query.Pair is ignored.
+func (botdb *BotDB) QuerySnapshots(query DBQuery) ([]TableSnapshots, error) {
+	var snapshots []TableSnapshots
+	db := botdb.DB.Scopes(query.snapshotScope).Find(&snapshots)
+	return snapshots, db.Error
+}
+
+// NavPoint: The NAV of a bot at one snapshot. Change is the difference to
+// the bot's previous point.
+type NavPoint struct {
+	BlockHeight int64
+	TakenAt     time.Time
+	BotID       string
+	Trader      string
+	Nav         sdk.Dec
+	Change      sdk.Dec
+}
+
+// QueryNav returns the NAV recorded in the snapshots matching query, in
+// block order. Snapshots taken before NAV was recorded are left out.
+func (botdb *BotDB) QueryNav(query DBQuery) ([]NavPoint, error) {
+
+	var snapshots []TableSnapshots
+	err := botdb.DB.Where("nav <> ''").Scopes(query.snapshotScope).Find(&snapshots).Error
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]NavPoint, 0, len(snapshots))
+	last := make(map[string]sdk.Dec)
+
+	for _, snapshot := range snapshots {
+		nav, err := sdk.NewDecFromStr(snapshot.Nav)
+		if err != nil {
+			return nil, fmt.Errorf("Snapshot %d: %w", snapshot.ID, err)
+		}
+		change := sdk.ZeroDec()
+		if previous, exists := last[snapshot.BotID]; exists {
+			change = nav.Sub(previous)
+		}
+		last[snapshot.BotID] = nav
+
+		points = append(points, NavPoint{
+			BlockHeight: snapshot.BlockHeight,
+			TakenAt:     snapshot.TakenAt,
+			BotID:       snapshot.BotID,
+			Trader:      snapshot.Trader,
+			Nav:         nav,
+			Change:      change,
+		})
+	}
+
+	return points, nil
+}
+
+// NewRunID returns a random id for the snapshots of one bot process.
+func NewRunID() string {
+	bz := make([]byte, 8)
+	rand.Read(bz)
+	return hex.EncodeToString(bz)
+}
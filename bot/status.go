@@ -0,0 +1,151 @@
+package fbot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+type RunState string
+
+const (
+	RunStateStopped RunState = "stopped"
+	RunStateRunning RunState = "running"
+	RunStatePaused  RunState = "paused"
+)
+
+// BotStatus: Snapshot of what the bot holds, served by the daemon and printed
+// by the status command.
+type BotStatus struct {
+	Address     string
+	BlockHeight int64
+	RunState    RunState
+	// Source: "daemon" if served by a running bot, "chain" if queried directly.
+	Source      string
+	Positions   []PositionStatus
+	WalletCoins sdk.Coins
+	// Nav: Total NAV in NAV_DENOM, see Portfolio.NAV.
+	Nav sdk.Dec
+	// BalanceDiffs: Where the bot's local balances differed from the chain
+	// at the last refresh.
+	BalanceDiffs []BalanceDiff `json:",omitempty"`
+	// BreakerTrip: Why a circuit breaker stopped the bot, if one did.
+	BreakerTrip string `json:",omitempty"`
+	UpdatedAt   time.Time
+}
+
+type PositionStatus struct {
+	Pair          string
+	Size          sdk.Dec
+	EntryPrice    sdk.Dec
+	MarkPrice     sdk.Dec
+	IndexPrice    sdk.Dec
+	UnrealizedPnl sdk.Dec
+	MarginRatio   sdk.Dec
+	// MaintenanceMarginRatio: Margin ratio at which the market liquidates.
+	MaintenanceMarginRatio sdk.Dec
+	// LiquidationDistance: MarginRatio minus MaintenanceMarginRatio.
+	LiquidationDistance sdk.Dec
+	// IsAgainstMarket: True if the position pays funding, see IsPosAgainstMarket.
+	IsAgainstMarket bool
+}
+
+// FundingDirection: "paying" or "receiving" funding on the position.
+func (pos PositionStatus) FundingDirection() string {
+	if pos.IsAgainstMarket {
+		return "paying"
+	}
+	return "receiving"
+}
+
+// BuildStatus summarizes the bot's current state. Positions with zero size are
+// left out.
+func (bot *Bot) BuildStatus(runState RunState) (BotStatus, error) {
+
+	addr, err := bot.GetAddress()
+	if err != nil {
+		return BotStatus{}, err
+	}
+
+	positions := []PositionStatus{}
+
+	for pair, posField := range bot.State.Positions {
+		size := posField.Positon.Size_
+		if size.IsNil() || size.IsZero() {
+			continue
+		}
+
+		prices := bot.State.Prices[pair]
+		margin := EvaluateMargin(pair, posField, bot.State.Amms[pair].Market, MarginPolicy{}, nil)
+
+		positions = append(positions, PositionStatus{
+			Pair:                   pair,
+			Size:                   size,
+			EntryPrice:             posField.Positon.OpenNotional.Quo(size.Abs()),
+			MarkPrice:              prices.MarkPrice,
+			IndexPrice:             prices.IndexPrice,
+			UnrealizedPnl:          posField.UnrealizedPnl,
+			MarginRatio:            margin.MarginRatio,
+			MaintenanceMarginRatio: margin.MaintenanceMarginRatio,
+			LiquidationDistance:    margin.Distance,
+			IsAgainstMarket:        IsPosAgainstMarket(size, prices.MarkPrice, prices.IndexPrice),
+		})
+	}
+
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i].Pair < positions[j].Pair
+	})
+
+	breakerTrip := ""
+	if bot.State.BreakerTrip != nil {
+		breakerTrip = bot.State.BreakerTrip.Error()
+	}
+
+	return BotStatus{
+		Address:      addr.String(),
+		BlockHeight:  bot.State.PortfolioBalances.BlockNumber,
+		RunState:     runState,
+		Source:       "daemon",
+		Positions:    positions,
+		WalletCoins:  bot.State.PortfolioBalances.Balances.WalletCoins,
+		Nav:          bot.State.PortfolioBalances.NAV(bot.State.Prices, bot.State.Positions).Total,
+		BalanceDiffs: bot.State.BalanceDiffs,
+		BreakerTrip:  breakerTrip,
+		UpdatedAt:    time.Now().UTC(),
+	}, nil
+}
+
+// FetchStatus queries prices, positions and balances from chain and builds a
+// status from them, without trading or writing to the DB.
+func (bot *Bot) FetchStatus(ctx context.Context) (BotStatus, error) {
+
+	if err := bot.FetchNewPrices(ctx); err != nil {
+		return BotStatus{}, fmt.Errorf("Cannot FetchNewPrices(): %s", err)
+	}
+
+	addr, err := bot.GetAddress()
+	if err != nil {
+		return BotStatus{}, fmt.Errorf("Cannot QueryAddress(): %s", err)
+	}
+
+	// The bot had no local view to reconcile with the chain, so every coin
+	// would be reported as a difference.
+	if _, err = bot.RefreshBalances(ctx, addr); err != nil {
+		return BotStatus{}, err
+	}
+	bot.State.BalanceDiffs = nil
+
+	height, err := bot.GetBlockHeight(ctx, bot.TmrpcAddr)
+	if err != nil {
+		return BotStatus{}, fmt.Errorf("Cannot GetHeight(): %s", err)
+	}
+	bot.State.PortfolioBalances.BlockNumber = height
+
+	status, err := bot.BuildStatus(RunStateStopped)
+	status.Source = "chain"
+
+	return status, err
+}
@@ -0,0 +1,258 @@
+package fbot
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	perpTypes "github.com/NibiruChain/nibiru/x/perp/v2/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// Throttle: Limits on how often the strategy trades, enforced by PlanTrade
+// before the risk limits. Exits and margin txs are not throttled, but their
+// orders count towards the rate limits. A zero field is not enforced.
+type Throttle struct {
+	// MinHold: Time a position is held before the strategy may close it.
+	MinHold time.Duration
+	// Cooldown: Time after a close before the strategy may open the pair
+	// again.
+	Cooldown time.Duration
+	// MaxOrdersPerHour: Max orders sent over the last hour, all pairs.
+	MaxOrdersPerHour int
+	// MaxPairOrdersPerHour: Max orders sent over the last hour on one pair.
+	MaxPairOrdersPerHour int
+	// Hysteresis: Fraction the trade thresholds of EvaluateTradeAction are
+	// widened by, see ApplyHysteresis.
+	Hysteresis sdk.Dec
+}
+
+// Names of the throttle rules that hold back an order, see ThrottleDecision.
+const (
+	THROTTLE_MIN_HOLD        = "min_hold"
+	THROTTLE_COOLDOWN        = "cooldown"
+	THROTTLE_MAX_ORDERS      = "max_orders_per_hour"
+	THROTTLE_MAX_PAIR_ORDERS = "max_pair_orders_per_hour"
+	THROTTLE_HYSTERESIS      = "hysteresis"
+)
+
+// throttleRateWindow: Window of the order rate limits.
+const throttleRateWindow = time.Hour
+
+// Enabled is false if the throttle never holds back an order.
+func (throttle Throttle) Enabled() bool {
+	return throttle.MinHold > 0 || throttle.Cooldown > 0 || throttle.MaxOrdersPerHour > 0 ||
+		throttle.MaxPairOrdersPerHour > 0 || isSet(throttle.Hysteresis)
+}
+
+// Validate checks that no limit is negative and the hysteresis is below 1.
+func (throttle Throttle) Validate() error {
+	if throttle.MinHold < 0 || throttle.Cooldown < 0 {
+		return fmt.Errorf("Throttle hold time and cooldown can't be negative")
+	}
+	if throttle.MaxOrdersPerHour < 0 || throttle.MaxPairOrdersPerHour < 0 {
+		return fmt.Errorf("Throttle order rates can't be negative")
+	}
+	if !throttle.Hysteresis.IsNil() &&
+		(throttle.Hysteresis.IsNegative() || throttle.Hysteresis.GTE(sdk.OneDec())) {
+		return fmt.Errorf("Throttle %s must be in [0, 1), got %s", THROTTLE_HYSTERESIS, throttle.Hysteresis)
+	}
+	return nil
+}
+
+// Lookback returns how far back the order history matters to the throttle.
+func (throttle Throttle) Lookback() time.Duration {
+	lookback := throttleRateWindow
+	if throttle.MinHold > lookback {
+		lookback = throttle.MinHold
+	}
+	if throttle.Cooldown > lookback {
+		lookback = throttle.Cooldown
+	}
+	return lookback
+}
+
+// ApplyHysteresis turns action into DontTrade unless it still holds with the
+// thresholds of EvaluateTradeAction widened by the hysteresis band: opens
+// need a quote to move of (1 + h) times the threshold, closes less than
+// (1 - h) times it and a market delta of (1 + h) times theirs, and
+// close-and-opens an unrealized PnL of (1 + h) times theirs.
+func (throttle Throttle) ApplyHysteresis(action TradeAction, quoteToMove sdk.Int,
+	amm perpTypes.AMM, position CurrPosStats) TradeAction {
+
+	if !isSet(throttle.Hysteresis) {
+		return action
+	}
+	wider := sdk.OneDec().Add(throttle.Hysteresis)
+	narrower := sdk.OneDec().Sub(throttle.Hysteresis)
+	quote := sdk.NewDecFromInt(quoteToMove).Abs()
+	threshold := amm.QuoteReserve.QuoInt64(TRADE_QUOTE_RESERVE_DIVISOR)
+
+	switch action {
+	case OpenOrder:
+		if quote.LT(threshold.Mul(wider)) {
+			return DontTrade
+		}
+	case CloseOrder:
+		if !quote.LT(threshold.Mul(narrower)) ||
+			!position.MarketDelta.GT(position.CurrIndexPrice.QuoInt64(CLOSE_MARKET_DELTA_DIVISOR).Mul(wider)) {
+			return DontTrade
+		}
+	case CloseAndOpenOrder:
+		if !position.UnrealizedPnl.GT(position.Notional().QuoInt64(CLOSE_AND_OPEN_PNL_DIVISOR).Mul(wider)) {
+			return DontTrade
+		}
+	}
+
+	return action
+}
+
+// OrderActivity: When orders were sent, per pair, from the trades journal
+// and the orders journaled since it was loaded.
+type OrderActivity struct {
+	Orders    map[string][]time.Time
+	LastOpen  map[string]time.Time
+	LastClose map[string]time.Time
+}
+
+// Record adds an order of side on pair sent at. Margin txs count as orders
+// but neither open nor close.
+func (activity *OrderActivity) Record(pair string, side string, at time.Time) {
+
+	if activity.Orders == nil {
+		activity.Orders = make(map[string][]time.Time)
+		activity.LastOpen = make(map[string]time.Time)
+		activity.LastClose = make(map[string]time.Time)
+	}
+
+	activity.Orders[pair] = append(activity.Orders[pair], at)
+	switch side {
+	case SIDE_LONG, SIDE_SHORT:
+		if at.After(activity.LastOpen[pair]) {
+			activity.LastOpen[pair] = at
+		}
+	case SIDE_CLOSE:
+		if at.After(activity.LastClose[pair]) {
+			activity.LastClose[pair] = at
+		}
+	}
+}
+
+// Count returns the orders sent on pair, or on all pairs if pair is empty,
+// after since.
+func (activity OrderActivity) Count(pair string, since time.Time) int {
+	count := 0
+	for orderPair, times := range activity.Orders {
+		if pair != "" && orderPair != pair {
+			continue
+		}
+		for _, at := range times {
+			if at.After(since) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// LoadOrderActivity replaces the bot's OrderActivity with the orders trader
+// journaled since.
+func (bot *Bot) LoadOrderActivity(trader string, since time.Time) error {
+
+	trades, err := bot.DB.QueryTrades(DBQuery{Trader: trader, FromTime: since})
+	if err != nil {
+		return fmt.Errorf("Cannot QueryTrades(): %w", err)
+	}
+	sort.SliceStable(trades, func(i, j int) bool {
+		return trades[i].CreatedAt.Before(trades[j].CreatedAt)
+	})
+
+	activity := OrderActivity{}
+	for _, trade := range trades {
+		activity.Record(trade.Pair, trade.Side, trade.CreatedAt)
+	}
+	bot.State.Orders = activity
+
+	return nil
+}
+
+// ThrottleDecision: What the throttle did to one strategy action.
+type ThrottleDecision struct {
+	Pair      string
+	Requested TradeAction
+	Allowed   TradeAction
+	// Rule: The throttle rule that held back the action, empty if none did.
+	Rule   string
+	Reason string
+}
+
+// Throttled is true if the action was held back in whole or in part.
+func (decision ThrottleDecision) Throttled() bool {
+	return decision.Rule != ""
+}
+
+// CheckOrder holds back action on pair given the orders of activity at now.
+// A close-and-open that may close but not open becomes a CloseOrder, and
+// one that may not close becomes DontTrade.
+func (throttle Throttle) CheckOrder(pair string, action TradeAction, activity OrderActivity,
+	now time.Time) ThrottleDecision {
+
+	decision := ThrottleDecision{Pair: pair, Requested: action, Allowed: action}
+	opens := action == OpenOrder || action == CloseAndOpenOrder
+	closes := action == CloseOrder || action == CloseAndOpenOrder
+	if !opens && !closes {
+		return decision
+	}
+
+	if lastOpen, exists := activity.LastOpen[pair]; closes && throttle.MinHold > 0 && exists {
+		if held := now.Sub(lastOpen); held < throttle.MinHold {
+			decision.Allowed, decision.Rule = DontTrade, THROTTLE_MIN_HOLD
+			decision.Reason = fmt.Sprintf("position held %s of %s", held.Round(time.Second), throttle.MinHold)
+			return decision
+		}
+	}
+
+	if lastClose, exists := activity.LastClose[pair]; opens && throttle.Cooldown > 0 && exists {
+		if since := now.Sub(lastClose); since < throttle.Cooldown {
+			decision.Allowed, decision.Rule = withoutOpenAction(action), THROTTLE_COOLDOWN
+			decision.Reason = fmt.Sprintf("closed %s ago, cooldown %s", since.Round(time.Second), throttle.Cooldown)
+			return decision
+		}
+	}
+
+	txs := 1
+	if action == CloseAndOpenOrder {
+		txs = 2
+	}
+	since := now.Add(-throttleRateWindow)
+	for _, rate := range []struct {
+		rule  string
+		pair  string
+		limit int
+	}{
+		{THROTTLE_MAX_ORDERS, "", throttle.MaxOrdersPerHour},
+		{THROTTLE_MAX_PAIR_ORDERS, pair, throttle.MaxPairOrdersPerHour},
+	} {
+		if rate.limit <= 0 {
+			continue
+		}
+		sent := activity.Count(rate.pair, since)
+		room := rate.limit - sent
+		if room >= txs {
+			continue
+		}
+		decision.Allowed, decision.Rule = DontTrade, rate.rule
+		if room >= 1 {
+			decision.Allowed = withoutOpenAction(action)
+		}
+		decision.Reason = fmt.Sprintf("%d orders sent in the last hour, limit %d", sent, rate.limit)
+		return decision
+	}
+
+	return decision
+}
+
+// withoutOpenAction drops the open leg of action, see TradeOrder.withoutOpen.
+func withoutOpenAction(action TradeAction) TradeAction {
+	return TradeOrder{Action: action}.withoutOpen().Action
+}
@@ -0,0 +1,203 @@
+package fbot
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	coretypes "github.com/cometbft/cometbft/rpc/core/types"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+func (action TradeAction) String() string {
+	switch action {
+	case OpenOrder:
+		return "open"
+	case CloseOrder:
+		return "close"
+	case CloseAndOpenOrder:
+		return "close_and_open"
+	case DontTrade:
+		return "dont_trade"
+	case AddMarginOrder:
+		return "add_margin"
+	case RemoveMarginOrder:
+		return "remove_margin"
+	case StopLossExit:
+		return EXIT_STOP_LOSS
+	case TakeProfitExit:
+		return EXIT_TAKE_PROFIT
+	case TrailingStopExit:
+		return EXIT_TRAILING_STOP
+	}
+	return fmt.Sprintf("TradeAction(%d)", int(action))
+}
+
+// Sides of a journaled order.
+const (
+	SIDE_LONG  = "long"
+	SIDE_SHORT = "short"
+	SIDE_CLOSE = "close"
+	// Sides of the margin txs sent by ManageMargin.
+	SIDE_ADD_MARGIN    = "add_margin"
+	SIDE_REMOVE_MARGIN = "remove_margin"
+)
+
+// TradeOrder: One order planned by PlanTrade, with the strategy inputs
+// that led to it.
+type TradeOrder struct {
+	Pair   string
+	Action TradeAction
+	Side   string
+	// QuoteAmount and Leverage are unset for closes. QuoteAmount is the
+	// margin moved by margin txs.
+	QuoteAmount sdk.Int
+	Leverage    sdk.Dec
+	QuoteToMove sdk.Int
+	Inputs      CurrPosStats
+}
+
+// openLeg and closeLeg return the order for one tx of the action.
+
+func (order TradeOrder) openLeg(quoteAmount sdk.Int, leverage sdk.Dec) TradeOrder {
+	order.Side = SIDE_LONG
+	if quoteAmount.IsNegative() {
+		order.Side = SIDE_SHORT
+	}
+	order.QuoteAmount = quoteAmount.Abs()
+	order.Leverage = leverage
+	return order
+}
+
+func (order TradeOrder) closeLeg() TradeOrder {
+	order.Side = SIDE_CLOSE
+	order.QuoteAmount, order.Leverage = sdk.Int{}, sdk.Dec{}
+	return order
+}
+
+// ManualOrder: An order sent outside of the strategy, by the open, close
+// and close-all commands or by EndBot, with the stats of the pair's
+// position as inputs. quoteAmount is signed as in OpenPosition, and unset
+// with leverage for closes.
+func (bot *Bot) ManualOrder(pair string, action TradeAction, quoteAmount sdk.Int, leverage sdk.Dec) TradeOrder {
+
+	order := TradeOrder{
+		Pair:        pair,
+		Action:      action,
+		QuoteAmount: quoteAmount,
+		Leverage:    leverage,
+	}
+
+	// Like PlanTrade, only an open position has stats, and they need the
+	// pair's prices and market.
+	_, posExists := bot.State.Positions[pair]
+	price, pricesExist := bot.State.Prices[pair]
+	amm, ammExists := bot.State.Amms[pair]
+	if posExists && pricesExist && ammExists && !price.MarkPrice.IsNil() &&
+		!price.IndexPrice.IsNil() && !amm.Markets.PriceMultiplier.IsNil() {
+		order.Inputs = bot.PopulateCurrPosStats(pair)
+	}
+
+	return order
+}
+
+// JournalTrade records an order and its outcome in the trades journal. For
+// txs that passed CheckTx it waits for inclusion and reads the fill and
+// position changes from the tx result. It counts the txs that failed in a
+// row in State.FailedTxs and adds the order to State.Orders.
+//
+// It returns the delivered tx, nil if it wasn't sent or included, whose code
+// tells whether it succeeded even when the journal can't be written.
+func (bot *Bot) JournalTrade(ctx context.Context, trader sdk.AccAddress,
+	order TradeOrder, resp *sdk.TxResponse, txErr error) (*coretypes.ResultTx, error) {
+
+	trade := TableTrades{
+		Pair:            order.Pair,
+		Trader:          trader.String(),
+		Action:          order.Action.String(),
+		Side:            order.Side,
+		QuoteAmount:     decString(order.QuoteAmount),
+		Leverage:        decString(order.Leverage),
+		QuoteToMove:     decString(order.QuoteToMove),
+		MarkPrice:       decString(order.Inputs.CurrMarkPrice),
+		IndexPrice:      decString(order.Inputs.CurrIndexPrice),
+		PositionSize:    decString(order.Inputs.CurrSize),
+		MarketDelta:     decString(order.Inputs.MarketDelta),
+		UnrealizedPnl:   decString(order.Inputs.UnrealizedPnl),
+		IsAgainstMarket: order.Inputs.IsAgainstMarket,
+	}
+	if txErr != nil {
+		trade.Error = txErr.Error()
+	}
+
+	if resp != nil {
+		trade.TxHash = resp.TxHash
+		trade.BlockHeight = resp.Height
+		trade.Code = resp.Code
+		trade.RawLog = resp.RawLog
+		trade.GasUsed = resp.GasUsed
+	}
+
+	var resultTx *coretypes.ResultTx
+	if resp != nil && resp.Code == 0 {
+		var err error
+		resultTx, err = bot.WaitForTx(ctx, resp.TxHash)
+		if err != nil {
+			trade.Error = err.Error()
+		} else {
+			trade.BlockHeight = resultTx.Height
+			trade.Code = resultTx.TxResult.Code
+			trade.RawLog = resultTx.TxResult.Log
+			trade.GasUsed = resultTx.TxResult.GasUsed
+
+			fill, err := ParseTradeFill(resultTx.TxResult)
+			if err != nil {
+				trade.Error = fmt.Sprintf("Cannot ParseTradeFill(): %s", err)
+			}
+			trade.FilledBase = fill.FilledBase.String()
+			trade.AvgPrice = fill.AvgPrice().String()
+			trade.Fee = fill.Fee.String()
+
+			changes, err := PositionChangeRows(trader.String(), resultTx.Height,
+				resp.TxHash, EVENT_SOURCE_TX, resultTx.TxResult.Events)
+			if err == nil && len(changes) > 0 {
+				// Without the block time RoundTrips falls back to when the
+				// change was recorded, which is close for a journaled tx.
+				if block, blockErr := bot.Gosdk.CometRPC.Block(ctx, &resultTx.Height); blockErr == nil {
+					for i := range changes {
+						changes[i].BlockTime = block.Block.Time.UTC()
+					}
+				}
+				err = bot.DB.RecordPositionChanges(changes)
+			}
+			if err != nil {
+				trade.Error = fmt.Sprintf("Cannot RecordPositionChanges(): %s", err)
+			}
+		}
+	}
+
+	if trade.Error != "" || trade.Code != 0 || resp == nil {
+		bot.State.FailedTxs++
+	} else {
+		bot.State.FailedTxs = 0
+	}
+
+	err := bot.DB.RecordTrade(&trade)
+	bot.State.Orders.Record(trade.Pair, trade.Side, time.Now())
+	return resultTx, err
+}
+
+// decString formats an sdk.Dec or sdk.Int, or returns "" if it is unset.
+func decString(value fmt.Stringer) string {
+	switch value := value.(type) {
+	case sdk.Dec:
+		if value.IsNil() {
+			return ""
+		}
+	case sdk.Int:
+		if value.IsNil() {
+			return ""
+		}
+	}
+	return value.String()
+}
@@ -0,0 +1,198 @@
+package fbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// TWAPSchedule: How Run slices opening orders of at least MinQuote
+// into Slices child orders, one every Blocks blocks, or every Interval if
+// Blocks is zero. Zero Slices or MinQuote disables slicing.
+type TWAPSchedule struct {
+	MinQuote sdk.Int
+	Slices   int
+	Blocks   int64
+	Interval time.Duration
+}
+
+// Enabled is false if no order is sliced.
+func (schedule TWAPSchedule) Enabled() bool {
+	return schedule.Slices > 1 && !schedule.MinQuote.IsNil() && schedule.MinQuote.IsPositive()
+}
+
+// Validate checks that an enabled schedule has a wait between slices.
+func (schedule TWAPSchedule) Validate() error {
+	if schedule.Slices < 0 || schedule.Blocks < 0 || schedule.Interval < 0 {
+		return fmt.Errorf("TWAP slices, blocks and interval can't be negative")
+	}
+	if schedule.Enabled() && schedule.Blocks == 0 && schedule.Interval == 0 {
+		return fmt.Errorf("TWAP needs a number of blocks or an interval between slices")
+	}
+	return nil
+}
+
+// Applies is true if the open leg of order is sliced.
+func (schedule TWAPSchedule) Applies(order TradeOrder) bool {
+	if !schedule.Enabled() || order.QuoteAmount.IsNil() {
+		return false
+	}
+	if order.Action != OpenOrder && order.Action != CloseAndOpenOrder {
+		return false
+	}
+	return order.QuoteAmount.Abs().GTE(schedule.MinQuote)
+}
+
+// TWAPSlice returns the next child order of a TWAP with remaining quote
+// left to send in slicesLeft slices, given the latest quote to move target
+// and quote reserve of the pair. The remaining amount never grows past the
+// target, and the last slice sends all of it. It returns a reason instead if
+// the TWAP should stop: the target changed side or the mark/index gap is
+// too small to trade, see ShouldNotTrade.
+func TWAPSlice(remaining sdk.Int, slicesLeft int, target sdk.Dec, quoteReserve sdk.Dec) (sdk.Int, string) {
+
+	if remaining.IsZero() || slicesLeft <= 0 {
+		return sdk.ZeroInt(), "nothing left to send"
+	}
+	if target.IsNil() || target.IsNegative() != remaining.IsNegative() || target.IsZero() {
+		return sdk.ZeroInt(), fmt.Sprintf("target %s changed side", target)
+	}
+	if ShouldNotTrade(target, quoteReserve) {
+		return sdk.ZeroInt(), fmt.Sprintf("mark/index gap closed, target %s", target.RoundInt())
+	}
+
+	left := remaining.Abs()
+	if targetAbs := target.Abs().TruncateInt(); targetAbs.LT(left) {
+		left = targetAbs
+	}
+
+	child := left
+	if slicesLeft > 1 {
+		child = left.QuoRaw(int64(slicesLeft))
+	}
+	if remaining.IsNegative() {
+		child = child.Neg()
+	}
+
+	return child, ""
+}
+
+// TWAPResult: What a TWAP sent of an order.
+type TWAPResult struct {
+	Pair string
+	// Target: Signed quote amount of the order's open leg.
+	Target sdk.Int
+	// Executed: Signed quote amount of the child orders that went through.
+	Executed sdk.Int
+	Slices   int
+	// Aborted: Why the TWAP stopped before its last slice, if it did.
+	Aborted string
+}
+
+// TWAPOrder: A sliced order in progress. Run sends at most one of its
+// slices per iteration, so the daemon handles pause and stop commands
+// between slices.
+type TWAPOrder struct {
+	Order    TradeOrder
+	Schedule TWAPSchedule
+	// Remaining: Signed quote amount left to send.
+	Remaining  sdk.Int
+	SlicesLeft int
+	// NextBlock, NextTime: When the next slice is due.
+	NextBlock int64
+	NextTime  time.Time
+	Result    TWAPResult
+}
+
+// Due is true if the next slice of twap can be sent at height and now.
+func (twap *TWAPOrder) Due(height int64, now time.Time) bool {
+	return height >= twap.NextBlock && !now.Before(twap.NextTime)
+}
+
+// finish logs what twap sent, stopped early for reason if not empty, and
+// returns true.
+func (twap *TWAPOrder) finish(reason string) bool {
+	twap.Result.Aborted = reason
+	log.Printf("TWAP on %s: sent %s of %s in %d slices%s", twap.Result.Pair,
+		twap.Result.Executed, twap.Result.Target, twap.Result.Slices, abortedSuffix(reason))
+	return true
+}
+
+func abortedSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ", stopped: " + reason
+}
+
+// StartTWAP sends the close leg of a CloseAndOpenOrder, journaling it, and
+// returns the TWAP of the open leg of order following schedule. Its first
+// slice is due right away.
+func (bot *Bot) StartTWAP(ctx context.Context, trader sdk.AccAddress, order TradeOrder,
+	schedule TWAPSchedule) (*TWAPOrder, error) {
+
+	if order.Action == CloseAndOpenOrder {
+		closeResp, err := bot.ClosePosition(trader, order.Pair, ctx)
+		bot.journalTrade(ctx, trader, order.closeLeg(), closeResp, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &TWAPOrder{
+		Order:      order,
+		Schedule:   schedule,
+		Remaining:  order.QuoteAmount,
+		SlicesLeft: schedule.Slices,
+		Result:     TWAPResult{Pair: order.Pair, Target: order.QuoteAmount, Executed: sdk.ZeroInt()},
+	}, nil
+}
+
+// ExecuteTWAPSlice sends the next slice of twap if it is due at height,
+// given the latest quote to move target of the pair, see TWAPSlice, and
+// schedules the one after. The child order is journaled. It returns true
+// once the TWAP is done: its last slice was sent, TWAPSlice stopped it, or
+// the child order failed.
+func (bot *Bot) ExecuteTWAPSlice(ctx context.Context, trader sdk.AccAddress, twap *TWAPOrder,
+	target sdk.Dec, height int64) (bool, error) {
+
+	now := bot.now()
+	if !twap.Due(height, now) {
+		return false, nil
+	}
+
+	pair := twap.Order.Pair
+	child, reason := TWAPSlice(twap.Remaining, twap.SlicesLeft, target,
+		bot.State.Amms[pair].Markets.QuoteReserve)
+	if reason != "" {
+		return twap.finish(reason), nil
+	}
+
+	twap.SlicesLeft--
+	if twap.Schedule.Blocks > 0 {
+		twap.NextBlock = height + twap.Schedule.Blocks
+	} else {
+		twap.NextTime = now.Add(twap.Schedule.Interval)
+	}
+
+	if !child.IsZero() {
+		txResp, err := bot.OpenPosition(trader, child, twap.Order.Leverage, pair, ctx)
+		bot.journalTrade(ctx, trader, twap.Order.openLeg(child, twap.Order.Leverage), txResp, err)
+		twap.Result.Slices++
+		if err != nil {
+			return twap.finish(err.Error()), err
+		}
+		if txResp.Code == 0 {
+			twap.Result.Executed = twap.Result.Executed.Add(child)
+			twap.Remaining = twap.Remaining.Sub(child)
+		}
+	}
+
+	if twap.SlicesLeft == 0 {
+		return twap.finish(""), nil
+	}
+	return false, nil
+}
@@ -0,0 +1,155 @@
+package cli
+
+import (
+	"encoding/json"
+	"fbot/backtest"
+	fbot "fbot/bot"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/urfave/cli"
+)
+
+func backtestCommand() cli.Command {
+	return cli.Command{
+		// go run main.go backtest --from-block 100 --wallet 1000000000unusd,10000000unibi
+		Name:  "backtest",
+		Usage: "Replay the recorded market snapshots through the strategy and print its trades, equity and stats",
+		Flags: append(append([]cli.Flag{
+			jsonFlag,
+			cli.StringFlag{Name: "wallet", Value: "1000000000unusd,100000000unibi",
+				Usage: "starting coins, including unibi for the tx fees"},
+			cli.StringFlag{Name: "fee-ratio", Value: backtest.DEFAULT_FEE_RATIO.String(),
+				Usage: "fraction of the notional charged on every fill"},
+			cli.DurationFlag{Name: "funding-interval", Value: backtest.DEFAULT_FUNDING_INTERVAL,
+				Usage: "length of a funding epoch"},
+		}, dbFlags...), dbFilterFlags...),
+		Action: backtestAction,
+	}
+}
+
+func backtestAction(c *cli.Context) error {
+
+	config, err := backtestConfigFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	query, err := dbQueryFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	steps, err := backtest.LoadSteps(&botdb, query)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		return fmt.Errorf("No market snapshots in range")
+	}
+
+	result, err := backtest.Run(steps, config)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		bz, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bz))
+		return nil
+	}
+
+	summary := result.Summary
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Blocks:\t%d -> %d (%d steps)\n", steps[0].Block, steps[len(steps)-1].Block, summary.Steps)
+	fmt.Fprintf(w, "Equity:\t%s -> %s\n", formatDec(summary.StartEquity), formatDec(summary.EndEquity))
+	fmt.Fprintf(w, "Total return:\t%.4f%%\n", summary.TotalReturn*100)
+	fmt.Fprintf(w, "Max drawdown:\t%.4f%%\n", summary.MaxDrawdown*100)
+	fmt.Fprintf(w, "Trades:\t%d\n", summary.Trades)
+	fmt.Fprintf(w, "Round trips:\t%d (%d won, %d lost)\n", summary.RoundTrips, summary.Wins, summary.Losses)
+	fmt.Fprintf(w, "Win rate:\t%.2f%%\n", summary.WinRate*100)
+	fmt.Fprintf(w, "Realized PnL:\t%s\n", formatDec(summary.RealizedPnl))
+	fmt.Fprintf(w, "Funding PnL:\t%s\n", formatDec(summary.FundingPnl))
+	fmt.Fprintf(w, "Fees:\t%s (tx fees %s)\n", formatDec(summary.Fees), summary.TxFees)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Fprintln(w, "BLOCK\tPAIR\tACTION\tSIDE\tNOTIONAL\tBASE\tPRICE\tFEE\tREALIZED PNL")
+	for _, trade := range result.Trades {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", trade.Block, trade.Pair, trade.Action,
+			trade.Side, formatDec(trade.Notional), formatDec(trade.Base), formatDec(trade.Price),
+			formatDec(trade.Fee), formatDec(trade.RealizedPnl))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(result.Adjustments) > 0 {
+		fmt.Println()
+		fmt.Fprintln(w, "BLOCK\tPAIR\tACTION\tREQUESTED\tFILLED\tREASON")
+		for _, adjustment := range result.Adjustments {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", adjustment.Block, adjustment.Pair,
+				adjustment.Action, adjustment.Requested, adjustment.Filled, adjustment.Reason)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println()
+	fmt.Fprintln(w, "BLOCK\tTIME\tEQUITY")
+	for _, point := range result.Equity {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", point.Block, point.Time.Format("2006-01-02 15:04:05"),
+			formatDec(point.Equity))
+	}
+
+	return w.Flush()
+}
+
+// backtestConfigFromFlags reads the simulated account from the flags, and
+// the risk limits, throttle and exit rules from the config file, if there
+// is one, so that the backtest trades like the bot. A config file that
+// can't be read is an error.
+func backtestConfigFromFlags(c *cli.Context) (backtest.Config, error) {
+
+	config := backtest.Config{FundingInterval: c.Duration("funding-interval")}
+
+	var err error
+	if config.Wallet, err = sdk.ParseCoinsNormalized(c.String("wallet")); err != nil {
+		return config, fmt.Errorf("Invalid --wallet: %w", err)
+	}
+	if config.FeeRatio, err = sdk.NewDecFromStr(c.String("fee-ratio")); err != nil || config.FeeRatio.IsNegative() {
+		return config, fmt.Errorf("--fee-ratio must be a non negative number, got %q", c.String("fee-ratio"))
+	}
+
+	botConfig, err := fbot.Load()
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, fmt.Errorf("Cannot read the config file %s: %w", fbot.EnvFilePath(), err)
+	}
+	if config.RiskLimits, err = botConfig.RiskLimits(); err != nil {
+		return config, err
+	}
+	if config.Throttle, err = botConfig.Throttle(); err != nil {
+		return config, err
+	}
+	if config.ExitRules, err = botConfig.ExitRules(); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
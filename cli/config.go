@@ -0,0 +1,309 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	fbot "fbot/bot"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Unique-Divine/gonibi"
+	"github.com/cosmos/cosmos-sdk/crypto/hd"
+	"github.com/cosmos/cosmos-sdk/crypto/keyring"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/urfave/cli"
+)
+
+func configCommand() cli.Command {
+	return cli.Command{
+		Name:  "config",
+		Usage: "Manage the bot config stored in " + fbot.ENV_FILENAME,
+		Subcommands: []cli.Command{
+			{
+				// go run main.go config init
+				Name:   "init",
+				Usage:  "Interactively create the config file",
+				Action: configInit,
+			},
+			{
+				// go run main.go config show
+				Name:  "show",
+				Usage: "Print the config with secrets redacted",
+				Flags: []cli.Flag{
+					cli.BoolFlag{Name: "json", Usage: "print as JSON"},
+				},
+				Action: configShow,
+			},
+			{
+				// go run main.go config set CHAIN_ID=nibiru-localnet-0 DB_DSN=
+				Name:      "set",
+				Usage:     "Set one or more config fields, KEY= clears one",
+				ArgsUsage: "KEY=VALUE [KEY=VALUE...]",
+				Action:    configSet,
+			},
+			{
+				// go run main.go config validate
+				Name:  "validate",
+				Usage: "Check that every field is set and the mnemonic is valid",
+				Flags: []cli.Flag{
+					cli.BoolFlag{Name: "connect", Usage: "also dial the gRPC endpoint and the DB"},
+				},
+				Action: configValidate,
+			},
+			{
+				// go run main.go config reset
+				Name:   "reset",
+				Usage:  "Delete the config file",
+				Flags:  []cli.Flag{yesFlag},
+				Action: configReset,
+			},
+		},
+	}
+}
+
+// loadOrEmptyConfig loads the config file, or returns an empty config if
+// there is no file yet.
+func loadOrEmptyConfig() (*fbot.BotConfig, error) {
+	config, err := fbot.Load()
+	if os.IsNotExist(err) {
+		return &fbot.BotConfig{}, nil
+	}
+	return config, err
+}
+
+func configInit(c *cli.Context) error {
+
+	reader := bufio.NewReader(os.Stdin)
+
+	oldConfig, err := loadOrEmptyConfig()
+	if err != nil {
+		return err
+	}
+
+	if oldConfig.MNEMONIC != "" {
+		overwrite, err := confirm(reader, fmt.Sprintf(
+			"%s already has a mnemonic. Overwrite it?", fbot.EnvFilePath()))
+		if err != nil || !overwrite {
+			return err
+		}
+	}
+
+	config := fbot.LoadDefaultNetwork("")
+	for key, value := range oldConfig.ToMap() {
+		if value != "" {
+			config.SetField(key, value)
+		}
+	}
+
+	if config.CHAIN_ID, err = promptLine(reader, "Chain ID", config.CHAIN_ID); err != nil {
+		return err
+	}
+	if config.GRPC_ENDPOINT, err = promptLine(reader, "gRPC endpoint", config.GRPC_ENDPOINT); err != nil {
+		return err
+	}
+	if config.TMRPC_ENDPOINT, err = promptLine(reader, "Tendermint RPC endpoint", config.TMRPC_ENDPOINT); err != nil {
+		return err
+	}
+
+	mnemonic, err := promptSecret(reader, "Mnemonic (leave empty to generate a new one)")
+	if err != nil {
+		return err
+	}
+
+	if mnemonic == "" {
+		mnemonic, err = newMnemonic()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nGenerated mnemonic, store it somewhere safe:\n\n%s\n\n", mnemonic)
+	}
+	config.MNEMONIC = mnemonic
+
+	if err = config.CheckConfig(); err != nil {
+		return fmt.Errorf("Invalid config, nothing saved: %w", err)
+	}
+
+	if _, err = config.Save(); err != nil {
+		return err
+	}
+
+	addr, err := config.Address()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved config to %s\n", fbot.EnvFilePath())
+	fmt.Printf("Bot address: %s\n", addr)
+
+	return nil
+}
+
+func configShow(c *cli.Context) error {
+
+	config, err := fbot.Load()
+	if err != nil {
+		return err
+	}
+
+	redacted := config.Redacted()
+
+	if c.Bool("json") {
+		bz, err := json.MarshalIndent(redacted, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bz))
+		return nil
+	}
+
+	for _, key := range fbot.ConfigFieldNames() {
+		fmt.Printf("%s=%s\n", key, redacted[key])
+	}
+
+	return nil
+}
+
+func configSet(c *cli.Context) error {
+
+	if c.NArg() == 0 {
+		return fmt.Errorf("Expected at least one KEY=VALUE argument")
+	}
+
+	config := &fbot.BotConfig{}
+	clear := []string{}
+
+	for _, arg := range c.Args() {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			return fmt.Errorf("Expected KEY=VALUE, or KEY= to clear it, got %q", arg)
+		}
+
+		key, value = strings.ToUpper(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if err := config.SetField(key, value); err != nil {
+			return err
+		}
+		if value == "" {
+			clear = append(clear, key)
+		}
+	}
+
+	if config.MNEMONIC != "" {
+		if _, err := config.Address(); err != nil {
+			return fmt.Errorf("Invalid MNEMONIC, nothing saved: %w", err)
+		}
+	}
+
+	saved, err := config.Save(clear...)
+	if err != nil {
+		return err
+	}
+
+	redacted := saved.Redacted()
+	for _, key := range fbot.ConfigFieldNames() {
+		fmt.Printf("%s=%s\n", key, redacted[key])
+	}
+
+	return nil
+}
+
+func configValidate(c *cli.Context) error {
+
+	config, err := fbot.Load()
+	if err != nil {
+		return err
+	}
+
+	if err = config.CheckConfig(); err != nil {
+		return err
+	}
+
+	addr, err := config.Address()
+	if err != nil {
+		return err
+	}
+
+	switch driver := config.DBDriver(); driver {
+	case fbot.DB_DRIVER_SQLITE:
+	case fbot.DB_DRIVER_POSTGRES:
+		if config.DB_DSN == "" {
+			return fmt.Errorf("DB_DSN is required for DB_DRIVER=%s", driver)
+		}
+	default:
+		return fmt.Errorf("DB_DRIVER must be %s or %s, got %q",
+			fbot.DB_DRIVER_SQLITE, fbot.DB_DRIVER_POSTGRES, driver)
+	}
+
+	if _, err = config.RetentionPolicies(); err != nil {
+		return err
+	}
+	if _, err = config.PruneInterval(); err != nil {
+		return fmt.Errorf("PRUNE_INTERVAL: %w", err)
+	}
+	if _, err = config.MinGasBalance(); err != nil {
+		return err
+	}
+	if _, err = config.MarginPolicy(); err != nil {
+		return err
+	}
+	if _, err = config.Throttle(); err != nil {
+		return err
+	}
+	if _, err = config.TWAPSchedule(); err != nil {
+		return err
+	}
+	if _, err = config.RiskLimits(); err != nil {
+		return err
+	}
+	if _, err = config.CircuitBreakers(); err != nil {
+		return err
+	}
+	if _, err = config.ExitRules(); err != nil {
+		return err
+	}
+
+	if c.Bool("connect") {
+		grpcConn, err := gonibi.GetGRPCConnection(config.GRPC_ENDPOINT, true, 5)
+		if err != nil {
+			return err
+		}
+		grpcConn.Close()
+
+		botdb := new(fbot.BotDB)
+		if err = botdb.Open(config.DBDriver(), config.DBDSN()); err != nil {
+			return err
+		}
+		sqlDB, err := botdb.DB.DB()
+		if err != nil {
+			return err
+		}
+		defer sqlDB.Close()
+		if err = sqlDB.Ping(); err != nil {
+			return fmt.Errorf("Cannot reach DB %s: %w", botdb.Name, err)
+		}
+	}
+
+	fmt.Printf("Config is valid, bot address: %s\n", addr)
+
+	return nil
+}
+
+func configReset(c *cli.Context) error {
+
+	if !c.Bool("yes") {
+		reset, err := confirm(bufio.NewReader(os.Stdin),
+			fmt.Sprintf("Delete %s?", fbot.EnvFilePath()))
+		if err != nil || !reset {
+			return err
+		}
+	}
+
+	return fbot.DeleteConfigFile()
+}
+
+func newMnemonic() (string, error) {
+	_, mnemonic, err := gonibi.NewKeyring().NewMnemonic(
+		fbot.KEY_NAME, keyring.English, sdk.FullFundraiserPath, "", hd.Secp256k1,
+	)
+	return mnemonic, err
+}
@@ -0,0 +1,652 @@
+package cli
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	fbot "fbot/bot"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// dbFlags select the DB, see connectDB.
+var dbFlags = []cli.Flag{
+	cli.StringFlag{Name: "db", Usage: "path of a SQLite file, instead of the configured DB"},
+	cli.StringFlag{Name: "db-driver", Value: fbot.DB_DRIVER_SQLITE, Usage: "driver of --db-dsn: sqlite or postgres"},
+	cli.StringFlag{Name: "db-dsn", Usage: "DSN of the DB, instead of the configured DB"},
+}
+
+// dbTarget picks the DB: --db-driver and --db-dsn, else the SQLite file
+// --db, else DB_DRIVER and DB_DSN of the config file, else bot.db.
+func dbTarget(c *cli.Context) (driver string, dsn string) {
+	if dsn := c.String("db-dsn"); dsn != "" {
+		return c.String("db-driver"), dsn
+	}
+	if file := c.String("db"); file != "" {
+		return fbot.DB_DRIVER_SQLITE, file
+	}
+	if config, err := fbot.Load(); err == nil {
+		return config.DBDriver(), config.DBDSN()
+	}
+	return fbot.DB_DRIVER_SQLITE, fbot.DEFAULT_DB_NAME
+}
+
+// connectDB opens and migrates the DB picked by dbTarget.
+func connectDB(c *cli.Context) (fbot.BotDB, error) {
+	return fbot.CreateAndConnect(dbTarget(c))
+}
+
+// dbFilterFlags select rows by pair, trader, block range and time range, see
+// dbQueryFromFlags.
+var dbFilterFlags = []cli.Flag{
+	cli.StringFlag{Name: "pair", Usage: "only rows for this pair, e.g. ubtc:unusd"},
+	cli.StringFlag{Name: "trader", Usage: "only the account rows of this trader, needed if several bots share the DB"},
+	cli.Int64Flag{Name: "from-block", Usage: "first block height, inclusive"},
+	cli.Int64Flag{Name: "to-block", Usage: "last block height, inclusive"},
+	cli.StringFlag{Name: "from-time", Usage: "earliest row time, RFC3339 or YYYY-MM-DD"},
+	cli.StringFlag{Name: "to-time", Usage: "latest row time, RFC3339 or YYYY-MM-DD for the whole day"},
+}
+
+// dbMetrics are the values accepted by db analyze --metric.
+var dbMetrics = []string{"spread", "balances", "exposure"}
+
+// dbTables are the values accepted by --table, in output order.
+var dbTables = []string{"prices", "amms", "positions", "balances", "trades", "position_changes",
+	"snapshots", "rollups", "breaker_trips"}
+
+func dbCommand() cli.Command {
+	return cli.Command{
+		Name:  "db",
+		Usage: "Inspect the bot's database",
+		Subcommands: []cli.Command{
+			{
+				// go run main.go db query --table prices --pair ubtc:unusd --from-block 100
+				Name:  "query",
+				Usage: "Print rows filtered by table, pair, block range and time range",
+				Flags: append(append([]cli.Flag{
+					cli.StringFlag{Name: "table", Value: "all", Usage: strings.Join(dbTables, ", ") + " or all"},
+					cli.StringFlag{Name: "output, o", Value: "table", Usage: "table, json or csv"},
+				}, dbFlags...), dbFilterFlags...),
+				Action: dbQueryAction,
+			},
+			{
+				// go run main.go db analyze --metric spread --from-block 100
+				Name:  "analyze",
+				Usage: "Print spread, balance or exposure aggregates over a range",
+				Flags: append(append([]cli.Flag{
+					cli.StringFlag{Name: "metric", Value: "spread", Usage: strings.Join(dbMetrics, ", ")},
+					cli.StringFlag{Name: "output, o", Value: "table", Usage: "table, json or csv"},
+				}, dbFlags...), dbFilterFlags...),
+				Action: dbAnalyzeAction,
+			},
+			{
+				// go run main.go db stats
+				Name:   "stats",
+				Usage:  "Print row counts and block coverage of each table",
+				Flags:  dbFlags,
+				Action: dbStatsAction,
+			},
+			{
+				// go run main.go db migrate
+				Name:  "migrate",
+				Usage: "Apply pending schema migrations",
+				Flags: append([]cli.Flag{
+					cli.BoolFlag{Name: "status", Usage: "only list pending migrations"},
+				}, dbFlags...),
+				Action: dbMigrateAction,
+			},
+			{
+				// go run main.go db state --height 1234
+				Name:  "state",
+				Usage: "Print the prices, amms, positions and balances the bot saw at a block",
+				Flags: append([]cli.Flag{
+					cli.Int64Flag{Name: "height", Usage: "block height, the latest state at or before it is printed"},
+					cli.StringFlag{Name: "trader", Usage: "state of the bot of this trader, needed if several bots share the DB"},
+					jsonFlag,
+				}, dbFlags...),
+				Action: dbStateAction,
+			},
+			dbExportCommand(),
+			{
+				// go run main.go db import --mode skip other-bot.json
+				Name:      "import",
+				Usage:     "Import rows exported by db query --output json, e.g. from another bot",
+				ArgsUsage: "FILE",
+				Flags: append([]cli.Flag{
+					cli.StringFlag{Name: "mode", Value: string(fbot.IMPORT_SKIP), Usage: "rows already in the DB: skip, overwrite or renumber (insert anyway)"},
+				}, dbFlags...),
+				Action: dbImportAction,
+			},
+			{
+				// go run main.go db prune --policy prices=7d:100,snapshots=30d --vacuum
+				Name:  "prune",
+				Usage: "Downsample and delete rows older than the retention policies",
+				Flags: append([]cli.Flag{
+					cli.StringFlag{Name: "policy", Usage: "TABLE=KEEP[:BLOCKS],... instead of RETENTION, e.g. prices=7d:100"},
+					cli.BoolFlag{Name: "vacuum", Usage: "give the freed space back to the file system"},
+				}, dbFlags...),
+				Action: dbPruneAction,
+			},
+		},
+	}
+}
+
+func dbQueryAction(c *cli.Context) error {
+
+	tables := dbTables
+	if table := c.String("table"); table != "all" {
+		if !containsString(dbTables, table) {
+			return fmt.Errorf("--table must be one of %s or all, got %q",
+				strings.Join(dbTables, ", "), table)
+		}
+		tables = []string{table}
+	}
+
+	output := c.String("output")
+	if output == "csv" && len(tables) > 1 {
+		return fmt.Errorf("--output csv needs a single --table")
+	}
+
+	query, err := dbQueryFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	results := make(map[string]interface{})
+	rows := make(map[string]dbRows)
+
+	for _, table := range tables {
+		results[table], rows[table], err = queryTable(&botdb, table, query)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch output {
+	case "json":
+		var bz []byte
+		if len(tables) == 1 {
+			bz, err = json.MarshalIndent(results[tables[0]], "", "  ")
+		} else {
+			bz, err = json.MarshalIndent(results, "", "  ")
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bz))
+	case "csv":
+		return writeCSV(rows[tables[0]])
+	case "table":
+		for _, table := range tables {
+			fmt.Printf("%s (%d rows)\n", strings.ToUpper(table), len(rows[table].rows))
+			printRows(rows[table])
+			fmt.Println()
+		}
+	default:
+		return fmt.Errorf("--output must be table, json or csv, got %q", output)
+	}
+
+	return nil
+}
+
+func dbAnalyzeAction(c *cli.Context) error {
+
+	query, err := dbQueryFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	var results interface{}
+	var rows dbRows
+
+	switch metric := c.String("metric"); metric {
+	case "spread":
+		stats, err := botdb.QuerySpreadStats(query)
+		if err != nil {
+			return err
+		}
+		results = stats
+		rows.header = []string{"pair", "samples", "min_spread", "max_spread", "avg_spread"}
+		for _, stat := range stats {
+			rows.rows = append(rows.rows, []string{stat.Pair, strconv.FormatInt(stat.Samples, 10),
+				formatFloat(stat.MinSpread), formatFloat(stat.MaxSpread), formatFloat(stat.AvgSpread)})
+		}
+	case "balances":
+		points, err := botdb.QueryCumulativeBalances(query)
+		if err != nil {
+			return err
+		}
+		results = points
+		rows.header = []string{"block_height", "denom", "amount", "change"}
+		for _, point := range points {
+			rows.rows = append(rows.rows, []string{strconv.FormatInt(point.BlockHeight, 10),
+				point.Denom, formatFloat(point.Amount), formatFloat(point.Change)})
+		}
+	case "exposure":
+		points, err := botdb.QueryExposure(query)
+		if err != nil {
+			return err
+		}
+		results = points
+		rows.header = []string{"block_height", "pair", "size", "notional", "unrealized_pnl"}
+		for _, point := range points {
+			rows.rows = append(rows.rows, []string{strconv.FormatInt(point.BlockHeight, 10),
+				point.Pair, formatFloat(point.Size), formatFloat(point.Notional),
+				formatFloat(point.UnrealizedPnl)})
+		}
+	default:
+		return fmt.Errorf("--metric must be one of %s, got %q", strings.Join(dbMetrics, ", "), metric)
+	}
+
+	switch output := c.String("output"); output {
+	case "json":
+		bz, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bz))
+	case "csv":
+		return writeCSV(rows)
+	case "table":
+		printRows(rows)
+	default:
+		return fmt.Errorf("--output must be table, json or csv, got %q", output)
+	}
+
+	return nil
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func dbQueryFromFlags(c *cli.Context) (fbot.DBQuery, error) {
+
+	fromTime, err := parseTimeFlag(c.String("from-time"), false)
+	if err != nil {
+		return fbot.DBQuery{}, fmt.Errorf("Invalid --from-time: %w", err)
+	}
+
+	toTime, err := parseTimeFlag(c.String("to-time"), true)
+	if err != nil {
+		return fbot.DBQuery{}, fmt.Errorf("Invalid --to-time: %w", err)
+	}
+
+	return fbot.DBQuery{
+		Pair:      c.String("pair"),
+		Trader:    c.String("trader"),
+		FromBlock: c.Int64("from-block"),
+		ToBlock:   c.Int64("to-block"),
+		FromTime:  fromTime,
+		ToTime:    toTime,
+	}, nil
+}
+
+// queryTable returns the rows of table both as records, for JSON, and as
+// DBRows, for table and CSV output.
+func queryTable(botdb *fbot.BotDB, table string, query fbot.DBQuery) (interface{}, dbRows, error) {
+
+	switch table {
+	case "prices":
+		records, err := botdb.QueryPrices(query)
+		rows := dbRows{header: fbot.TablePrices{}.Header()}
+		for _, record := range records {
+			rows.rows = append(rows.rows, record.Row())
+		}
+		return records, rows, err
+	case "amms":
+		records, err := botdb.QueryAmms(query)
+		rows := dbRows{header: fbot.TableAmms{}.Header()}
+		for _, record := range records {
+			rows.rows = append(rows.rows, record.Row())
+		}
+		return records, rows, err
+	case "positions":
+		records, err := botdb.QueryPositions(query)
+		rows := dbRows{header: fbot.TablePosition{}.Header()}
+		for _, record := range records {
+			rows.rows = append(rows.rows, record.Row())
+		}
+		return records, rows, err
+	case "balances":
+		records, err := botdb.QueryBalances(query)
+		rows := dbRows{header: fbot.TableBalances{}.Header()}
+		for _, record := range records {
+			rows.rows = append(rows.rows, record.Row())
+		}
+		return records, rows, err
+	case "trades":
+		records, err := botdb.QueryTrades(query)
+		rows := dbRows{header: fbot.TableTrades{}.Header()}
+		for _, record := range records {
+			rows.rows = append(rows.rows, record.Row())
+		}
+		return records, rows, err
+	case "position_changes":
+		records, err := botdb.QueryPositionChanges(query)
+		rows := dbRows{header: fbot.TablePositionChanges{}.Header()}
+		for _, record := range records {
+			rows.rows = append(rows.rows, record.Row())
+		}
+		return records, rows, err
+	case "snapshots":
+		records, err := botdb.QuerySnapshots(query)
+		rows := dbRows{header: fbot.TableSnapshots{}.Header()}
+		for _, record := range records {
+			rows.rows = append(rows.rows, record.Row())
+		}
+		return records, rows, err
+	case "rollups":
+		records, err := botdb.QueryRollups("", query)
+		rows := dbRows{header: fbot.TableRollups{}.Header()}
+		for _, record := range records {
+			rows.rows = append(rows.rows, record.Row())
+		}
+		return records, rows, err
+	case "breaker_trips":
+		records, err := botdb.QueryBreakerTrips(query)
+		rows := dbRows{header: fbot.TableBreakerTrips{}.Header()}
+		for _, record := range records {
+			rows.rows = append(rows.rows, record.Row())
+		}
+		return records, rows, err
+	}
+
+	return nil, dbRows{}, fmt.Errorf("Unknown table %q", table)
+}
+
+// dbRows: Rows of one table, formatted by fbot.DBRow.
+type dbRows struct {
+	header []string
+	rows   [][]string
+}
+
+func dbStatsAction(c *cli.Context) error {
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	stats, err := botdb.Stats()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tROWS\tBLOCKS\tFIRST BLOCK\tLAST BLOCK")
+	for _, table := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", table.Table, table.Rows,
+			table.Blocks, table.MinBlock, table.MaxBlock)
+	}
+
+	return w.Flush()
+}
+
+func dbMigrateAction(c *cli.Context) error {
+
+	botdb := new(fbot.BotDB)
+	if err := botdb.Open(dbTarget(c)); err != nil {
+		return err
+	}
+
+	version, err := botdb.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is at schema version %d\n", botdb.Name, version)
+
+	pending, err := botdb.PendingMigrations()
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		fmt.Println("No pending migrations")
+		return nil
+	}
+
+	if c.Bool("status") {
+		for _, migration := range pending {
+			fmt.Printf("pending %d: %s\n", migration.Version, migration.Name)
+		}
+		return nil
+	}
+
+	applied, err := botdb.Migrate()
+	for _, migration := range applied {
+		fmt.Printf("applied %d: %s\n", migration.Version, migration.Name)
+	}
+
+	return err
+}
+
+func dbStateAction(c *cli.Context) error {
+
+	height := c.Int64("height")
+	if height <= 0 {
+		return fmt.Errorf("--height must be a positive block height")
+	}
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	state, err := botdb.LoadStateAt(height, c.String("trader"))
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		bz, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bz))
+		return nil
+	}
+
+	fmt.Printf("State at block %d (requested %d)\n\n", state.PortfolioBalances.BlockNumber, height)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PAIR\tINDEX PRICE\tMARK PRICE\tBASE RESERVE\tQUOTE RESERVE\tBIAS")
+	for _, pair := range sortedPairs(state) {
+		prices, amm := state.Prices[pair], state.Amms[pair]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", pair, formatDec(prices.IndexPrice),
+			formatDec(prices.MarkPrice), formatDec(amm.Markets.BaseReserve),
+			formatDec(amm.Markets.QuoteReserve), formatDec(amm.Bias))
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POSITION\tTRADER\tSIZE\tUNREALIZED PNL")
+	for _, pair := range sortedPairs(state) {
+		if position, exists := state.Positions[pair]; exists {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", pair, position.Positon.TraderAddress,
+				position.Positon.Size_, position.UnrealizedPnl)
+		}
+	}
+	w.Flush()
+
+	fmt.Println()
+	fmt.Printf("Wallet: %s\n", state.PortfolioBalances.Balances.WalletCoins)
+
+	return nil
+}
+
+// sortedPairs returns the pairs of state's prices, amms and positions.
+func sortedPairs(state fbot.BotState) []string {
+	seen := make(map[string]bool)
+	for pair := range state.Prices {
+		seen[pair] = true
+	}
+	for pair := range state.Amms {
+		seen[pair] = true
+	}
+	for pair := range state.Positions {
+		seen[pair] = true
+	}
+
+	pairs := make([]string, 0, len(seen))
+	for pair := range seen {
+		pairs = append(pairs, pair)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+func dbImportAction(c *cli.Context) error {
+
+	if c.NArg() != 1 {
+		return fmt.Errorf("Usage: db import [--mode skip|overwrite|renumber] FILE")
+	}
+
+	bz, err := os.ReadFile(c.Args().First())
+	if err != nil {
+		return err
+	}
+	records, err := fbot.NewDBRecordsFromString(string(bz))
+	if err != nil {
+		return fmt.Errorf("Cannot parse %s: %w", c.Args().First(), err)
+	}
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	summary, err := botdb.ImportDbRecords(records, fbot.ImportMode(c.String("mode")))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tINSERTED\tUPDATED\tSKIPPED\tFAILED")
+	for _, table := range summary.Tables {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", table.Table, table.Inserted,
+			table.Updated, table.Skipped, table.Failed)
+	}
+	w.Flush()
+
+	for _, failure := range summary.Failures {
+		fmt.Printf("failed %s[%d]: %s\n", failure.Table, failure.Index, failure.Error)
+	}
+	if len(summary.Failures) > 0 {
+		return fmt.Errorf("%d records failed validation and were not imported", len(summary.Failures))
+	}
+
+	return nil
+}
+
+func dbPruneAction(c *cli.Context) error {
+
+	spec := c.String("policy")
+	if spec == "" {
+		if config, err := fbot.Load(); err == nil {
+			spec = config.RETENTION
+		}
+	}
+
+	policies, err := fbot.ParseRetentionPolicies(spec)
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return fmt.Errorf("No retention policy, set RETENTION or pass --policy")
+	}
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	results, err := botdb.Prune(policies, time.Now().UTC())
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tCUTOFF\tROLLUPS\tDELETED")
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", result.Table,
+			result.Cutoff.Format(time.RFC3339), result.Rollups, result.Deleted)
+	}
+	w.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("vacuum") {
+		return botdb.Vacuum()
+	}
+
+	return nil
+}
+
+func printRows(rows dbRows) {
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(rows.header, "\t")))
+	for _, row := range rows.rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+func writeCSV(rows dbRows) error {
+
+	w := csv.NewWriter(os.Stdout)
+	if err := w.Write(rows.header); err != nil {
+		return err
+	}
+	if err := w.WriteAll(rows.rows); err != nil {
+		return err
+	}
+
+	return w.Error()
+}
+
+// parseTimeFlag parses an RFC3339 time or a YYYY-MM-DD date, which is the
+// start of the day, or its last instant if endOfDay, for inclusive upper
+// bounds.
+func parseTimeFlag(value string, endOfDay bool) (time.Time, error) {
+
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+
+	day, err := time.Parse("2006-01-02", value)
+	if err != nil || !endOfDay {
+		return day, err
+	}
+	return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimeFlag(t *testing.T) {
+
+	parsed, err := parseTimeFlag("2023-06-01", false)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC), parsed)
+
+	// A date as upper bound covers the whole day.
+	parsed, err = parseTimeFlag("2023-06-01", true)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 6, 1, 23, 59, 59, 999_999_999, time.UTC), parsed)
+
+	parsed, err = parseTimeFlag("2023-06-01T12:00:00Z", true)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC), parsed)
+
+	parsed, err = parseTimeFlag("", true)
+	require.NoError(t, err)
+	require.True(t, parsed.IsZero())
+
+	_, err = parseTimeFlag("June 1st", false)
+	require.Error(t, err)
+}
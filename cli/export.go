@@ -0,0 +1,215 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	fbot "fbot/bot"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// exportFormats are the values accepted by db export --format.
+var exportFormats = []string{"csv", "jsonl", "parquet"}
+
+func dbExportCommand() cli.Command {
+	return cli.Command{
+		// go run main.go db export --format parquet --table prices --from-block 100 --out prices.parquet
+		Name:  "export",
+		Usage: "Stream the rows of a table as CSV, JSON lines or Parquet",
+		Flags: append(append([]cli.Flag{
+			cli.StringFlag{Name: "table", Usage: strings.Join(fbot.ExportTables, ", ")},
+			cli.StringFlag{Name: "format", Value: "csv", Usage: strings.Join(exportFormats, ", ")},
+			cli.StringFlag{Name: "out", Value: "-", Usage: "file to write, - for stdout"},
+		}, dbFlags...), dbFilterFlags...),
+		Action: dbExportAction,
+	}
+}
+
+func dbExportAction(c *cli.Context) error {
+
+	table := c.String("table")
+	if !containsString(fbot.ExportTables, table) {
+		return fmt.Errorf("--table must be one of %s, got %q",
+			strings.Join(fbot.ExportTables, ", "), table)
+	}
+
+	format := c.String("format")
+	if !containsString(exportFormats, format) {
+		return fmt.Errorf("--format must be one of %s, got %q",
+			strings.Join(exportFormats, ", "), format)
+	}
+
+	query, err := dbQueryFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	columns, err := botdb.ExportColumns(table)
+	if err != nil {
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+	if path := c.String("out"); path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	rowWriter, err := newRowWriter(format, columns, out)
+	if err != nil {
+		return err
+	}
+
+	err = botdb.ExportTable(table, query, rowWriter.WriteRow)
+	if closeErr := rowWriter.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// rowWriter writes the rows of an export in one format. Close must be
+// called once all rows are written.
+type rowWriter interface {
+	WriteRow(row []string) error
+	Close() error
+}
+
+func newRowWriter(format string, columns []fbot.ExportColumn, out io.Writer) (rowWriter, error) {
+	switch format {
+	case "csv":
+		return newCSVRowWriter(columns, out)
+	case "jsonl":
+		return &jsonlRowWriter{columns: columns, w: bufio.NewWriter(out)}, nil
+	case "parquet":
+		return newParquetRowWriter(columns, out)
+	}
+	return nil, fmt.Errorf("Unknown export format %q", format)
+}
+
+// csvRowWriter writes a header line, then the rows as formatted by DBRow.
+type csvRowWriter struct {
+	w *csv.Writer
+}
+
+func newCSVRowWriter(columns []fbot.ExportColumn, out io.Writer) (*csvRowWriter, error) {
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Name
+	}
+	w := csv.NewWriter(out)
+	return &csvRowWriter{w: w}, w.Write(header)
+}
+
+func (rw *csvRowWriter) WriteRow(row []string) error {
+	return rw.w.Write(row)
+}
+
+func (rw *csvRowWriter) Close() error {
+	rw.w.Flush()
+	return rw.w.Error()
+}
+
+// jsonlRowWriter writes one JSON object per row, with the keys in column
+// order. Numbers and booleans are JSON values and decimals exact strings,
+// empty ones null.
+type jsonlRowWriter struct {
+	columns []fbot.ExportColumn
+	w       *bufio.Writer
+}
+
+func (rw *jsonlRowWriter) WriteRow(row []string) error {
+
+	rw.w.WriteByte('{')
+	for i, value := range row {
+		if i > 0 {
+			rw.w.WriteByte(',')
+		}
+		key, _ := json.Marshal(rw.columns[i].Name)
+		rw.w.Write(key)
+		rw.w.WriteByte(':')
+
+		switch kind := rw.columns[i].Kind; {
+		case kind == fbot.EXPORT_KIND_STRING:
+			bz, _ := json.Marshal(value)
+			rw.w.Write(bz)
+		case value == "":
+			rw.w.WriteString("null")
+		case kind == fbot.EXPORT_KIND_DECIMAL:
+			bz, _ := json.Marshal(value)
+			rw.w.Write(bz)
+		default:
+			rw.w.WriteString(value)
+		}
+	}
+	rw.w.WriteString("}\n")
+
+	return nil
+}
+
+func (rw *jsonlRowWriter) Close() error {
+	return rw.w.Flush()
+}
+
+// parquetRowWriter writes a Parquet file with typed int, float and bool
+// columns and UTF8 columns for the rest, decimals included. Empty values
+// other than strings are null.
+type parquetRowWriter struct {
+	columns []fbot.ExportColumn
+	w       *writer.CSVWriter
+}
+
+func newParquetRowWriter(columns []fbot.ExportColumn, out io.Writer) (*parquetRowWriter, error) {
+
+	metadata := make([]string, len(columns))
+	for i, column := range columns {
+		parquetType := "type=BYTE_ARRAY, convertedtype=UTF8"
+		switch column.Kind {
+		case fbot.EXPORT_KIND_INT:
+			parquetType = "type=INT64"
+		case fbot.EXPORT_KIND_FLOAT:
+			parquetType = "type=DOUBLE"
+		case fbot.EXPORT_KIND_BOOL:
+			parquetType = "type=BOOLEAN"
+		}
+		metadata[i] = fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", column.Name, parquetType)
+	}
+
+	w, err := writer.NewCSVWriterFromWriter(metadata, out, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &parquetRowWriter{columns: columns, w: w}, nil
+}
+
+func (rw *parquetRowWriter) WriteRow(row []string) error {
+
+	values := make([]*string, len(row))
+	for i := range row {
+		if row[i] != "" || rw.columns[i].Kind == fbot.EXPORT_KIND_STRING {
+			values[i] = &row[i]
+		}
+	}
+
+	return rw.w.WriteString(values)
+}
+
+func (rw *parquetRowWriter) Close() error {
+	return rw.w.WriteStop()
+}
@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fbot "fbot/bot"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+var exportTestColumns = []fbot.ExportColumn{
+	{Name: "id", Kind: fbot.EXPORT_KIND_INT},
+	{Name: "pair", Kind: fbot.EXPORT_KIND_STRING},
+	{Name: "price", Kind: fbot.EXPORT_KIND_DECIMAL},
+	{Name: "avg", Kind: fbot.EXPORT_KIND_FLOAT},
+	{Name: "ok", Kind: fbot.EXPORT_KIND_BOOL},
+}
+
+var exportTestRows = [][]string{
+	{"1", "ubtc:unusd", "123456789.000000000000000001", "0.25", "true"},
+	{"2", "", "", "", ""},
+}
+
+func writeExportTestRows(t *testing.T, format string) []byte {
+	var out bytes.Buffer
+	rowWriter, err := newRowWriter(format, exportTestColumns, &out)
+	require.NoError(t, err)
+	for _, row := range exportTestRows {
+		require.NoError(t, rowWriter.WriteRow(row))
+	}
+	require.NoError(t, rowWriter.Close())
+	return out.Bytes()
+}
+
+func TestJSONLRowWriterRoundTrip(t *testing.T) {
+
+	out := writeExportTestRows(t, "jsonl")
+
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	require.Len(t, lines, len(exportTestRows))
+	require.True(t, strings.HasPrefix(lines[0], `{"id":1,"pair":"ubtc:unusd","price":"123456789.`))
+
+	for i, line := range lines {
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		object := map[string]interface{}{}
+		require.NoError(t, decoder.Decode(&object))
+
+		row := make([]string, len(exportTestColumns))
+		for j, column := range exportTestColumns {
+			if value := object[column.Name]; value != nil {
+				row[j] = fmt.Sprint(value)
+			}
+		}
+		require.Equal(t, exportTestRows[i], row)
+	}
+}
+
+func TestParquetRowWriterRoundTrip(t *testing.T) {
+
+	out := writeExportTestRows(t, "parquet")
+
+	file := buffer.NewBufferFileFromBytes(out)
+	parquetReader, err := reader.NewParquetReader(file, nil, 1)
+	require.NoError(t, err)
+	defer parquetReader.ReadStop()
+
+	numRows := parquetReader.GetNumRows()
+	require.Equal(t, int64(len(exportTestRows)), numRows)
+
+	rows := make([][]string, numRows)
+	for i := range rows {
+		rows[i] = make([]string, len(exportTestColumns))
+	}
+	for j, column := range exportTestColumns {
+		values, _, _, err := parquetReader.ReadColumnByPath(
+			parquetReader.SchemaHandler.GetRootExName()+"\x01"+column.Name, numRows)
+		require.NoError(t, err)
+		require.Len(t, values, len(exportTestRows))
+		for i, value := range values {
+			if value != nil {
+				rows[i][j] = fmt.Sprint(value)
+			}
+		}
+	}
+	require.Equal(t, exportTestRows, rows)
+}
+
+func TestExportColumnsTrades(t *testing.T) {
+
+	var botdb fbot.BotDB
+	require.NoError(t, botdb.OpenDB(filepath.Join(t.TempDir(), "export.db")))
+
+	columns, err := botdb.ExportColumns("trades")
+	require.NoError(t, err)
+	require.Len(t, fbot.TableTrades{}.Row(), len(columns))
+
+	kinds := make(map[string]string)
+	for _, column := range columns {
+		kinds[column.Name] = column.Kind
+	}
+	// Which bot sent a trade, in a DB shared by several.
+	require.Equal(t, fbot.EXPORT_KIND_STRING, kinds["trader"])
+	require.Equal(t, fbot.EXPORT_KIND_INT, kinds["gas_used"])
+	require.Equal(t, fbot.EXPORT_KIND_STRING, kinds["raw_log"])
+	require.Equal(t, fbot.EXPORT_KIND_INT, kinds["code"])
+	require.Equal(t, fbot.EXPORT_KIND_DECIMAL, kinds["avg_price"])
+}
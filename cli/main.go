@@ -5,69 +5,118 @@ import (
 	"log"
 	"os"
 
+	"github.com/Unique-Divine/gonibi"
 	"github.com/urfave/cli"
 )
 
 func CliMain() {
 
+	gonibi.EnsureNibiruPrefix()
+
 	app := cli.NewApp()
 	app.Name = "Funding Bot"
 
-	runner := fbot.Runner{
-		Bot: &fbot.Bot{},
-		Server: &fbot.Server{
-			StartCh:  make(chan bool),
-			StopCh:   make(chan bool),
-			PauseCh:  make(chan bool),
-			IsPaused: false,
-		},
-	}
-
-	botConfig, err := fbot.Load()
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = runner.SetConfig(*botConfig)
-
-	if err != nil {
-		panic(err)
-	}
-
 	app.Commands = []cli.Command{
 		{
 			// go run main.go start
-			Name: "start",
+			Name:  "start",
+			Usage: "Run the bot as a daemon, serving its status API",
 			Action: func(c *cli.Context) error {
-				runner.Server.StartCh <- true
+				runner, err := newRunner()
+				if err != nil {
+					return err
+				}
+				if err = runner.ServeStatus(); err != nil {
+					return err
+				}
+				go func() { runner.Server.StartCh <- true }()
 				runner.HandleChannels()
 				return nil
 			},
 		},
 		{
 			// go run main.go pause
-			Name: "pause",
+			Name:  "pause",
+			Usage: "Pause the running daemon, or resume it if it is paused",
 			Action: func(c *cli.Context) error {
-				runner.Server.PauseCh <- true
-				runner.HandleChannels()
-				return nil
+				config, err := fbot.Load()
+				if err != nil {
+					return err
+				}
+				return fbot.SendDaemonCommand(config.DaemonAddr(), fbot.DAEMON_PAUSE_PATH)
 			},
 		},
 		{
 			// go run main.go end
-			Name: "end",
+			Name:  "end",
+			Usage: "Close all positions and stop the daemon",
 			Action: func(c *cli.Context) error {
-				runner.Server.StopCh <- true
-				runner.HandleChannels()
-				return nil
+				config, err := fbot.Load()
+				if err != nil {
+					return err
+				}
+				err = fbot.SendDaemonCommand(config.DaemonAddr(), fbot.DAEMON_STOP_PATH)
+				if !fbot.IsDaemonUnreachable(err) {
+					return err
+				}
+
+				// No daemon is running, close the positions from here.
+				runner, err := newRunner()
+				if err != nil {
+					return err
+				}
+				return runner.EndBot()
 			},
 		},
+		// go run main.go status
+		statusCommand(),
+		// go run main.go config ...
+		configCommand(),
+		// go run main.go db ...
+		dbCommand(),
+		// go run main.go report ...
+		reportCommand(),
+		// go run main.go backtest ...
+		backtestCommand(),
 	}
 
-	err = app.Run(os.Args)
+	// go run main.go open|close|close-all ...
+	app.Commands = append(app.Commands, orderCommands()...)
+
+	err := app.Run(os.Args)
 
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+}
+
+// newRunner loads the bot config from the env file and connects a runner
+// with it.
+func newRunner() (*fbot.Runner, error) {
+
+	runner := fbot.Runner{
+		Bot: &fbot.Bot{},
+		Server: &fbot.Server{
+			StartCh: make(chan bool),
+			// Buffered, so the status API can queue a command while an
+			// iteration runs, see ServeStatus.
+			StopCh:   make(chan bool, 1),
+			PauseCh:  make(chan bool, 1),
+			IsPaused: false,
+		},
 	}
+
+	botConfig, err := fbot.Load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = runner.SetConfig(*botConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &runner, nil
 }
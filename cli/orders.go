@@ -0,0 +1,225 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	fbot "fbot/bot"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/NibiruChain/nibiru/x/common/asset"
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/urfave/cli"
+)
+
+var yesFlag = cli.BoolFlag{Name: "yes, y", Usage: "skip the confirmation prompt"}
+
+func orderCommands() []cli.Command {
+	return []cli.Command{
+		{
+			// go run main.go open --pair ubtc:unusd --quote 1000 --side long
+			Name:  "open",
+			Usage: "Open or add to a position with a market order",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "pair", Usage: "market pair, e.g. ubtc:unusd"},
+				cli.StringFlag{Name: "quote", Usage: "quote amount to put in, e.g. 1000"},
+				cli.StringFlag{Name: "leverage", Value: "1", Usage: "leverage of the order"},
+				cli.StringFlag{Name: "side", Usage: "long or short"},
+				yesFlag,
+			},
+			Action: openAction,
+		},
+		{
+			// go run main.go close --pair ubtc:unusd
+			Name:  "close",
+			Usage: "Close the position in a pair",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "pair", Usage: "market pair, e.g. ubtc:unusd"},
+				yesFlag,
+			},
+			Action: closeAction,
+		},
+		{
+			// go run main.go close-all
+			Name:   "close-all",
+			Usage:  "Close every open position",
+			Flags:  []cli.Flag{yesFlag},
+			Action: closeAllAction,
+		},
+	}
+}
+
+func openAction(c *cli.Context) error {
+
+	pair, err := asset.TryNewPair(c.String("pair"))
+	if err != nil {
+		return fmt.Errorf("Invalid --pair: %w", err)
+	}
+
+	quote, ok := sdk.NewIntFromString(c.String("quote"))
+	if !ok || !quote.IsPositive() {
+		return fmt.Errorf("--quote must be a positive integer, got %q", c.String("quote"))
+	}
+
+	leverage, err := sdk.NewDecFromStr(c.String("leverage"))
+	if err != nil || !leverage.IsPositive() {
+		return fmt.Errorf("--leverage must be a positive number, got %q", c.String("leverage"))
+	}
+
+	// OpenPosition picks the side from the sign of the quote amount.
+	switch strings.ToLower(c.String("side")) {
+	case "long":
+	case "short":
+		quote = quote.Neg()
+	default:
+		return fmt.Errorf("--side must be long or short, got %q", c.String("side"))
+	}
+
+	runner, err := newRunner()
+	if err != nil {
+		return err
+	}
+	bot := runner.Bot
+	ctx := context.Background()
+
+	if err = bot.FetchNewPrices(ctx); err != nil {
+		return err
+	}
+
+	if _, exists := bot.State.Amms[pair.String()]; !exists {
+		return fmt.Errorf("No market for pair %s", pair)
+	}
+
+	markPrice := bot.State.Prices[pair.String()].MarkPrice
+	baseLimit := fbot.BaseAssetAmountLimit(quote, leverage, markPrice, bot.MaxSlippage)
+
+	fmt.Printf("Open %s %s %s at %sx leverage on %s\n", strings.ToUpper(c.String("side")),
+		quote.Abs(), pair.QuoteDenom(), formatDec(leverage), pair)
+	fmt.Printf("Mark price: %s, base amount limit: %s\n", formatDec(markPrice), baseLimit)
+
+	if !c.Bool("yes") {
+		proceed, err := confirm(bufio.NewReader(os.Stdin), "Send order?")
+		if err != nil || !proceed {
+			return err
+		}
+	}
+
+	trader, err := bot.GetAddress()
+	if err != nil {
+		return err
+	}
+
+	if err = bot.FetchPositions(trader.String(), ctx); err != nil {
+		return err
+	}
+
+	order := bot.ManualOrder(pair.String(), fbot.OpenOrder, quote, leverage)
+	resp, err := bot.ExecuteTrade(order, trader, ctx)
+	printTxResponse(resp)
+
+	return err
+}
+
+func closeAction(c *cli.Context) error {
+
+	pair, err := asset.TryNewPair(c.String("pair"))
+	if err != nil {
+		return fmt.Errorf("Invalid --pair: %w", err)
+	}
+
+	runner, err := newRunner()
+	if err != nil {
+		return err
+	}
+	bot := runner.Bot
+	ctx := context.Background()
+
+	trader, err := bot.GetAddress()
+	if err != nil {
+		return err
+	}
+
+	if err = bot.FetchPositions(trader.String(), ctx); err != nil {
+		return err
+	}
+
+	position, exists := bot.State.Positions[pair.String()]
+	if !exists || position.Positon.Size_.IsZero() {
+		return fmt.Errorf("No open position in %s", pair)
+	}
+
+	fmt.Printf("Close position of size %s in %s (unrealized PnL %s)\n",
+		formatDec(position.Positon.Size_), pair, formatDec(position.UnrealizedPnl))
+
+	if !c.Bool("yes") {
+		proceed, err := confirm(bufio.NewReader(os.Stdin), "Send order?")
+		if err != nil || !proceed {
+			return err
+		}
+	}
+
+	if err = bot.FetchNewPrices(ctx); err != nil {
+		return err
+	}
+
+	order := bot.ManualOrder(pair.String(), fbot.CloseOrder, sdk.Int{}, sdk.Dec{})
+	resp, err := bot.ExecuteTrade(order, trader, ctx)
+	printTxResponse(resp)
+
+	return err
+}
+
+func closeAllAction(c *cli.Context) error {
+
+	runner, err := newRunner()
+	if err != nil {
+		return err
+	}
+	bot := runner.Bot
+
+	trader, err := bot.GetAddress()
+	if err != nil {
+		return err
+	}
+
+	if err = bot.FetchPositions(trader.String(), context.Background()); err != nil {
+		return err
+	}
+
+	pairs := []string{}
+	for pair, position := range bot.State.Positions {
+		if !position.Positon.Size_.IsZero() {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Strings(pairs)
+
+	if len(pairs) == 0 {
+		fmt.Println("No open positions")
+		return nil
+	}
+
+	fmt.Printf("Close positions in %s\n", strings.Join(pairs, ", "))
+
+	if !c.Bool("yes") {
+		proceed, err := confirm(bufio.NewReader(os.Stdin), "Send orders?")
+		if err != nil || !proceed {
+			return err
+		}
+	}
+
+	return runner.EndBot()
+}
+
+func printTxResponse(resp *sdk.TxResponse) {
+	if resp == nil {
+		return
+	}
+	if resp.Code != 0 {
+		fmt.Printf("Tx %s failed with code %d: %s\n", resp.TxHash, resp.Code, resp.RawLog)
+		return
+	}
+	fmt.Printf("Tx %s included\n", resp.TxHash)
+}
@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// promptLine asks for a value on stdin, returning def when the answer is empty.
+func promptLine(reader *bufio.Reader, label string, def string) (string, error) {
+
+	if def != "" {
+		fmt.Printf("%s [%s]: ", label, def)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return def, nil
+	}
+
+	return answer, nil
+}
+
+// promptSecret asks for a value without echoing it when stdin is a terminal.
+func promptSecret(reader *bufio.Reader, label string) (string, error) {
+
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		return promptLine(reader, label, "")
+	}
+
+	fmt.Printf("%s: ", label)
+	bz, err := term.ReadPassword(fd)
+	fmt.Println()
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(bz)), nil
+}
+
+// confirm asks a yes/no question, defaulting to no.
+func confirm(reader *bufio.Reader, question string) (bool, error) {
+
+	answer, err := promptLine(reader, question+" (y/N)", "")
+	if err != nil {
+		return false, err
+	}
+
+	answer = strings.ToLower(answer)
+
+	return answer == "y" || answer == "yes", nil
+}
@@ -0,0 +1,187 @@
+package cli
+
+import (
+	"encoding/json"
+	fbot "fbot/bot"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func reportCommand() cli.Command {
+	return cli.Command{
+		Name:  "report",
+		Usage: "Report on the bot's recorded results",
+		Subcommands: []cli.Command{
+			{
+				// go run main.go report pnl --from-block 100
+				Name:   "pnl",
+				Usage:  "Print realized, funding and fee PnL per pair and overall",
+				Flags:  append(append([]cli.Flag{jsonFlag}, dbFlags...), dbFilterFlags...),
+				Action: reportPnlAction,
+			},
+			{
+				// go run main.go report nav --from-time 2023-08-01
+				Name:   "nav",
+				Usage:  "Print the NAV recorded at each snapshot and its change",
+				Flags:  append(append([]cli.Flag{jsonFlag}, dbFlags...), dbFilterFlags...),
+				Action: reportNavAction,
+			},
+			{
+				// go run main.go report performance --from-time 2023-08-01 --period 24h
+				Name:  "performance",
+				Usage: "Print returns, drawdown, Sharpe and Sortino ratios, win rate, holding time and PnL per pair",
+				Flags: append(append([]cli.Flag{
+					jsonFlag,
+					cli.StringFlag{Name: "bot-id", Usage: "bot whose NAV to use, needed if several bots share the DB"},
+					cli.DurationFlag{Name: "period", Value: fbot.DEFAULT_RETURN_PERIOD, Usage: "length of the return periods"},
+				}, dbFlags...), dbFilterFlags...),
+				Action: reportPerformanceAction,
+			},
+		},
+	}
+}
+
+var jsonFlag = cli.BoolFlag{Name: "json", Usage: "print as JSON"}
+
+func reportPnlAction(c *cli.Context) error {
+
+	query, err := dbQueryFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	pairs, total, err := botdb.QueryPnl(query)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		bz, err := json.MarshalIndent(map[string]interface{}{
+			"pairs": pairs,
+			"total": total,
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bz))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PAIR\tCHANGES\tREALIZED PNL\tFUNDING PNL\tFEE PNL\tNET PNL")
+	for _, summary := range append(pairs, total) {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", summary.Pair, summary.Changes,
+			formatDec(summary.RealizedPnl), formatDec(summary.FundingPnl),
+			formatDec(summary.FeePnl), formatDec(summary.NetPnl))
+	}
+
+	return w.Flush()
+}
+
+func reportNavAction(c *cli.Context) error {
+
+	query, err := dbQueryFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	points, err := botdb.QueryNav(query)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		bz, err := json.MarshalIndent(points, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bz))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "BLOCK\tTAKEN AT\tBOT\tNAV (%s)\tCHANGE\n", fbot.NAV_DENOM)
+	for _, point := range points {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", point.BlockHeight,
+			point.TakenAt.Format("2006-01-02 15:04:05"), point.BotID,
+			formatDec(point.Nav), formatDec(point.Change))
+	}
+
+	return w.Flush()
+}
+
+func reportPerformanceAction(c *cli.Context) error {
+
+	query, err := dbQueryFromFlags(c)
+	if err != nil {
+		return err
+	}
+
+	botdb, err := connectDB(c)
+	if err != nil {
+		return err
+	}
+
+	report, err := botdb.QueryPerformance(query, c.String("bot-id"), c.Duration("period"))
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		bz, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bz))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Bot:\t%s (%s)\n", report.BotID, report.Trader)
+	fmt.Fprintf(w, "NAV (%s):\t%.6f -> %.6f\n", fbot.NAV_DENOM, report.StartNav, report.EndNav)
+	fmt.Fprintf(w, "Total return:\t%.4f%%\n", report.TotalReturn*100)
+	fmt.Fprintf(w, "Max drawdown:\t%.4f%%\n", report.MaxDrawdown*100)
+	fmt.Fprintf(w, "Sharpe:\t%.4f\n", report.Sharpe)
+	fmt.Fprintf(w, "Sortino:\t%.4f\n", report.Sortino)
+	fmt.Fprintf(w, "Round trips:\t%d (%d won, %d lost)\n", len(report.RoundTrips), report.Wins, report.Losses)
+	fmt.Fprintf(w, "Win rate:\t%.2f%%\n", report.WinRate*100)
+	fmt.Fprintf(w, "Avg holding:\t%s (%.1f blocks)\n",
+		report.AvgHoldingTime.Round(time.Second), report.AvgHoldingBlocks)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Fprintln(w, "PERIOD\tSTART NAV\tEND NAV\tRETURN")
+	for _, periodReturn := range report.Returns {
+		fmt.Fprintf(w, "%s\t%.6f\t%.6f\t%.4f%%\n", periodReturn.Start.Format("2006-01-02 15:04"),
+			periodReturn.StartNav, periodReturn.EndNav, periodReturn.Return*100)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Fprintln(w, "PAIR\tCHANGES\tTRADING PNL\tFUNDING PNL\tFEE PNL\tNET PNL")
+	for _, summary := range append(report.Pairs, report.TotalPnl) {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", summary.Pair, summary.Changes,
+			formatDec(summary.RealizedPnl), formatDec(summary.FundingPnl),
+			formatDec(summary.FeePnl), formatDec(summary.NetPnl))
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	fbot "fbot/bot"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/urfave/cli"
+)
+
+func statusCommand() cli.Command {
+	return cli.Command{
+		// go run main.go status
+		Name:  "status",
+		Usage: "Show positions, PnL and balances, from the daemon if it is running",
+		Flags: []cli.Flag{
+			cli.BoolFlag{Name: "json", Usage: "print as JSON"},
+			cli.BoolFlag{Name: "chain", Usage: "query the chain even if a daemon is running"},
+		},
+		Action: statusAction,
+	}
+}
+
+func statusAction(c *cli.Context) error {
+
+	config, err := fbot.Load()
+	if err != nil {
+		return err
+	}
+
+	var status *fbot.BotStatus
+
+	if !c.Bool("chain") {
+		// Falls back to the chain below if no daemon answers.
+		status, _ = fbot.QueryDaemonStatus(config.DaemonAddr())
+	}
+
+	if status == nil {
+		runner, err := newRunner()
+		if err != nil {
+			return err
+		}
+
+		chainStatus, err := runner.Bot.FetchStatus(context.Background())
+		if err != nil {
+			return err
+		}
+		status = &chainStatus
+	}
+
+	if c.Bool("json") {
+		bz, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bz))
+		return nil
+	}
+
+	printStatus(status)
+
+	return nil
+}
+
+func printStatus(status *fbot.BotStatus) {
+
+	fmt.Printf("Address: %s\n", status.Address)
+	fmt.Printf("Block:   %d\n", status.BlockHeight)
+	fmt.Printf("NAV:     %s %s\n", formatDec(status.Nav), fbot.NAV_DENOM)
+	fmt.Printf("State:   %s (from %s, %s)\n", status.RunState, status.Source,
+		status.UpdatedAt.Format("2006-01-02 15:04:05 MST"))
+	if status.BreakerTrip != "" {
+		fmt.Printf("Breaker: %s\n", status.BreakerTrip)
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "PAIR\tSIZE\tENTRY\tMARK\tINDEX\tUNREALIZED PNL\tMARGIN RATIO\tMAINT. RATIO\tTO LIQUIDATION\tFUNDING")
+	for _, pos := range status.Positions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			pos.Pair, formatDec(pos.Size), formatDec(pos.EntryPrice),
+			formatDec(pos.MarkPrice), formatDec(pos.IndexPrice),
+			formatDec(pos.UnrealizedPnl), formatDec(pos.MarginRatio),
+			formatDec(pos.MaintenanceMarginRatio), formatDec(pos.LiquidationDistance),
+			pos.FundingDirection(),
+		)
+	}
+	if len(status.Positions) == 0 {
+		fmt.Fprintln(w, "(no open positions)")
+	}
+	w.Flush()
+
+	fmt.Println()
+
+	fmt.Fprintln(w, "DENOM\tBALANCE")
+	for _, coin := range status.WalletCoins {
+		fmt.Fprintf(w, "%s\t%s\n", coin.Denom, coin.Amount)
+	}
+	w.Flush()
+
+	if len(status.BalanceDiffs) == 0 {
+		return
+	}
+
+	fmt.Println()
+	fmt.Println("Local balances differed from chain at the last refresh:")
+	fmt.Fprintln(w, "PAIR\tDENOM\tLOCAL\tCHAIN\tDELTA")
+	for _, diff := range status.BalanceDiffs {
+		pair := diff.Pair
+		if pair == "" {
+			pair = "(wallet)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pair, diff.Denom, diff.Local, diff.Chain, diff.Delta())
+	}
+	w.Flush()
+}
+
+// formatDec prints a Dec with at most 6 decimal places, without trailing zeros.
+func formatDec(dec sdk.Dec) string {
+
+	if dec.IsNil() {
+		return "-"
+	}
+
+	str := dec.String()
+	if point := strings.Index(str, "."); point >= 0 {
+		if len(str) > point+7 {
+			str = str[:point+7]
+		}
+		str = strings.TrimRight(strings.TrimRight(str, "0"), ".")
+	}
+	if str == "-0" {
+		return "0"
+	}
+
+	return str
+}